@@ -6,9 +6,64 @@ CREATE TABLE users (
   id SERIAL PRIMARY KEY,
   username VARCHAR(50) NOT NULL,
   email VARCHAR(50) NOT NULL,
-  encrypted_pw VARCHAR(100) NOT NULL
+  encrypted_pw VARCHAR(100) NOT NULL,
+  plan VARCHAR(20) NOT NULL DEFAULT 'free',
+  role VARCHAR(20) NOT NULL DEFAULT 'user',
+  totp_secret VARCHAR(64),
+  totp_enabled BOOLEAN NOT NULL DEFAULT false,
+  totp_last_step BIGINT NOT NULL DEFAULT 0,
+  failed_sign_ins INT NOT NULL DEFAULT 0,
+  locked_until BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE user_recovery_codes (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash CHAR(64) NOT NULL,
+  when_created BIGINT NOT NULL,
+  when_used BIGINT
+);
+
+CREATE INDEX user_recovery_codes_user_id_idx ON user_recovery_codes (user_id);
+
+CREATE TABLE user_identities (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  provider VARCHAR(50) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  email VARCHAR(320),
+  when_created BIGINT NOT NULL,
+  when_last_used BIGINT NOT NULL,
+  UNIQUE (provider, subject)
+);
+
+CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
+
+CREATE TABLE user_sessions (
+  id SERIAL PRIMARY KEY,
+  token_hash CHAR(64) NOT NULL UNIQUE,
+  name VARCHAR(50) NOT NULL,
+  user_id INT REFERENCES users(id) ON DELETE CASCADE,
+  data BYTEA NOT NULL,
+  user_agent VARCHAR(255) NOT NULL,
+  when_created BIGINT NOT NULL,
+  when_last_seen BIGINT NOT NULL,
+  when_expires BIGINT NOT NULL
 );
 
+CREATE INDEX user_sessions_user_id_idx ON user_sessions (user_id);
+
+CREATE TABLE sign_ins (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  method VARCHAR(50) NOT NULL,
+  user_agent VARCHAR(255) NOT NULL,
+  ip_address VARCHAR(64) NOT NULL,
+  when_created BIGINT NOT NULL
+);
+
+CREATE INDEX sign_ins_user_id_idx ON sign_ins (user_id);
+
 CREATE TABLE pending_activations (
   id SERIAL PRIMARY KEY,
   username VARCHAR(50) NOT NULL,
@@ -28,6 +83,15 @@ CREATE TABLE password_reset_requests (
   code_attempts INT NOT NULL
 );
 
+CREATE TABLE email_change_requests (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+  new_email VARCHAR(50) NOT NULL,
+  code VARCHAR(100) NOT NULL,
+  expiry BIGINT NOT NULL,
+  code_attempts INT NOT NULL
+);
+
 CREATE TABLE coding_sessions (
   id SERIAL PRIMARY KEY,
   user_id INT REFERENCES users(id) ON DELETE CASCADE,
@@ -36,3 +100,62 @@ CREATE TABLE coding_sessions (
   when_created BIGINT NOT NULL,
   when_accessed BIGINT NOT NULL
 );
+
+CREATE TABLE runs (
+  id SERIAL PRIMARY KEY,
+  coding_session_id INT REFERENCES coding_sessions(id) ON DELETE CASCADE,
+  run_uid VARCHAR(32) NOT NULL,
+  lang VARCHAR(20) NOT NULL,
+  code TEXT NOT NULL,
+  output TEXT NOT NULL,
+  stdout TEXT NOT NULL,
+  stderr TEXT NOT NULL,
+  output_truncated BOOLEAN NOT NULL,
+  split BOOLEAN NOT NULL,
+  exit_status INT,
+  exception_class VARCHAR(100),
+  timed_out BOOLEAN NOT NULL,
+  interrupted BOOLEAN NOT NULL,
+  output_bytes INT NOT NULL,
+  when_started BIGINT NOT NULL,
+  when_ended BIGINT NOT NULL,
+  wall_time_ms BIGINT NOT NULL
+);
+
+CREATE INDEX runs_coding_session_id_idx ON runs (coding_session_id);
+
+CREATE TABLE recordings (
+  id SERIAL PRIMARY KEY,
+  coding_session_id INT REFERENCES coding_sessions(id) ON DELETE CASCADE,
+  cast_data TEXT NOT NULL,
+  truncated BOOLEAN NOT NULL,
+  when_created BIGINT NOT NULL
+);
+
+CREATE INDEX recordings_coding_session_id_idx ON recordings (coding_session_id);
+
+CREATE TABLE email_outbox (
+  id SERIAL PRIMARY KEY,
+  from_addr VARCHAR(320) NOT NULL,
+  to_addr VARCHAR(320) NOT NULL,
+  subject TEXT NOT NULL,
+  body TEXT NOT NULL,
+  html_body TEXT NOT NULL,
+  status VARCHAR(20) NOT NULL,
+  attempts INT NOT NULL,
+  last_error TEXT,
+  next_attempt BIGINT NOT NULL,
+  when_created BIGINT NOT NULL,
+  when_sent BIGINT
+);
+
+CREATE INDEX email_outbox_pending_idx ON email_outbox (next_attempt) WHERE status = 'pending';
+
+CREATE TABLE rate_limit_buckets (
+  key VARCHAR(400) PRIMARY KEY,
+  tokens DOUBLE PRECISION NOT NULL,
+  when_updated DOUBLE PRECISION NOT NULL,
+  when_full DOUBLE PRECISION NOT NULL
+);
+
+CREATE INDEX rate_limit_buckets_when_full_idx ON rate_limit_buckets (when_full);
@@ -79,6 +79,7 @@ function CodeArea () {
   const [participantNames, setParticipantNames] = useState(null);
   const codeSessionID = useRef(-1);
   const running = useRef(false);
+  const lastRunResult = useRef(null);
   const [language, setLanguage] = useState('');
   const ydoc = useRef(null);
   const yCode = useRef(null);
@@ -90,6 +91,15 @@ function CodeArea () {
   const initialX = useRef(null);
   const [cmWidth, setCmWidth] = useState('50%');
   const [termWidth, setTermWidth] = useState('50%');
+  const [inputLocked, setInputLocked] = useState(false);
+  const [lockHolder, setLockHolder] = useState(null);
+  const [editorReadOnly, setEditorReadOnly] = useState(false);
+  // Copies of the lock state for handlers set up once (e.g., key
+  // bindings), which would otherwise see stale values
+  const inputLockedRef = useRef(false);
+  const lockHolderIDRef = useRef(null);
+  const wsClientID = useRef(null);
+  const wsClientToken = useRef(null);
   const [minCmWidth, minTermWidth] = [150, 150];
   const [replTitle, setReplTitle] = useState('');
   const [cmTitle, setCmTitle] = useState('');
@@ -106,6 +116,7 @@ function CodeArea () {
   const [showRoomClosedDialog, setShowRoomClosedDialog] = useState(false);
   const [popupMessage, setPopupMessage] = useState('');
   const [vimKeysSelected, setVimKeysSelected] = useState(false);
+  const [separateStderrSelected, setSeparateStderrSelected] = useState(false);
   const nowOnlineEvent = new Event('nowonline');
   const defaultKeyMap = 'sublime';
   let setupDoneTimestamp;
@@ -335,9 +346,14 @@ function CodeArea () {
                 ref={settingsDomRef}
                 className='editor-settings'
                 enabled={selectButtonsEnabled}
-                options={[{ value: 'vimkeys', label: `${vimKeysSelected ? '\u2611' : '\u2610'} Vim keys` }]}
+                options={[{ value: 'vimkeys', label: `${vimKeysSelected ? '\u2611' : '\u2610'} Vim keys` },
+                          { value: 'separatestderr', label: `${separateStderrSelected ? '\u2611' : '\u2610'} Separate stderr` }]}
                 callback={(ev) => {
-                  setVimKeysSelected(!vimKeysSelected);
+                  if (ev.target.dataset.value === 'separatestderr') {
+                    setSeparateStderrSelected(!separateStderrSelected);
+                  } else {
+                    setVimKeysSelected(!vimKeysSelected);
+                  }
                 }}
                 config={{ staticTitle: true, titleImage: './images/settings.png' }}
               />
@@ -373,7 +389,11 @@ function CodeArea () {
               <Select
                 enabled={selectButtonsEnabled}
                 options={[{ value: 'clear', label: 'Clear' },
-                          { value: 'reset', label: 'Reset' }]}
+                          { value: 'reset', label: 'Reset' },
+                          ...(language === 'postgres' ? [{ value: 'resetdb', label: 'Reset database' }] : []),
+                          ...getInputLockOptions(),
+                          ...getEditorAccessOptions(),
+                          ...(isAuthedCreator.current ? [{ value: 'recording', label: 'Download recording' }] : [])]}
                 title='Actions'
                 callback={executeReplAction}
                 config={{ staticTitle: true }}
@@ -489,6 +509,7 @@ function CodeArea () {
     participantDetails.set('joinTime', currentTime);
     const stringID = ydoc.current.clientID.toString();
     participants.current.set(stringID, participantDetails);
+    sendIdentify();
     // Remove participant immediately if user leaves room. Note
     // that this doesn't handle the case of a user leaving room
     // because of losing the connection or device sleeping --
@@ -514,11 +535,158 @@ function CodeArea () {
   function executeReplAction (ev) {
     switch (ev.target.dataset.value) {
     case 'clear':
-      setYjsFlag(flagClear.current);
+      if (hasTerminalControl()) {
+        setYjsFlag(flagClear.current);
+      }
       break;
     case 'reset':
-      switchLanguage(language);
+      resetRepl(false);
+      break;
+    case 'resetdb':
+      resetRepl(true);
+      break;
+    case 'recording':
+      window.location.assign(`/api/rooms/${params.roomID}/recording`);
+      break;
+    case 'lockon':
+      setInputLock(true);
+      break;
+    case 'lockoff':
+      setInputLock(false);
+      break;
+    case 'lockrequest':
+      sendWsMessage('LOCKREQUEST');
+      break;
+    case 'lockrelease':
+      sendWsMessage('LOCKRELEASE');
       break;
+    case 'readonlyon':
+      requestEditorReadOnly(true);
+      break;
+    case 'readonlyoff':
+      requestEditorReadOnly(false);
+      break;
+    }
+  }
+
+  function getEditorAccessOptions () {
+    if (!isAuthedCreator.current) {
+      return [];
+    }
+    return [editorReadOnly
+      ? { value: 'readonlyoff', label: 'Let everyone edit' }
+      : { value: 'readonlyon', label: 'Make editor read-only' }];
+  }
+
+  async function requestEditorReadOnly (readOnly) {
+    const options = {
+      method: 'POST',
+      mode: 'cors',
+      headers: { 'Content-Type': 'application/json;charset=utf-8' },
+      body: JSON.stringify({ readOnly })
+    };
+    try {
+      const response = await fetch(`/api/rooms/${params.roomID}/editor-read-only`, options);
+      const json = await response.json();
+      if (json.status !== 'success') {
+        showPopup('Unable to change editor access');
+      }
+    } catch (error) {
+      showPopup('Unable to change editor access');
+    }
+  }
+
+  // The room owner can always edit
+  function applyEditorReadOnly (readOnly) {
+    setEditorReadOnly(readOnly);
+    if (!isAuthedCreator.current) {
+      cmRef.current?.setOption('readOnly', readOnly);
+    }
+  }
+
+  function getInputLockOptions () {
+    const options = [];
+    if (isAuthedCreator.current) {
+      options.push(inputLocked
+        ? { value: 'lockoff', label: 'Unlock input' }
+        : { value: 'lockon', label: 'Lock input' });
+    }
+    if (inputLocked) {
+      options.push(lockHolder?.id === wsClientID.current
+        ? { value: 'lockrelease', label: 'Release control' }
+        : { value: 'lockrequest', label: 'Request control' });
+    }
+    return options;
+  }
+
+  async function setInputLock (enabled) {
+    const options = {
+      method: 'POST',
+      mode: 'cors',
+      headers: { 'Content-Type': 'application/json;charset=utf-8' },
+      body: JSON.stringify({ enabled })
+    };
+    try {
+      const response = await fetch(`/api/rooms/${params.roomID}/input-lock`, options);
+      const json = await response.json();
+      if (json.status !== 'success') {
+        showPopup('Unable to change input lock');
+      }
+    } catch (error) {
+      showPopup('Unable to change input lock');
+    }
+  }
+
+  function sendWsMessage (message) {
+    try {
+      ws.current.send(message);
+    } catch {
+      handleConnectionChange();
+    }
+  }
+
+  // Let the server know the name to attribute this user's
+  // terminal input to
+  function sendIdentify () {
+    if (username.current && ws.current?.readyState === WebSocket.OPEN) {
+      ws.current.send('IDENTIFY:' + username.current);
+    }
+  }
+
+  function handleLockHolderMessage (data) {
+    const details = data.slice('LOCKHOLDER:'.length);
+    if (details === '') {
+      lockHolderIDRef.current = null;
+      setLockHolder(null);
+      return;
+    }
+    const sepIdx = details.indexOf(':');
+    lockHolderIDRef.current = Number(details.slice(0, sepIdx));
+    setLockHolder({ id: lockHolderIDRef.current, name: details.slice(sepIdx + 1) });
+  }
+
+  // Running code, stopping a run, resetting the REPL, clearing
+  // the terminal and switching language need control of the
+  // terminal while input is locked
+  function holdsTerminalControl () {
+    return !inputLockedRef.current || lockHolderIDRef.current === wsClientID.current;
+  }
+
+  function hasTerminalControl () {
+    if (!holdsTerminalControl()) {
+      showPopup('Request control of the terminal first');
+      return false;
+    }
+    return true;
+  }
+
+  function handleLockRequestedMessage (data) {
+    const details = data.slice('LOCKREQUESTED:'.length);
+    const sepIdx = details.indexOf(':');
+    const id = details.slice(0, sepIdx);
+    const name = details.slice(sepIdx + 1);
+    if (window.confirm(`${name} would like to take over the terminal. Pass control to them?`)) {
+      sendWsMessage('LOCKPASS:' + id);
     }
   }
 
@@ -635,6 +803,21 @@ function CodeArea () {
     elem.onpointermove = null;
     elem.onpointerleave = null;
     elem.releasePointerCapture(event.pointerId);
+    sendTermSize();
+  }
+
+  // Let the server know how many columns fit in this user's
+  // terminal pane. The server picks the size for the whole room and
+  // sends it back in a TERMSIZE message.
+  function sendTermSize () {
+    const dims = term.current?._core?._renderService?.dimensions;
+    if (!dims?.actualCellWidth || ws.current?.readyState !== WebSocket.OPEN) {
+      return;
+    }
+    const minCols = 20;
+    // Leave a column free for the scrollbar
+    const cols = Math.max(minCols, Math.floor(termDomRef.current.clientWidth / dims.actualCellWidth) - 1);
+    ws.current.send(`RESIZE:${cols},${initialTermRows}`);
   }
 
   async function getCodeSessionID (roomID) {
@@ -656,6 +839,22 @@ function CodeArea () {
     return -1;
   }
 
+  async function getYjsToken (roomID) {
+    const options = {
+      method: 'GET',
+      mode: 'cors'
+    };
+
+    try {
+      const response = await fetch(`/api/rooms/${roomID}/yjs-token`, options);
+      const json = await response.json();
+      return json.status === 'success' ? json.token : null;
+    } catch (error) {
+      console.error('Error fetching json:', error);
+      return null;
+    }
+  }
+
   function setRoomStatusOpen (roomID) {
     const body = JSON.stringify({ roomID });
     const options = {
@@ -817,7 +1016,7 @@ function CodeArea () {
     const initialLang = initialVars.language;
     const initialHist = initialVars.history;
 
-    setupTerminal(initialHist);
+    setupTerminal(initialHist, initialVars.termCols);
 
     ws.current = openWs(roomID);
 
@@ -839,6 +1038,7 @@ function CodeArea () {
     setShowCodeMirror(true);
 
     cmRef.current = setupCodeMirror();
+    applyEditorReadOnly(initialVars.editorReadOnly);
 
     if (setupCanceled.current) {
       return;
@@ -851,10 +1051,23 @@ function CodeArea () {
 
     yCode.current = ydoc.current.getText('codemirror');
 
-    // y.js connection provider
+    // y.js connection provider. The token is only checked when the
+    // websocket connects, so it is renewed before it expires for
+    // the provider to use on reconnects.
+    const yjsServerUrl = window.location.origin.replace(/^http/, 'ws') + '/api/yjs';
     wsProvider.current = new WebsocketProvider(
-      window.location.origin.replace(/^http/, 'ws') + '/ywebsocketprovider', 'nicks-cm-room-' + roomID, ydoc.current
+      yjsServerUrl, roomID, ydoc.current, { params: { token: initialVars.yjsToken } }
     );
+    const yjsTokenInterval = setInterval(async () => {
+      if (setupCanceled.current) {
+        clearInterval(yjsTokenInterval);
+        return;
+      }
+      const token = await getYjsToken(roomID);
+      if (token !== null && wsProvider.current) {
+        wsProvider.current.url = `${yjsServerUrl}/${roomID}?token=${encodeURIComponent(token)}`;
+      }
+    }, initialVars.yjsTokenTTL * 1000 / 2);
 
     const binding = new CodemirrorBinding(yCode.current, cmRef.current, wsProvider.current.awareness);
 
@@ -1058,13 +1271,15 @@ function CodeArea () {
     setParticipantNames(nameList);
   }
 
-  function setupTerminal (initialHist) {
+  function setupTerminal (initialHist, initialCols) {
     term.current = new Terminal({
       fontSize: 12,
       fontFamily: 'courier, monospace'
     });
     term.current.open(termDomRef.current);
-    term.current.resize(term.current.cols, initialTermRows);
+    // Start out at the room's terminal size, so that the history
+    // wraps the same way it did for everybody else
+    term.current.resize(initialCols || term.current.cols, initialTermRows);
     writeToTerminal(initialHist);
     term.current.onData((data) => {
       // Ignore all keypresses except ctrl-c if code running
@@ -1073,7 +1288,9 @@ function CodeArea () {
       }
       // If ctrl-l (lowecase L) pressed
       if (data.charCodeAt() === 12) {
-        setYjsFlag(flagClear.current);
+        if (holdsTerminalControl()) {
+          setYjsFlag(flagClear.current);
+        }
       } else {
         try {
           ws.current.send(data.toString());
@@ -1176,6 +1393,7 @@ function CodeArea () {
   function setupResizeEventListener () {
     window.addEventListener('resize', () => {
       handleResize();
+      debounce(sendTermSize, 200);
     });
   }
 
@@ -1419,6 +1637,9 @@ function CodeArea () {
   }
 
   async function switchLanguage (newLang) {
+    if (!hasTerminalControl()) {
+      return;
+    }
     // The auto saver conflicts with this language switching
     // process since it also sets editorContents.current for the
     // current language when any changes are observed in the
@@ -1433,14 +1654,15 @@ function CodeArea () {
       headers: { 'Content-Length': '0' }
     };
     try {
-      const response = await fetch(`/api/switch-language?roomID=${roomID}&lang=${newLang}`, options);
+      const query = new URLSearchParams({ roomID, lang: newLang, clientToken: wsClientToken.current || '' });
+      const response = await fetch(`/api/switch-language?${query}`, options);
       const json = await response.json();
       if (json.status === 'done') {
         termDomRef.current.scroll({ top: 0, left: 0, behavior: 'smooth' });
         showTitles(newLang);
         cmRef.current.setValue(editorContents.current.has(newLang) ? editorContents.current.get(newLang) : '');
       } else {
-        showPopup('Unable to switch language');
+        showPopup(json.reason || 'Unable to switch language');
       }
     } catch (error) {
       showPopup('Unable to switch language');
@@ -1449,6 +1671,28 @@ function CodeArea () {
     }
   }
 
+  async function resetRepl (dropDatabase) {
+    if (!hasTerminalControl()) {
+      return;
+    }
+    const body = JSON.stringify({ dropDatabase, clientToken: wsClientToken.current });
+    const options = {
+      method: 'POST',
+      mode: 'cors',
+      headers: { 'Content-Type': 'application/json;charset=utf-8' },
+      body: body
+    };
+    try {
+      const response = await fetch(`/api/rooms/${params.roomID}/reset-repl`, options);
+      const json = await response.json();
+      if (json.status !== 'success') {
+        showPopup(json.reason || 'Unable to reset REPL');
+      }
+    } catch (error) {
+      showPopup('Unable to reset REPL');
+    }
+  }
+
   /**
    * --Shared flag setter--
    * Push a timestamp onto the shared flag to trigger the desired
@@ -1460,9 +1704,15 @@ function CodeArea () {
 
   async function clearTerminal () {
     term.current.clear();
+    // Every client clears its own terminal; the one in control of
+    // it clears the server's copy
+    if (!holdsTerminalControl()) {
+      termDomRef.current.scroll({ top: 0, left: 0, behavior: 'smooth' });
+      return;
+    }
     const { lastLine } = getLastTermLineAndNumber();
     const roomID = params.roomID;
-    const body = JSON.stringify({ lastLine, roomID });
+    const body = JSON.stringify({ lastLine, roomID, clientToken: wsClientToken.current });
     const options = {
       method: 'POST',
       mode: 'cors',
@@ -1506,7 +1756,7 @@ function CodeArea () {
     const newArr = [];
     for (let i = 0; i < text.length; i++) {
       cnt++;
-      if (cnt > initialTermCols) {
+      if (cnt > term.current.cols) {
         newArr.push('\n' + text[i]);
         cnt = 1;
         continue;
@@ -1539,7 +1789,15 @@ function CodeArea () {
   }
 
   function runCode (filename, lines, promptLineEmpty) {
-    const body = JSON.stringify({ roomID: params.roomID, lang: lang.current, filename, lines, promptLineEmpty });
+    const body = JSON.stringify({
+      roomID: params.roomID,
+      lang: lang.current,
+      filename,
+      lines,
+      promptLineEmpty,
+      separateStderr: separateStderrSelected,
+      clientToken: wsClientToken.current
+    });
     const options = {
       method: 'POST',
       mode: 'cors',
@@ -1560,9 +1818,32 @@ function CodeArea () {
     //                          `/api/openreplws?lang=${language}`);
     const ws = new WebSocket(window.location.origin.replace(/^http/, 'ws') +
                              '/api/open-ws?roomID=' + roomID);
+    ws.onopen = () => {
+      sendTermSize();
+      sendIdentify();
+    };
     ws.onmessage = ev => {
       if (ev.data === 'RESETTERMINAL') {
         resetTerminal();
+      } else if (ev.data.startsWith('CLIENTID:')) {
+        const [id, token] = ev.data.slice('CLIENTID:'.length).split(':');
+        wsClientID.current = Number(id);
+        wsClientToken.current = token;
+      } else if (ev.data.startsWith('INPUTLOCK:')) {
+        inputLockedRef.current = ev.data === 'INPUTLOCK:on';
+        setInputLocked(inputLockedRef.current);
+      } else if (ev.data.startsWith('EDITORREADONLY:')) {
+        applyEditorReadOnly(ev.data === 'EDITORREADONLY:on');
+      } else if (ev.data.startsWith('LOCKHOLDER:')) {
+        handleLockHolderMessage(ev.data);
+      } else if (ev.data.startsWith('LOCKREQUESTED:')) {
+        handleLockRequestedMessage(ev.data);
+      } else if (ev.data === 'LOCKDENIED') {
+        showPopup('Request control of the terminal to type in it');
+      } else if (ev.data.startsWith('TERMSIZE:')) {
+        const [cols, rows] = ev.data.slice('TERMSIZE:'.length).split(',').map(Number);
+        term.current.resize(cols, rows);
+        debounce(alignLastLineToBottom, 100);
       } else if (ev.data === 'TIMEOUT' || ev.data === 'CONTAINERERROR') {
         running.current = false;
         runButtonDone();
@@ -1573,6 +1854,20 @@ function CodeArea () {
       } else if (ev.data === 'RUNDONE' || ev.data === 'CANCELRUN') {
         running.current = false;
         runButtonDone();
+      } else if (ev.data.startsWith('RUNCANCELLED:')) {
+        running.current = false;
+        runButtonDone();
+      } else if (ev.data === 'OUTPUTTRUNCATED') {
+        // The server has started dropping output because there is
+        // too much of it. A marker showing where the gap is arrives
+        // as regular output, so there is nothing more to do here.
+      } else if (ev.data.startsWith('RUNRESULT:')) {
+        lastRunResult.current = JSON.parse(ev.data.slice('RUNRESULT:'.length));
+      } else if (ev.data.startsWith('STDERR:')) {
+        // Show stderr from split mode runs in red
+        writeToTerminal('\x1b[31m' + ev.data.slice('STDERR:'.length) + '\x1b[0m');
+      } else if (ev.data.startsWith('STDOUT:')) {
+        writeToTerminal(ev.data.slice('STDOUT:'.length));
       } else {
         writeToTerminal(ev.data);
       }
@@ -1601,11 +1896,23 @@ function CodeArea () {
   }
 
   function stopRun () {
-    // Send ctrl-c
-    ws.current.send('\x03');
+    if (!hasTerminalControl()) {
+      return;
+    }
+    const body = JSON.stringify({ clientToken: wsClientToken.current });
+    const options = {
+      method: 'POST',
+      mode: 'cors',
+      headers: { 'Content-Type': 'application/json;charset=utf-8' },
+      body: body
+    };
+    fetch(`/api/rooms/${params.roomID}/interrupt`, options);
   }
 
   async function executeContent () {
+    if (!hasTerminalControl()) {
+      return;
+    }
     setYjsFlag(flagRun.current);
     const prompt = /> $/;
     const { lastLine } = getLastTermLineAndNumber();
@@ -1628,7 +1935,7 @@ function CodeArea () {
       filename = 'code.sql';
       break;
     }
-    const body = JSON.stringify({ content, filename, roomID: params.roomID });
+    const body = JSON.stringify({ content, filename, roomID: params.roomID, clientToken: wsClientToken.current });
     const options = {
       method: 'POST',
       mode: 'cors',
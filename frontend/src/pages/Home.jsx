@@ -46,6 +46,13 @@ function Home () {
       }
       setAuth(userInfo.auth);
       setAuthChecked(true);
+      // Sign-in through a provider or link failed, needs a 2FA
+      // code, or a password is being reset from a link; the
+      // sign-in form takes it from there
+      const params = new URLSearchParams(window.location.search);
+      if (!userInfo.auth && ['authError', 'twoFactor', 'resetToken'].some(p => params.has(p))) {
+        setShowAuth(true);
+      }
 
       setupWindowResizeListener(() => {
         debounce(changeCSSInnerHeight, 100);
@@ -11,6 +11,9 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
   const [newPassword, setNewPassword] = useState('');
   const [newPasswordDup, setNewPasswordDup] = useState('');
   const [resetCode, setResetCode] = useState('');
+  const [twoFactorCode, setTwoFactorCode] = useState('');
+  // Token from a password reset link, in place of the email and code
+  const [resetToken, setResetToken] = useState('');
   const [emailValidationError, setEmailValidationError] = useState('');
   const [emailForgotPwValidationError, setEmailForgotPwValidationError] = useState('');
   const [passwordValidationError, setPasswordValidationError] = useState('');
@@ -21,6 +24,7 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
   const [status, setStatus] = useState('pre');
   const [showSpinner, setShowSpinner] = useState(false);
   const [showBackdrop, setShowBackdrop] = useState(false);
+  const [oauthProviders, setOAuthProviders] = useState([]);
   const forgotPasswordEmailInput = useRef(null);
   const resetPasswordForm = useRef(null);
   const emailInput = useRef(null);
@@ -28,6 +32,7 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
   const newPasswordInput = useRef(null);
   const newPasswordDupInput = useRef(null);
   const resetCodeInput = useRef(null);
+  const twoFactorCodeInput = useRef(null);
   const popupTimeout = useRef(null);
   const spinnerStartTimeout = useRef(null);
   const inputs = [emailInput, passwordInput];
@@ -37,6 +42,43 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
     setSavedSignInStatus(status);
   }, [status]);
 
+  useEffect(() => {
+    let isCanceled = false;
+    (async () => {
+      const providers = await getOAuthProviders();
+      if (!isCanceled) {
+        setOAuthProviders(providers);
+      }
+    })();
+
+    const params = new URLSearchParams(window.location.search);
+    if (params.has('authError')) {
+      showPopup(params.get('authError'));
+      params.delete('authError');
+      const query = params.toString();
+      window.history.replaceState(null, '', window.location.pathname + (query ? '?' + query : ''));
+    }
+    // Password reset links come back here for the new password
+    if (params.has('resetToken')) {
+      setResetToken(params.get('resetToken'));
+      setStatus('resetPassword');
+      params.delete('resetToken');
+      const query = params.toString();
+      window.history.replaceState(null, '', window.location.pathname + (query ? '?' + query : ''));
+    }
+    // Sign-in provider accounts with 2FA come back here for the code
+    if (params.has('twoFactor')) {
+      setStatus('twoFactor');
+      params.delete('twoFactor');
+      const query = params.toString();
+      window.history.replaceState(null, '', window.location.pathname + (query ? '?' + query : ''));
+    }
+
+    return function cleanup () {
+      isCanceled = true;
+    };
+  }, []);
+
   return (
     <>
       <div className='popup-container'>
@@ -109,6 +151,15 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
             <span className='form__error-item'>{passwordValidationError}</span>
           </p>
           <button className='form__submit-button u-center-block u-marg-top-1 u-marg-bot-2' type='submit'>Sign in</button>
+          {oauthProviders.map(provider => (
+            <a
+              key={provider.name}
+              className='form__submit-button u-center-block u-marg-bot-2'
+              href={`/api/oauth/${provider.name}/start?return=${encodeURIComponent(window.location.pathname)}`}
+            >
+              Sign in with {provider.displayName}
+            </a>
+          ))}
           <span
             className='form__bottom-link u-marg-top-3'
             onPointerDown={(ev) => handlePointerDown(ev, showForgotPassword, ev)}
@@ -116,6 +167,49 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
             Forgot your password?
           </span>
         </form>}
+      {status === 'twoFactor' &&
+        <form noValidate className='form' onSubmit={handleSubmitTwoFactor}>
+          {showBackdrop && <div className='backdrop backdrop--transparent backdrop--level2' />}
+          {showSpinner &&
+            <div>
+              <div className='spinner-container spinner-container--small'>
+                <FadeLoader
+                  color='#369999'
+                  loading={showSpinner}
+                  size={50}
+                />
+              </div>
+            </div>}
+          <div className='form__subheading form__subheading-medium u-pad-bot-3'>
+            Enter the code from your authenticator app, or one of your recovery codes
+          </div>
+          <div>
+            <label className='form__label form__label--code u-center-text u-marg-bot-1' htmlFor='twoFactorCode'>
+              Code:
+            </label>
+            <input
+              id='twoFactorCode'
+              className='form__input form__input--code u-center-block'
+              name='twoFactorCode'
+              type='text'
+              size='11'
+              autoComplete='one-time-code'
+              value={twoFactorCode}
+              ref={twoFactorCodeInput}
+              data-validation='Code'
+              required
+              onChange={handleTwoFactorChange}
+            />
+            <div className='form__error-item form__error-item--code u-center-text'>{codeValidationError}</div>
+          </div>
+          <button className='form__submit-button u-center-block u-marg-top-1' type='submit'>Verify</button>
+          <span
+            className='form__bottom-link u-marg-top-3'
+            onPointerDown={(ev) => handlePointerDown(ev, goBackToSignIn, ev)}
+          >
+            Go back to sign-in form
+          </span>
+        </form>}
       {status === 'forgotPassword' &&
         <div>
           <form noValidate className='form' onSubmit={handleSubmitForgotPassword}>
@@ -238,6 +332,7 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
             <span className='form__blank-item' />
             <span className='form__error-item'>{newPasswordDupValidationError}</span>
           </p>
+          {!resetToken &&
           <div>
             <label className='form__label form__label--code u-center-text u-marg-bot-1' htmlFor='resetCode'>
               Reset code:
@@ -255,7 +350,7 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
               onChange={handlePasswordResetChange}
             />
             <div className='form__error-item form__error-item--code u-center-text'>{codeValidationError}</div>
-          </div>
+          </div>}
           <button className='form__submit-button u-center-block u-marg-top-1' type='submit'>Reset password</button>
           <span
             className='form__bottom-link u-marg-top-3'
@@ -277,8 +372,19 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
     </>
   );
 
+  async function getOAuthProviders () {
+    try {
+      const response = await fetch('/api/oauth-providers', { method: 'GET', mode: 'cors' });
+      const json = await response.json();
+      return json.providers || [];
+    } catch (error) {
+      return [];
+    }
+  }
+
   function goBackToSignIn () {
     setForgotPasswordEmail('');
+    setTwoFactorCode('');
     clearPasswordResetValues();
     setStatus('pre');
   }
@@ -310,6 +416,14 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
     }
   }
 
+  function handleTwoFactorChange (ev) {
+    setTwoFactorCode(ev.target.value);
+
+    if (ev.target.classList.contains('invalid')) {
+      validate(ev.target);
+    }
+  }
+
   function handlePasswordResetChange (ev) {
     switch (ev.target.name) {
     case 'newPassword':
@@ -346,6 +460,7 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
       setNewPasswordDupValidationError(errorMsg);
       break;
     case 'resetCode':
+    case 'twoFactorCode':
       setCodeValidationError(errorMsg);
       break;
     }
@@ -393,6 +508,7 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
     setNewPassword('');
     setNewPasswordDup('');
     setResetCode('');
+    setResetToken('');
   }
 
   function displaySpinnerAndBackdrop () {
@@ -412,12 +528,14 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
     ev.preventDefault();
     const passwordValid = validate(newPasswordInput.current);
     const passwordDupValid = validate(newPasswordDupInput.current);
-    const codeValid = validate(resetCodeInput.current);
+    const codeValid = resetToken || validate(resetCodeInput.current);
     if (!(passwordValid && passwordDupValid && codeValid)) {
       return;
     }
 
-    const body = JSON.stringify({ email: forgotPasswordEmail, code: resetCode, newPlaintextPW: newPassword });
+    const body = resetToken
+      ? JSON.stringify({ token: resetToken, newPlaintextPW: newPassword })
+      : JSON.stringify({ email: forgotPasswordEmail, code: resetCode, newPlaintextPW: newPassword });
     const options = {
       method: 'POST',
       mode: 'cors',
@@ -442,7 +560,45 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
     }
   }
 
-  function handleSubmitForgotPassword (ev) {
+  async function handleSubmitTwoFactor (ev) {
+    ev.preventDefault();
+    if (!validate(twoFactorCodeInput.current)) {
+      return;
+    }
+
+    const body = JSON.stringify({ code: twoFactorCode });
+    const options = {
+      method: 'POST',
+      mode: 'cors',
+      headers: { 'Content-Type': 'application/json;charset=utf-8' },
+      body: body
+    };
+
+    displaySpinnerAndBackdrop();
+    try {
+      const response = await fetch('/api/sign-in-2fa', options);
+      const json = await response.json();
+      hideSpinnerAndBackdrop();
+      if (json.status === 'success') {
+        setShowAuth(false);
+        setAuthed(true);
+        if (config.successCallback) {
+          config.successCallback();
+        }
+      } else {
+        setTwoFactorCode('');
+        if (json.restart) {
+          goBackToSignIn();
+        }
+        showPopup(json.reason);
+      }
+    } catch (error) {
+      hideSpinnerAndBackdrop();
+      showPopup('Error processing sign-in request');
+    }
+  }
+
+  async function handleSubmitForgotPassword (ev) {
     ev.preventDefault();
     if (!validate(forgotPasswordEmailInput.current)) {
       return;
@@ -456,9 +612,19 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
       body: body
     };
 
+    try {
+      const response = await fetch('/api/forgot-password', options);
+      const json = await response.json();
+      if (json.magicLink) {
+        showPopup('Check your email for a link to reset your password');
+        goBackToSignIn();
+        return;
+      }
+    } catch (error) {
+      // Carry on to the code form regardless
+    }
     showPopup('Check your email for reset code');
     setStatus('resetPassword');
-    fetch('/api/forgot-password', options);
   }
 
   async function handleSubmit (ev) {
@@ -495,6 +661,8 @@ function SignIn ({ setShowAuth, setAuthed, setSavedSignInStatus, config }) {
         if (config.successCallback) {
           config.successCallback();
         }
+      } else if (json.status === '2fa-required') {
+        setStatus('twoFactor');
       } else {
         showPopup(json.reason);
       }
@@ -16,6 +16,8 @@ function SignUp ({ setShowAuth, setAuthed, setSavedActivationStatus, config }) {
   const [codeValidationError, setCodeValidationError] = useState('');
   const [activationStatus, setActivationStatus] = useState('pre');
   const [activationCode, setActivationCode] = useState('');
+  // Whether the verification email has a link instead of a code
+  const [magicLink, setMagicLink] = useState(false);
   const [popupMessage, setPopupMessage] = useState('');
   const [failureMessage, setFailureMessage] = useState('');
   const [showSpinner, setShowSpinner] = useState(false);
@@ -183,11 +185,18 @@ function SignUp ({ setShowAuth, setAuthed, setSavedActivationStatus, config }) {
                 </div>
               </div>}
             <div className='form__subheading u-pad-bot-1'>
-              A verification code has been sent to your email address:
+              {magicLink
+                ? 'An activation link has been sent to your email address:'
+                : 'A verification code has been sent to your email address:'}
             </div>
             <div className='form__subheading form__subheading-medium u-center-text u-marg-bot-3'>
               {email}
             </div>
+            {magicLink &&
+              <div className='form__subheading u-center-text u-marg-bot-3'>
+                Open the link to complete your registration.
+              </div>}
+            {!magicLink &&
             <div>
               <label className='form__label form__label--code u-center-text u-marg-top-2 u-marg-bot-1' htmlFor='activationCode'>
                 Enter code:
@@ -205,13 +214,14 @@ function SignUp ({ setShowAuth, setAuthed, setSavedActivationStatus, config }) {
                 onChange={handleCodeChange}
               />
               <div className='form__error-item form__error-item--code u-center-text'>{codeValidationError}</div>
-            </div>
-            <button className='form__submit-button u-center-block u-marg-top-1' type='submit'>Complete Registration</button>
+            </div>}
+            {!magicLink &&
+              <button className='form__submit-button u-center-block u-marg-top-1' type='submit'>Complete Registration</button>}
             <span
               className='form__bottom-link u-marg-top-3'
               onPointerDown={(ev) => handlePointerDown(ev, resendEmail, ev)}
             >
-              Resend activation code
+              {magicLink ? 'Resend activation link' : 'Resend activation code'}
             </span>
             <span
               className='form__bottom-link u-marg-top-1'
@@ -498,6 +508,7 @@ function SignUp ({ setShowAuth, setAuthed, setSavedActivationStatus, config }) {
         setErrorMessage(emailInput.current, 'Email in use or pending activation.');
         emailInput.current.classList.add('invalid');
       } else {
+        setMagicLink(Boolean(json.magicLink));
         setActivationStatus('underway');
       }
     } catch (error) {
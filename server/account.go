@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/sessions"
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Account settings for signed-in users. Changes that could lock the
+// owner out (email, password, deleting the account) need the
+// current password. Accounts created through a sign-in provider
+// have none; they need to have signed in within reauthWindow, or a
+// 2FA code, instead. The old address is told when the email
+// changes.
+
+const emailChangeTimeout = 15 * time.Minute
+const maxEmailChangeAttempts = 3
+const minPasswordLength = 6
+
+// Time after signing in during which accounts without a password
+// can make the changes that need one
+const reauthWindow = 10 * time.Minute
+
+// Limits of the users table columns
+const maxUsernameLength = 50
+const maxEmailLength = 50
+
+type accountParams struct {
+	Username           string `json:"username"`
+	NewEmail           string `json:"newEmail"`
+	Code               string `json:"code"`
+	CurrentPlainTextPW string `json:"currentPlainTextPW"`
+	NewPlainTextPW     string `json:"newPlainTextPW"`
+	// For accounts without a password that signed in too long ago
+	TwoFactorCode string `json:"twoFactorCode"`
+}
+
+func readAccountParams(r *http.Request) (*accountParams, error) {
+	var ap accountParams
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &ap); err != nil {
+		return nil, err
+	}
+	return &ap, nil
+}
+
+var errCurrentPasswordIncorrect = errors.New("Current password incorrect")
+var errReauthRequired = errors.New("Please sign in again (or enter a two-factor code) to make this change")
+
+// Check that the user is who they say they are before a change
+// that needs it: the current password, or for accounts without
+// one, a recent sign-in or a 2FA code
+func checkCurrentPassword(session *sessions.Session, userID int, ap *accountParams) error {
+	var encryptedPW string
+	query := "SELECT encrypted_pw FROM users WHERE id = $1"
+	if err := getDBPool().QueryRow(context.Background(), query, userID).Scan(&encryptedPW); err != nil {
+		return errCurrentPasswordIncorrect
+	}
+	if encryptedPW == "" {
+		signInTime, _ := session.Values["signInTime"].(int64)
+		if time.Since(time.Unix(signInTime, 0)) < reauthWindow {
+			return nil
+		}
+		if ap.TwoFactorCode != "" && verifySecondFactor(userID, ap.TwoFactorCode) {
+			return nil
+		}
+		return errReauthRequired
+	}
+	pepperedPW := ap.CurrentPlainTextPW + os.Getenv("PWPEPPER")
+	if bcrypt.CompareHashAndPassword([]byte(encryptedPW), []byte(pepperedPW)) != nil {
+		return errCurrentPasswordIncorrect
+	}
+	return nil
+}
+
+func isValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email && utf8.RuneCountInString(email) <= maxEmailLength
+}
+
+// Whether the email belongs to an account, or one waiting to be
+// activated
+func isEmailTaken(email string) bool {
+	var tmp int
+	query := "SELECT 1 FROM users WHERE lower(email) = lower($1) UNION SELECT 1 FROM pending_activations WHERE lower(email) = lower($1)"
+	err := getDBPool().QueryRow(context.Background(), query, email).Scan(&tmp)
+	return err != pgx.ErrNoRows
+}
+
+func changeUsername(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+	ap, err := readAccountParams(r)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	username := strings.TrimSpace(ap.Username)
+	if username == "" || utf8.RuneCountInString(username) > maxUsernameLength {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Username must be between 1 and 50 characters"})
+		return
+	}
+
+	query := "UPDATE users SET username = $1 WHERE id = $2"
+	if _, err := getDBPool().Exec(context.Background(), query, username, userID); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	session.Values["username"] = username
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+// Change the password. The user's other sessions are signed out.
+func changePassword(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+	ap, err := readAccountParams(r)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	if len(ap.NewPlainTextPW) < minPasswordLength {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Password must be at least 6 characters"})
+		return
+	}
+	if err := checkCurrentPassword(session, userID, ap); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": err.Error()})
+		return
+	}
+
+	pepperedPW := ap.NewPlainTextPW + os.Getenv("PWPEPPER")
+	encryptedPW, err := bcrypt.GenerateFromPassword([]byte(pepperedPW), bcrypt.DefaultCost)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	query := "UPDATE users SET encrypted_pw = $1 WHERE id = $2"
+	if _, err := getDBPool().Exec(context.Background(), query, encryptedPW, userID); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	if err := revokeUserSessions(userID, session.ID); err != nil {
+		logger.Println("Unable to revoke sessions after password change: ", err)
+	}
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+// First step of changing the email address: a code is sent to the
+// new address, and the change is made once the user enters it
+func requestEmailChange(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+	ap, err := readAccountParams(r)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	newEmail := strings.TrimSpace(ap.NewEmail)
+	if !isValidEmail(newEmail) {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Email is invalid"})
+		return
+	}
+	if err := checkCurrentPassword(session, userID, ap); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": err.Error()})
+		return
+	}
+	if isEmailTaken(newEmail) {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Email is already in use"})
+		return
+	}
+
+	var username string
+	if err := getDBPool().QueryRow(context.Background(), "SELECT username FROM users WHERE id = $1", userID).Scan(&username); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	code, err := generateRandomCode()
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	expiry := time.Now().Add(emailChangeTimeout).Unix()
+	// Replaces any earlier request
+	query := `INSERT INTO email_change_requests(user_id, new_email, code, expiry, code_attempts) VALUES($1, $2, $3, $4, 0)
+ON CONFLICT (user_id) DO UPDATE SET new_email = $2, code = $3, expiry = $4, code_attempts = 0`
+	if _, err := getDBPool().Exec(context.Background(), query, userID, newEmail, hashVerificationCode(code), expiry); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	if err := sendEmailChangeEmail(username, newEmail, code, emailLocale(r)); err != nil {
+		logger.Println("Error in queuing email change email:", err)
+		deleteEmailChangeRec(userID)
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+func deleteEmailChangeRec(userID int) error {
+	query := "DELETE FROM email_change_requests WHERE user_id = $1"
+	_, err := getDBPool().Exec(context.Background(), query, userID)
+	return err
+}
+
+// Second step of changing the email address, with the code sent to
+// the new address
+func confirmEmailChange(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+	ap, err := readAccountParams(r)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+
+	var newEmail, code string
+	var expiry int64
+	var codeAttempts int
+	query := "SELECT new_email, code, expiry, code_attempts FROM email_change_requests WHERE user_id = $1"
+	if err := getDBPool().QueryRow(context.Background(), query, userID).Scan(&newEmail, &code, &expiry, &codeAttempts); err != nil || time.Now().Unix() > expiry {
+		deleteEmailChangeRec(userID)
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Confirmation code expired"})
+		return
+	}
+	if !checkVerificationCode(ap.Code, code) {
+		if codeAttempts+1 >= maxEmailChangeAttempts {
+			deleteEmailChangeRec(userID)
+			sendJsonResponse(w, map[string]string{"status": "failure", "message": "Confirmation attempts exceeded"})
+			return
+		}
+		query = "UPDATE email_change_requests SET code_attempts = code_attempts + 1 WHERE user_id = $1"
+		getDBPool().Exec(context.Background(), query, userID)
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Incorrect confirmation code"})
+		return
+	}
+
+	// Someone may have signed up with the address in the meantime
+	if isEmailTaken(newEmail) {
+		deleteEmailChangeRec(userID)
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Email is already in use"})
+		return
+	}
+	var username, oldEmail string
+	query = "SELECT username, email FROM users WHERE id = $1"
+	if err := getDBPool().QueryRow(context.Background(), query, userID).Scan(&username, &oldEmail); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	query = "UPDATE users SET email = $1 WHERE id = $2"
+	if _, err := getDBPool().Exec(context.Background(), query, newEmail, userID); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	deleteEmailChangeRec(userID)
+	if err := sendEmailChangedEmail(username, oldEmail, newEmail, emailLocale(r)); err != nil {
+		logger.Println("Error in queuing email changed email:", err)
+	}
+	session.Values["email"] = newEmail
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+// Delete the account and everything in it. Rooms the user owns are
+// closed first.
+func deleteAccount(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+	ap, err := readAccountParams(r)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	if err := checkCurrentPassword(session, userID, ap); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": err.Error()})
+		return
+	}
+
+	for roomID, room := range rooms {
+		if room.creatorUserID == userID {
+			closeRoom(roomID)
+		}
+	}
+	// Coding sessions (with their runs and recordings), identities,
+	// sessions and pending requests go with the user
+	query := "DELETE FROM users WHERE id = $1"
+	if _, err := getDBPool().Exec(context.Background(), query, userID); err != nil {
+		logger.Println("Unable to delete account: ", err)
+		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Something went wrong — please try again"})
+		return
+	}
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		logger.Println("Unable to sign out deleted account: ", err)
+	}
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
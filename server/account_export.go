@@ -0,0 +1,478 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Export of everything stored about a user, as a zip archive:
+//
+//	profile.json             account details and linked sign-in providers
+//	sign_ins.json            sign-in history
+//	sessions.json            active sessions
+//	coding_sessions/<id>/    one directory per coding session, with
+//	  session.json           its details
+//	  code.<ext>             the editor contents, one file per language
+//	  runs.json              the code runs (each with the code that was
+//	                         run, so they double as revisions)
+//	  recordings/<id>.cast   terminal recordings
+//
+// Small accounts get the archive straight away. For accounts with
+// more than ACCOUNT_EXPORT_SYNC_LIMIT bytes of stored content
+// (default 5MB), the archive is built in the background in the
+// ACCOUNT_EXPORT_DIR directory (default "exports") and the response
+// has a link to download it from once it's ready. Asking again
+// while an export is being built gives that export's status; once
+// it is ready, asking again starts a new one, so that the archive
+// is never older than the request. Archives are deleted after
+// ACCOUNT_EXPORT_RETENTION seconds (default a day).
+
+// Export statuses
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+var exportSettings = struct {
+	syncLimit int
+	dir       string
+	retention time.Duration
+}{
+	syncLimit: 5 * 1024 * 1024,
+	dir:       "exports",
+	retention: 24 * time.Hour,
+}
+
+type accountExport struct {
+	id          string
+	userID      int
+	status      string
+	path        string
+	whenCreated time.Time
+}
+
+var accountExports = make(map[string]*accountExport)
+var accountExportsMu sync.Mutex
+
+var langFileExtensions = map[string]string{
+	"ruby":     "rb",
+	"node":     "js",
+	"postgres": "sql",
+}
+
+func initAccountExports() {
+	exportSettings.syncLimit = getEnvInt("ACCOUNT_EXPORT_SYNC_LIMIT", exportSettings.syncLimit)
+	exportSettings.retention = getEnvSeconds("ACCOUNT_EXPORT_RETENTION", exportSettings.retention)
+	if dir := os.Getenv("ACCOUNT_EXPORT_DIR"); dir != "" {
+		exportSettings.dir = dir
+	}
+	// Exports from before a restart can't be downloaded any more
+	if old, err := filepath.Glob(filepath.Join(exportSettings.dir, "*.zip")); err == nil {
+		for _, path := range old {
+			os.Remove(path)
+		}
+	}
+}
+
+// Remove exports past their retention time, with their archives
+func startAccountExportCleaner() {
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			accountExportsMu.Lock()
+			for id, export := range accountExports {
+				if export.status != exportPending && time.Since(export.whenCreated) > exportSettings.retention {
+					if export.path != "" {
+						os.Remove(export.path)
+					}
+					delete(accountExports, id)
+				}
+			}
+			accountExportsMu.Unlock()
+		}
+	}()
+}
+
+// Bytes of code, output and recordings stored for the user
+func getAccountContentSize(userID int) (int, error) {
+	var size int
+	query := `SELECT
+COALESCE((SELECT SUM(octet_length(COALESCE(editor_contents, ''))) FROM coding_sessions WHERE user_id = $1), 0) +
+COALESCE((SELECT SUM(octet_length(r.code) + octet_length(r.output) + octet_length(r.stdout) + octet_length(r.stderr))
+  FROM runs r INNER JOIN coding_sessions c ON r.coding_session_id = c.id WHERE c.user_id = $1), 0) +
+COALESCE((SELECT SUM(octet_length(rec.cast_data))
+  FROM recordings rec INNER JOIN coding_sessions c ON rec.coding_session_id = c.id WHERE c.user_id = $1), 0)`
+	err := getDBPool().QueryRow(context.Background(), query, userID).Scan(&size)
+	return size, err
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func writeAccountProfile(zw *zip.Writer, userID int) error {
+	ctx := context.Background()
+	type identityModel struct {
+		Provider     string `json:"provider"`
+		Email        string `json:"email"`
+		WhenCreated  int64  `json:"whenCreated"`
+		WhenLastUsed int64  `json:"whenLastUsed"`
+	}
+	type profileModel struct {
+		ID               int             `json:"id"`
+		Username         string          `json:"username"`
+		Email            string          `json:"email"`
+		Plan             string          `json:"plan"`
+		Role             string          `json:"role"`
+		HasPassword      bool            `json:"hasPassword"`
+		TwoFactorEnabled bool            `json:"twoFactorEnabled"`
+		Identities       []identityModel `json:"identities"`
+	}
+	profile := profileModel{ID: userID, Identities: []identityModel{}}
+	query := "SELECT username, email, plan, role, encrypted_pw <> '', totp_enabled FROM users WHERE id = $1"
+	if err := getDBPool().QueryRow(ctx, query, userID).Scan(&profile.Username, &profile.Email, &profile.Plan, &profile.Role, &profile.HasPassword, &profile.TwoFactorEnabled); err != nil {
+		return err
+	}
+	query = "SELECT provider, COALESCE(email, ''), when_created, when_last_used FROM user_identities WHERE user_id = $1 ORDER BY id"
+	rows, err := getDBPool().Query(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i identityModel
+		if err := rows.Scan(&i.Provider, &i.Email, &i.WhenCreated, &i.WhenLastUsed); err != nil {
+			return err
+		}
+		profile.Identities = append(profile.Identities, i)
+	}
+	return writeZipJSON(zw, "profile.json", profile)
+}
+
+func writeAccountSignIns(zw *zip.Writer, userID int) error {
+	type signInModel struct {
+		Method    string `json:"method"`
+		UserAgent string `json:"userAgent"`
+		IPAddress string `json:"ipAddress"`
+		When      int64  `json:"when"`
+	}
+	signIns := []signInModel{}
+	query := "SELECT method, user_agent, ip_address, when_created FROM sign_ins WHERE user_id = $1 ORDER BY when_created"
+	rows, err := getDBPool().Query(context.Background(), query, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s signInModel
+		if err := rows.Scan(&s.Method, &s.UserAgent, &s.IPAddress, &s.When); err != nil {
+			return err
+		}
+		signIns = append(signIns, s)
+	}
+	return writeZipJSON(zw, "sign_ins.json", signIns)
+}
+
+func writeAccountSessions(zw *zip.Writer, userID int) error {
+	type sessionModel struct {
+		UserAgent    string `json:"userAgent"`
+		WhenCreated  int64  `json:"whenCreated"`
+		WhenLastSeen int64  `json:"whenLastSeen"`
+		WhenExpires  int64  `json:"whenExpires"`
+	}
+	sessions := []sessionModel{}
+	query := "SELECT user_agent, when_created, when_last_seen, when_expires FROM user_sessions WHERE user_id = $1 ORDER BY when_created"
+	rows, err := getDBPool().Query(context.Background(), query, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s sessionModel
+		if err := rows.Scan(&s.UserAgent, &s.WhenCreated, &s.WhenLastSeen, &s.WhenExpires); err != nil {
+			return err
+		}
+		sessions = append(sessions, s)
+	}
+	return writeZipJSON(zw, "sessions.json", sessions)
+}
+
+func writeAccountCodingSessions(zw *zip.Writer, userID int) error {
+	ctx := context.Background()
+	type codingSessionModel struct {
+		ID           int    `json:"id"`
+		Language     string `json:"language"`
+		WhenCreated  int64  `json:"whenCreated"`
+		WhenAccessed int64  `json:"whenAccessed"`
+		contents     string
+	}
+	var codingSessions []codingSessionModel
+	query := "SELECT id, lang, COALESCE(editor_contents, ''), when_created, when_accessed FROM coding_sessions WHERE user_id = $1 ORDER BY id"
+	rows, err := getDBPool().Query(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var cs codingSessionModel
+		if err := rows.Scan(&cs.ID, &cs.Language, &cs.contents, &cs.WhenCreated, &cs.WhenAccessed); err != nil {
+			rows.Close()
+			return err
+		}
+		codingSessions = append(codingSessions, cs)
+	}
+	rows.Close()
+
+	for _, cs := range codingSessions {
+		dir := fmt.Sprintf("coding_sessions/%d/", cs.ID)
+		if err := writeZipJSON(zw, dir+"session.json", cs); err != nil {
+			return err
+		}
+
+		// Editor contents are a JSON object with the code for each
+		// language used in the session
+		if cs.contents != "" {
+			var contents map[string]string
+			if err := json.Unmarshal([]byte(cs.contents), &contents); err != nil {
+				contents = map[string]string{cs.Language: cs.contents}
+			}
+			for lang, code := range contents {
+				ext, ok := langFileExtensions[lang]
+				if !ok {
+					ext = "txt"
+				}
+				f, err := zw.Create(dir + "code." + ext)
+				if err != nil {
+					return err
+				}
+				if _, err := io.WriteString(f, code); err != nil {
+					return err
+				}
+			}
+		}
+
+		query = strings.Join([]string{
+			"SELECT", savedRunColumns,
+			"FROM runs r WHERE r.coding_session_id = $1",
+			"ORDER BY r.when_started"}, " ")
+		rows, err := getDBPool().Query(ctx, query, cs.ID)
+		if err != nil {
+			return err
+		}
+		runs := []savedRun{}
+		for rows.Next() {
+			sr, err := scanSavedRun(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			runs = append(runs, sr)
+		}
+		rows.Close()
+		if err := writeZipJSON(zw, dir+"runs.json", runs); err != nil {
+			return err
+		}
+
+		query = "SELECT id, cast_data FROM recordings WHERE coding_session_id = $1 ORDER BY id"
+		rows, err = getDBPool().Query(ctx, query, cs.ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			var cast string
+			if err := rows.Scan(&id, &cast); err != nil {
+				rows.Close()
+				return err
+			}
+			f, err := zw.Create(fmt.Sprintf("%srecordings/%d.cast", dir, id))
+			if err == nil {
+				_, err = io.WriteString(f, cast)
+			}
+			if err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+func writeAccountExport(w io.Writer, userID int) error {
+	zw := zip.NewWriter(w)
+	for _, write := range []func(*zip.Writer, int) error{
+		writeAccountProfile,
+		writeAccountSignIns,
+		writeAccountSessions,
+		writeAccountCodingSessions,
+	} {
+		if err := write(zw, userID); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func exportFilename() string {
+	return "codeconnected-export-" + time.Now().UTC().Format("20060102") + ".zip"
+}
+
+// Build the archive in the background
+func startAccountExport(userID int) (*accountExport, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	export := &accountExport{
+		id:          hex.EncodeToString(b),
+		userID:      userID,
+		status:      exportPending,
+		whenCreated: time.Now(),
+	}
+	accountExportsMu.Lock()
+	accountExports[export.id] = export
+	accountExportsMu.Unlock()
+
+	go func() {
+		status := exportReady
+		path := filepath.Join(exportSettings.dir, export.id+".zip")
+		err := os.MkdirAll(exportSettings.dir, 0o700)
+		var f *os.File
+		if err == nil {
+			f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		}
+		if err == nil {
+			err = writeAccountExport(f, userID)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			logger.Printf("Unable to export account %d: %s", userID, err)
+			os.Remove(path)
+			status = exportFailed
+			path = ""
+		}
+		accountExportsMu.Lock()
+		export.status = status
+		export.path = path
+		accountExportsMu.Unlock()
+	}()
+	return export, nil
+}
+
+// The user's export that is still being built, if any
+func findPendingAccountExport(userID int) *accountExport {
+	accountExportsMu.Lock()
+	defer accountExportsMu.Unlock()
+	for _, export := range accountExports {
+		if export.userID == userID && export.status == exportPending {
+			return export
+		}
+	}
+	return nil
+}
+
+func sendAccountExportStatus(w http.ResponseWriter, export *accountExport) {
+	accountExportsMu.Lock()
+	status := export.status
+	accountExportsMu.Unlock()
+	response := map[string]string{"status": status, "exportID": export.id}
+	if status == exportReady {
+		response["downloadURL"] = "/api/account/export/" + export.id + "/download"
+	}
+	sendJsonResponse(w, response)
+}
+
+// Download the user's data. Small accounts get the zip archive in
+// the response; otherwise the export is started (or the one in
+// progress found) and its status is sent instead.
+func exportAccount(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	_, userID, ok := getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	if export := findPendingAccountExport(userID); export != nil {
+		sendAccountExportStatus(w, export)
+		return
+	}
+	size, err := getAccountContentSize(userID)
+	if err != nil {
+		logger.Println("Unable to size account export: ", err)
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if size > exportSettings.syncLimit {
+		export, err := startAccountExport(userID)
+		if err != nil {
+			sendJsonResponse(w, map[string]string{"status": "failure"})
+			return
+		}
+		sendAccountExportStatus(w, export)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename()))
+	if err := writeAccountExport(w, userID); err != nil {
+		// Too late for an error response; the archive is left
+		// incomplete
+		logger.Printf("Unable to export account %d: %s", userID, err)
+	}
+}
+
+func getAccountExportStatus(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	_, userID, ok := getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+	accountExportsMu.Lock()
+	export, ok := accountExports[p.ByName("id")]
+	accountExportsMu.Unlock()
+	if !ok || export.userID != userID {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	sendAccountExportStatus(w, export)
+}
+
+func downloadAccountExport(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	_, userID, ok := getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+	accountExportsMu.Lock()
+	export, ok := accountExports[p.ByName("id")]
+	var path string
+	if ok && export.userID == userID && export.status == exportReady {
+		path = export.path
+	}
+	accountExportsMu.Unlock()
+	if path == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename()))
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Admins are the signed in users whose emails are listed
+// (comma-separated) in the ADMIN_EMAILS env variable
+func isAdminRequest(r *http.Request) bool {
+	session, err := getSessStore().Get(r, "session")
+	if err != nil {
+		return false
+	}
+	if !isFullySignedIn(session) {
+		return false
+	}
+	// Admins signed in without a second factor are turned away
+	// when 2FA is required for them
+	if isTwoFactorRequired(roleAdmin) {
+		if verified, _ := session.Values["2faVerified"].(bool); !verified {
+			return false
+		}
+	}
+	if role, _ := session.Values["role"].(string); role == roleAdmin {
+		return true
+	}
+	email, ok := session.Values["email"].(string)
+	if !ok || email == "" {
+		return false
+	}
+	for _, adminEmail := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if strings.EqualFold(strings.TrimSpace(adminEmail), email) {
+			return true
+		}
+	}
+	return false
+}
+
+func getAdminStats(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	type roomStats struct {
+		RoomID          string `json:"roomID"`
+		Lang            string `json:"lang"`
+		Status          string `json:"status"`
+		Websockets      int    `json:"websockets"`
+		HistoryBytes    int    `json:"historyBytes"`
+		ScrollbackLines int    `json:"scrollbackLines"`
+	}
+	type responseModel struct {
+		RoomCount          int         `json:"roomCount"`
+		TotalHistoryBytes  int         `json:"totalHistoryBytes"`
+		MaxScrollbackLines int         `json:"maxScrollbackLines"`
+		MaxScrollbackBytes int         `json:"maxScrollbackBytes"`
+		MaxBurstBytes      int         `json:"maxBurstBytes"`
+		Rooms              []roomStats `json:"rooms"`
+	}
+
+	response := &responseModel{
+		MaxScrollbackLines: histLimits.maxLines,
+		MaxScrollbackBytes: histLimits.maxBytes,
+		MaxBurstBytes:      histLimits.maxBurstBytes,
+		Rooms:              []roomStats{},
+	}
+	for roomID, room := range rooms {
+		historyBytes, scrollbackLines := room.screen.MemoryUsage()
+		response.Rooms = append(response.Rooms, roomStats{
+			RoomID:          roomID,
+			Lang:            room.lang,
+			Status:          room.status,
+			Websockets:      countWsClients(room),
+			HistoryBytes:    historyBytes,
+			ScrollbackLines: scrollbackLines,
+		})
+		response.TotalHistoryBytes += historyBytes
+	}
+	response.RoomCount = len(response.Rooms)
+	// Biggest rooms first
+	sort.Slice(response.Rooms, func(i, j int) bool {
+		return response.Rooms[i].HistoryBytes > response.Rooms[j].HistoryBytes
+	})
+
+	sendJsonResponse(w, response)
+}
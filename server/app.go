@@ -4,13 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
-	"github.com/gorilla/sessions"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/cors"
@@ -23,6 +23,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -55,8 +56,12 @@ type containerDetails struct {
 }
 
 type room struct {
-	wsockets         []*websocket.Conn
+	wsockets         []*wsClient
+	wsMu             sync.Mutex
+	output           *roomOutput
 	creatorUserID    int
+	creatorPlan      string
+	runTimeout       time.Duration
 	lang             string
 	codeSessionID    int
 	initialContent   string
@@ -64,14 +69,43 @@ type room struct {
 	echo             bool
 	runTimeoutTimer  *time.Timer
 	abortRunChan     chan struct{}
+	interruptChan    chan string
+	runInProgress    bool // Guarded by wsMu
 	container        *containerDetails
 	eventSubscribers map[string]func()
-	termHist         []byte
+	screen           *termScreen
+	recording        *termRecording
+	yjsState         []byte
+	yjsPersisted     bool
+	termSizePolicy   string
+	editorReadOnly   bool
+	savedCode        string
+	capturingRun     bool
+	runCapture       []byte
 	termRows         int
 	termCols         int
 	status           string
 	lastExistCheck   int64
 	expiry           int64
+
+	// Input locking and attribution. Guarded by wsMu.
+	nextClientID      int
+	inputLockEnabled  bool
+	lockHolder        *wsClient
+	inputLog          []inputLogEntry
+	lastInputClientID int
+}
+
+func (r *room) setRunInProgress(inProgress bool) {
+	r.wsMu.Lock()
+	r.runInProgress = inProgress
+	r.wsMu.Unlock()
+}
+
+func (r *room) isRunInProgress() bool {
+	r.wsMu.Lock()
+	defer r.wsMu.Unlock()
+	return r.runInProgress
 }
 
 func (r *room) emit(event string) {
@@ -139,7 +173,7 @@ func (r *room) awaitSideEffect(sideEffectEvent string, funcWithSideEffect func()
 
 var cli *client.Client
 var rooms = make(map[string]*room)
-var store = sessions.NewCookieStore([]byte(os.Getenv("SESS_STORE_SECRET")))
+var store = newPgSessionStore()
 var initialPrompts = map[string][]byte{
 	"ruby":     []byte("[1] pry(main)> "),
 	"node":     []byte("> "),
@@ -150,7 +184,6 @@ var pool *pgxpool.Pool
 // Timeouts
 const activationTimeout = 5 * time.Minute
 const anonRoomTimeout = 20 * time.Minute
-const maxRunTime = 10 * time.Second
 const runnerStartupTimeout = 13 * time.Second
 
 // Logger
@@ -170,7 +203,7 @@ func getDBPool() *pgxpool.Pool {
 	return pool
 }
 
-func getSessStore() *sessions.CookieStore {
+func getSessStore() *pgSessionStore {
 	return store
 }
 
@@ -193,6 +226,12 @@ func getInitialRoomData(w http.ResponseWriter, r *http.Request, p httprouter.Par
 		History         string `json:"history"`
 		Expiry          int64  `json:"expiry"`
 		IsAuthedCreator bool   `json:"isAuthedCreator"`
+		RunTimeLimit    int    `json:"runTimeLimit"`
+		RunTimeLimitCap int    `json:"runTimeLimitCap"`
+		TermCols        int    `json:"termCols"`
+		YjsToken        string `json:"yjsToken"`
+		YjsTokenTTL     int    `json:"yjsTokenTTL"`
+		EditorReadOnly  bool   `json:"editorReadOnly"`
 	}
 
 	queryValues := r.URL.Query()
@@ -202,48 +241,50 @@ func getInitialRoomData(w http.ResponseWriter, r *http.Request, p httprouter.Par
 	}
 
 	lang := rooms[roomID].lang
-	hist := rooms[roomID].termHist
+	hist := rooms[roomID].screen.Snapshot()
 	expiry := rooms[roomID].expiry
 
-	// Get userID from session. If user isn't signed in userID will
-	// be -1
-	session, err := store.Get(r, "session")
+	// If user isn't signed in userID will be -1
+	userID, err := getSessionUserID(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	var userID int
-	var ok bool
-	if userID, ok = session.Values["userID"].(int); !ok {
-		userID = -1
-	}
 
 	isAuthedCreator := false
 	if userID != -1 && userID == rooms[roomID].creatorUserID {
 		isAuthedCreator = true
 	}
 
+	// Token for the room's Yjs document
+	yjsToken, err := issueYjsToken(userID, roomID, getYjsRole(rooms[roomID], userID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	response := &responseModel{
 		Language:        lang,
 		History:         string(hist),
 		Expiry:          expiry,
 		IsAuthedCreator: isAuthedCreator,
+		RunTimeLimit:    int(rooms[roomID].runTimeLimit() / time.Second),
+		RunTimeLimitCap: int(rooms[roomID].runTimeLimitCap() / time.Second),
+		TermCols:        rooms[roomID].termCols,
+		YjsToken:        yjsToken,
+		YjsTokenTTL:     int(yjsTokenTTL / time.Second),
+		EditorReadOnly:  rooms[roomID].editorReadOnly,
 	}
 
 	sendJsonResponse(w, response)
 }
 
 func getCodeSessions(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	session, err := store.Get(r, "session")
+	userID, err := getSessionUserID(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	var userID int
-	var ok bool
-	if userID, ok = session.Values["userID"].(int); !ok {
-		userID = -1
-	}
 
 	type codeSession struct {
 		SessID        int    `json:"sessID"`
@@ -263,6 +304,7 @@ func getCodeSessions(w http.ResponseWriter, r *http.Request, p httprouter.Params
 	var lang string
 	var content string
 	var when_accessed int64
+	var ok bool
 	sessionCount := 0
 	queryLines :=
 		[]string{
@@ -315,9 +357,9 @@ func getCodeSessions(w http.ResponseWriter, r *http.Request, p httprouter.Params
 
 func createRoom(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	type roomModel struct {
-		Language       string `json="language"`
-		CodeSessionID  int    `json="codeSessionID"`
-		InitialContent string `json="initialContent"`
+		Language       string `json:"language"`
+		CodeSessionID  int    `json:"codeSessionID"`
+		InitialContent string `json:"initialContent"`
 	}
 	var rm roomModel
 	body, err := io.ReadAll(r.Body)
@@ -351,6 +393,11 @@ func createRoom(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		container:      &containerDetails{},
 		status:         "created",
 		abortRunChan:   make(chan struct{}),
+		interruptChan:  make(chan string),
+		screen:         newTermScreen(0, 0, histLimits),
+		output:         newRoomOutput(),
+		recording:      newTermRecording(),
+		termSizePolicy: defaultTermSizePolicy,
 	}
 
 	rooms[roomID] = &room
@@ -467,8 +514,12 @@ func prepareRoom(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	room.termRows = rm.Rows
 	room.termCols = rm.Cols
+	room.screen.Resize(rm.Rows, rm.Cols)
+	room.recording.setSize(rm.Rows, rm.Cols)
 
-	session, err := store.Get(r, "session")
+	// If user isn't signed in (or still has to set up 2FA) userID
+	// will be -1
+	userID, err := getSessionUserID(r)
 	if err != nil {
 		room.status = "failed"
 		closeRoom(roomID)
@@ -477,9 +528,8 @@ func prepareRoom(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	}
 
 	// If creating user is not authed, set expiry on room
-	var auth, ok bool
 	var expiry int64
-	if auth, ok = session.Values["auth"].(bool); !ok || !auth {
+	if userID == -1 {
 		expiry = time.Now().Add(anonRoomTimeout).Unix()
 	} else {
 		expiry = -1
@@ -505,12 +555,8 @@ func prepareRoom(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		}()
 	}
 
-	var userID int
-	if userID, ok = session.Values["userID"].(int); !ok {
-		userID = -1
-	}
-
 	room.creatorUserID = userID
+	room.creatorPlan = getUserPlan(userID)
 
 	// If this is an existing code session, don't create a new
 	// one. Instead update when_accessed timestamp.
@@ -542,12 +588,19 @@ func prepareRoom(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 // responding client-side). This also takes care of the need to
 // ping websockets with a non-empty payload at least once every
 // 60 seconds, to prevent nginx proxypass from timing out.
-func heartbeat(ctx context.Context, ws *websocket.Conn, d time.Duration, room *room) {
+func heartbeat(ctx context.Context, client *wsClient, d time.Duration, room *room) {
+	ws := client.conn
 	t := time.NewTimer(d)
 	defer t.Stop()
 	for {
 		select {
 		case <-t.C:
+		case <-client.done:
+			// Already disconnected (e.g., as a slow consumer). Empty
+			// rooms are left to the room closer, since the client
+			// may just be reloading the page.
+			removeWsClient(room, client)
+			return
 		}
 		// the Ping method sends a ping and returns on receipt of the
 		// corresponding pong or cancelation of the context. If the error
@@ -558,16 +611,8 @@ func heartbeat(ctx context.Context, ws *websocket.Conn, d time.Duration, room *r
 			// instance of ping
 			time.Sleep(2 * time.Second)
 			if err := ws.Ping(ctx); err != nil {
-				ws.Close(websocket.StatusInternalError, "websocket no longer available")
-
-				// Remove websocket from room
-				var deadIdx int
-				for idx, socket := range room.wsockets {
-					if socket == ws {
-						deadIdx = idx
-					}
-				}
-				room.wsockets = append(room.wsockets[:deadIdx], room.wsockets[deadIdx+1:]...)
+				client.close(websocket.StatusInternalError, "websocket no longer available")
+				removeWsClient(room, client)
 				closeEmptyRooms()
 				return
 			}
@@ -591,14 +636,30 @@ func openWs(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	defer ws.Close(websocket.StatusInternalError, "deferred close")
 
 	// Append websocket to room socket list
-	room.wsockets = append(rooms[roomID].wsockets, ws)
+	userID, err := getSessionUserID(r)
+	isOwner := err == nil && userID != -1 && userID == room.creatorUserID
+	client := newWsClient(ws, isOwner)
+	defer client.close(websocket.StatusInternalError, "deferred close")
+	client.name = getRequestUsername(r, "")
+	client.signedInName = userID != -1
+
+	// Let the new client know the terminal size and input lock
+	// state in effect
+	if room.termCols > 0 {
+		client.send(termSizeMessage(room.termCols, room.termRows))
+	}
+	room.wsMu.Lock()
+	client.send(inputLockMessage(room.inputLockEnabled))
+	client.send(lockHolderMessage(room.lockHolder))
+	room.wsMu.Unlock()
 
 	// If first websocket in room, display initial repl message/prompt
-	if len(room.wsockets) == 1 {
+	if addWsClient(room, client) == 1 {
 		displayInitialPrompt(roomID, true, "1")
 	}
+	client.send([]byte(fmt.Sprintf("CLIENTID:%d:%s", client.id, client.token)))
 
-	go heartbeat(context.Background(), ws, heartbeatTime*time.Second, room)
+	go heartbeat(context.Background(), client, heartbeatTime*time.Second, room)
 
 	// Websocket receive loop
 	for {
@@ -608,13 +669,34 @@ func openWs(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			break
 		}
 		if string(message) == "WSPING" {
-			ws.Write(context.Background(), websocket.MessageText, []byte("WSPONG"))
+			client.send([]byte("WSPONG"))
+		} else if bytes.HasPrefix(message, []byte("RESIZE:")) {
+			if cols, rows, ok := parseResizeMessage(message); ok {
+				setWsClientSize(room, client, cols, rows)
+				updateTermSize(room)
+			}
+		} else if bytes.HasPrefix(message, []byte("IDENTIFY:")) {
+			setWsClientName(room, client, string(bytes.TrimPrefix(message, []byte("IDENTIFY:"))))
+		} else if isLockMessage(message) {
+			handleLockMessage(room, client, message)
 		} else {
+			if !canSendInput(room, client) {
+				client.send([]byte("LOCKDENIED"))
+				continue
+			}
+			logInput(room, client, message)
+			room.recording.recordInputData(message)
 			if err := sendToContainer(message, roomID); err != nil {
 				writeToWebsockets([]byte("CONTAINERERROR"), roomID)
 			}
 		}
 	}
+
+	// Client is gone; its size no longer counts, and it can't keep
+	// the input lock
+	removeWsClient(room, client)
+	releaseClientLock(room, client)
+	updateTermSize(room)
 }
 
 func startRunnerReader(roomID string) {
@@ -713,6 +795,8 @@ func startRunnerReader(roomID string) {
 					fakeTermBuffer = ansiEscapes.ReplaceAll(fakeTermBuffer, []byte(""))
 					// Check whether fakeTermBuffer ends with prompt termination
 					if promptTermination.Match(fakeTermBuffer) {
+						room.screen.EndBurst()
+						endOutputThrottle(room)
 						room.emit("promptReady")
 						fakeTermBuffer = []byte{}
 						newlineCount = 0
@@ -724,12 +808,15 @@ func startRunnerReader(roomID string) {
 
 			if room.echo == true {
 				writeToWebsockets(byteSlice, roomID)
+				if room.capturingRun {
+					room.runCapture = append(room.runCapture, byteSlice...)
+				}
 			}
 		}
 		cn.runnerReaderActive = false
 		// Try to reestablish connection if anybody is in room
 		// and restart flag is true
-		if len(room.wsockets) > 0 && cn.runnerReaderRestart == true {
+		if countWsClients(room) > 0 && cn.runnerReaderRestart == true {
 			// Try to reopen language connection
 			if err := openLanguageConnection(room.lang, roomID); err != nil {
 				writeToWebsockets([]byte("CONTAINERERROR"), roomID)
@@ -744,25 +831,38 @@ func writeToWebsockets(text []byte, roomID string) {
 	if room, ok = rooms[roomID]; !ok {
 		return
 	}
-	// Also write to history if at least one client connected
-	if len(room.wsockets) > 0 {
-		// Don't write special messages to history
-		textString := string(text)
-		if textString != "RESETTERMINAL" &&
-			textString != "RUNDONE" &&
-			textString != "CANCELRUN" &&
-			textString != "TIMEOUT" &&
-			textString != "CONTAINERERROR" {
-			room.termHist = append(room.termHist, text...)
-		}
+	// Special messages don't go into the history, and aren't
+	// coalesced with output
+	if isControlMessage(text) {
+		sendControlMessage(room, text)
+		return
 	}
+	queueOutput(room, "", text)
+}
 
-	for _, ws := range room.wsockets {
-		err := ws.Write(context.Background(), websocket.MessageText, text)
-		if err != nil {
-			logger.Println("ws write err:", err, "in room:", roomID)
-		}
+// Write output from one of the streams of a split mode run
+// (stdout or stderr). Messages are tagged with the stream name for
+// clients.
+func writeStreamToWebsockets(stream string, text []byte, roomID string) {
+	var room *room
+	var ok bool
+	if room, ok = rooms[roomID]; !ok {
+		return
 	}
+	queueOutput(room, stream, text)
+}
+
+func isControlMessage(text []byte) bool {
+	switch string(text) {
+	case "RESETTERMINAL", "RUNDONE", "CANCELRUN", "TIMEOUT", "CONTAINERERROR", "OUTPUTTRUNCATED":
+		return true
+	}
+	return bytes.HasPrefix(text, []byte("RUNRESULT:")) ||
+		bytes.HasPrefix(text, []byte("TERMSIZE:")) ||
+		bytes.HasPrefix(text, []byte("INPUTLOCK:")) ||
+		bytes.HasPrefix(text, []byte("LOCKHOLDER:")) ||
+		bytes.HasPrefix(text, []byte("EDITORREADONLY:")) ||
+		bytes.HasPrefix(text, []byte("RUNCANCELLED:"))
 }
 
 func sendToContainer(message []byte, roomID string) error {
@@ -783,9 +883,10 @@ func sendToContainer(message []byte, roomID string) error {
 
 func saveContent(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	type contentModel struct {
-		Content  string
-		Filename string
-		RoomID   string
+		Content     string
+		Filename    string
+		RoomID      string
+		ClientToken string
 	}
 
 	var cm contentModel
@@ -801,17 +902,19 @@ func saveContent(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		sendJsonResponse(w, map[string]string{"status": "failure"})
 		return
 	}
-	tarBuffer, err := makeTarball([]byte(cm.Content), cm.Filename)
-	if err != nil {
+
+	room, ok := rooms[cm.RoomID]
+	if !ok {
 		sendJsonResponse(w, map[string]string{"status": "failure"})
 		return
 	}
+	// The file is the one the next run runs
+	if !canControlRepl(room, cm.ClientToken) {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": inputLockedReason})
+		return
+	}
 
-	cn := rooms[cm.RoomID].container
-
-	// Copy contents of user program to container.
-	err = cli.CopyToContainer(context.Background(), cn.ID, "/home/codeuser/", &tarBuffer, types.CopyToContainerOptions{})
-	if err != nil {
+	if err = copyCodeToContainer(cm.RoomID, cm.Content, cm.Filename); err != nil {
 		sendJsonResponse(w, map[string]string{"status": "failure"})
 		return
 	}
@@ -819,6 +922,30 @@ func saveContent(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	sendJsonResponse(w, map[string]string{"status": "success"})
 }
 
+func copyCodeToContainer(roomID, content, filename string) error {
+	var room *room
+	var ok bool
+	if room, ok = rooms[roomID]; !ok {
+		return fmt.Errorf("room %s does not exist", roomID)
+	}
+	tarBuffer, err := makeTarball([]byte(content), filename)
+	if err != nil {
+		return err
+	}
+
+	cn := room.container
+
+	// Copy contents of user program to container.
+	err = cli.CopyToContainer(context.Background(), cn.ID, "/home/codeuser/", &tarBuffer, types.CopyToContainerOptions{})
+	if err != nil {
+		return err
+	}
+	// Keep a copy of the code so it can be saved with the run
+	// results
+	room.savedCode = content
+	return nil
+}
+
 func startUpRunner(lang, roomID string, rows int, cols int) error {
 	timer := time.NewTimer(runnerStartupTimeout)
 	returnChan := make(chan error)
@@ -873,6 +1000,9 @@ func startUpRunner(lang, roomID string, rows int, cols int) error {
 }
 
 func resizeTTY(cn *containerDetails, cols, rows int) error {
+	if cn.ID == "" {
+		return nil
+	}
 	ctx := context.Background()
 	resizeOpts := types.ResizeOptions{
 		Height: uint(rows),
@@ -882,6 +1012,8 @@ func resizeTTY(cn *containerDetails, cols, rows int) error {
 	if err := cli.ContainerResize(ctx, cn.ID, resizeOpts); err != nil {
 		return err
 	}
+	cn.ttyRows = rows
+	cn.ttyCols = cols
 	return nil
 }
 
@@ -890,9 +1022,33 @@ func switchLanguage(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 	lang := queryValues.Get("lang")
 	roomID := queryValues.Get("roomID")
 
-	room := rooms[roomID]
-	cn := room.container
+	room, ok := rooms[roomID]
+	if !ok {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if !canControlRepl(room, queryValues.Get("clientToken")) {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": inputLockedReason})
+		return
+	}
 	room.lang = lang
+
+	closeLanguageConnection(room)
+
+	err := openLanguageConnection(lang, roomID)
+	if err != nil {
+		writeToWebsockets([]byte("CONTAINERERROR"), roomID)
+	}
+	// TODO: Return a failure status if we fail to switch rooms
+	// within a certain time limit
+	sendJsonResponse(w, map[string]string{"status": "done"})
+}
+
+// Close the connection to the room's current REPL exec, aborting
+// any run in progress, and wait until the runner reader has
+// stopped
+func closeLanguageConnection(room *room) {
+	cn := room.container
 	if room.runTimeoutTimer != nil {
 		room.runTimeoutTimer.Stop()
 	}
@@ -923,14 +1079,6 @@ func switchLanguage(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 		}
 	}()
 	<-runnerReaderInactiveChan
-
-	err := openLanguageConnection(lang, roomID)
-	if err != nil {
-		writeToWebsockets([]byte("CONTAINERERROR"), roomID)
-	}
-	// TODO: Return a failure status if we fail to switch rooms
-	// within a certain time limit
-	sendJsonResponse(w, map[string]string{"status": "done"})
 }
 
 func openLanguageConnection(lang, roomID string) error {
@@ -1046,6 +1194,10 @@ func attemptLangConn(lang, roomID string) error {
 	}
 
 	cn.execID = resp.ID
+	// A new exec starts out with the default tty size
+	if err := resizeExecTTY(cn); err != nil {
+		logger.Println("Error resizing repl tty: ", err)
+	}
 	cn.runner = cn.connection.Conn
 	cn.bufReader = bufio.NewReader(cn.connection.Reader)
 	// Set reader restart to false to prevent reader from
@@ -1104,7 +1256,14 @@ func getReplVersionInfo(lang string, containerID string) (string, error) {
 }
 
 func executeSingleCmdInContainer(containerID string, cmd []string) ([]byte, error) {
+	return executeSingleCmdInContainerAs(containerID, "", cmd)
+}
+
+// Same as executeSingleCmdInContainer, but run as the given user
+// (an empty string means the container's default user)
+func executeSingleCmdInContainerAs(containerID, user string, cmd []string) ([]byte, error) {
 	execOpts := types.ExecConfig{
+		User:         user,
 		AttachStdout: true,
 		AttachStderr: true,
 		Cmd:          cmd,
@@ -1127,7 +1286,7 @@ func executeSingleCmdInContainer(containerID string, cmd []string) ([]byte, erro
 	// and then read data, and repeat until EOF
 	for {
 		h := make([]byte, 8)
-		_, err := connection.Reader.Read(h)
+		_, err := io.ReadFull(connection.Reader, h)
 		if err == io.EOF {
 			break
 		}
@@ -1143,10 +1302,10 @@ func executeSingleCmdInContainer(containerID string, cmd []string) ([]byte, erro
 		// 	streamType = "stdout"
 		// }
 
-		// Last 4 bytes represent uint32 size
-		size := h[4] + h[5] + h[6] + h[7]
+		// Last 4 bytes represent big endian uint32 size
+		size := binary.BigEndian.Uint32(h[4:])
 		b := make([]byte, size)
-		_, err = connection.Reader.Read(b)
+		_, err = io.ReadFull(connection.Reader, b)
 		if err == io.EOF {
 			break
 		}
@@ -1213,7 +1372,7 @@ func resetTerminal(roomID string) {
 	writeToWebsockets([]byte("RESETTERMINAL"), roomID)
 	// Also reset terminal history
 	room := rooms[roomID]
-	room.termHist = []byte("")
+	room.screen.Reset()
 	if room.runTimeoutTimer != nil {
 		room.runTimeoutTimer.Stop()
 	}
@@ -1225,8 +1384,9 @@ func resetTerminal(roomID string) {
 
 func clientClearTerm(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	type contentModel struct {
-		LastLine string `json:"lastLine"`
-		RoomID   string `json:"roomID"`
+		LastLine    string `json:"lastLine"`
+		RoomID      string `json:"roomID"`
+		ClientToken string `json:"clientToken"`
 	}
 	var cm contentModel
 	var body []byte
@@ -1242,7 +1402,20 @@ func clientClearTerm(w http.ResponseWriter, r *http.Request, p httprouter.Params
 		return
 	}
 
-	rooms[cm.RoomID].termHist = []byte(cm.LastLine)
+	room, ok := rooms[cm.RoomID]
+	if !ok {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if !canControlRepl(room, cm.ClientToken) {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": inputLockedReason})
+		return
+	}
+
+	// The client has cleared its terminal, leaving only the last
+	// line (the prompt). Do the same with our own copy of the
+	// screen, rather than relying on the line sent by the client.
+	room.screen.ClearKeepingCursorLine()
 
 	sendJsonResponse(w, map[string]string{"status": "success"})
 }
@@ -1279,6 +1452,12 @@ func onlineCheckPing(w http.ResponseWriter, r *http.Request, p httprouter.Params
 }
 
 func abortRun(roomID string) {
+	interruptRun(roomID, getTimeLimitMessage(rooms[roomID]))
+}
+
+// Send ctrl-c to the REPL, wait for the prompt and then print
+// message to the terminal
+func interruptRun(roomID string, message []byte) {
 	// TODO: Use room.runTimeoutTimer field to stop this
 	// procedure when resetting terminal
 	room := rooms[roomID]
@@ -1294,12 +1473,45 @@ func abortRun(roomID string) {
 		return
 	}
 	writeToWebsockets([]byte("CANCELRUN"), roomID)
-	writeToWebsockets([]byte("\r\nExecution interrupted because time limit exceeded.\r\n"), roomID)
+	writeToWebsockets(message, roomID)
 	displayInitialPrompt(roomID, false, "3")
 	room.echo = true
 }
 
-func runCode(roomID string, lang string, linesOfCode int, promptLineEmpty bool) error {
+// Message printed when a run is stopped for going over the room's
+// time limit
+func getTimeLimitMessage(room *room) []byte {
+	seconds := int(room.runTimeLimit() / time.Second)
+	return []byte(fmt.Sprintf("\r\nExecution interrupted because time limit (%d seconds) exceeded.\r\n", seconds))
+}
+
+// Run the code file saved in the room's container, either through
+// the REPL or, if separateStderr is set, directly in a non-TTY
+// exec. A result record is produced for every run, successful or
+// not, and broadcast to the room.
+func runCode(roomID string, lang string, linesOfCode int, promptLineEmpty bool, separateStderr bool) (*runResult, error) {
+	room := rooms[roomID]
+	result := newRunResult(lang, separateStderr)
+	result.Code = room.savedCode
+	room.setRunInProgress(true)
+	defer room.setRunInProgress(false)
+	var err error
+	if separateStderr {
+		err = runCodeSplit(roomID, lang, promptLineEmpty, result)
+	} else {
+		room.runCapture = []byte{}
+		room.capturingRun = true
+		err = runCodeInRepl(roomID, lang, linesOfCode, promptLineEmpty, result)
+		room.capturingRun = false
+		result.ReplOutput = room.runCapture
+		room.runCapture = nil
+	}
+	result.finish()
+	recordRunResult(roomID, result)
+	return result, err
+}
+
+func runCodeInRepl(roomID string, lang string, linesOfCode int, promptLineEmpty bool, result *runResult) error {
 	room := rooms[roomID]
 	cn := room.container
 	// Max run time in seconds
@@ -1356,13 +1568,21 @@ func runCode(roomID string, lang string, linesOfCode int, promptLineEmpty bool)
 		room.removeEventListener("promptReady")
 		close(runFinishedChan)
 	})
-	room.runTimeoutTimer = time.NewTimer(maxRunTime)
+	room.runTimeoutTimer = time.NewTimer(room.runTimeLimit())
 	select {
 	case <-room.runTimeoutTimer.C:
+		result.TimedOut = true
 		abortRun(roomID)
 		return errors.New("Container or run timeout")
 	case <-room.abortRunChan:
+		result.Interrupted = true
 		return errors.New("Container or run timeout")
+	case username := <-room.interruptChan:
+		room.runTimeoutTimer.Stop()
+		result.Interrupted = true
+		interruptRun(roomID, getRunCancelledMessage(username))
+		broadcastRunCancelled(roomID, username)
+		return errors.New("Run cancelled by user")
 	case <-runFinishedChan:
 		room.runTimeoutTimer.Stop()
 	}
@@ -1401,6 +1621,8 @@ func runFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		RoomID          string
 		Lang            string
 		PromptLineEmpty bool
+		SeparateStderr  bool
+		ClientToken     string
 	}
 	var pm paramsModel
 	body, err := io.ReadAll(r.Body)
@@ -1414,12 +1636,29 @@ func runFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		return
 	}
 
-	if err := runCode(pm.RoomID, pm.Lang, pm.Lines, pm.PromptLineEmpty); err != nil {
-		sendJsonResponse(w, map[string]string{"status": "failure"})
+	type responseModel struct {
+		Status string     `json:"status"`
+		Reason string     `json:"reason,omitempty"`
+		Result *runResult `json:"result"`
+	}
+
+	room, ok := rooms[pm.RoomID]
+	if !ok {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+	if !canControlRepl(room, pm.ClientToken) {
+		sendJsonResponse(w, &responseModel{Status: "failure", Reason: inputLockedReason})
 		return
 	}
 
-	sendJsonResponse(w, map[string]string{"status": "success"})
+	result, err := runCode(pm.RoomID, pm.Lang, pm.Lines, pm.PromptLineEmpty, pm.SeparateStderr)
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure", Result: result})
+		return
+	}
+
+	sendJsonResponse(w, &responseModel{Status: "success", Result: result})
 }
 
 func updateCodeSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -1448,6 +1687,12 @@ func updateCodeSession(w http.ResponseWriter, r *http.Request, p httprouter.Para
 		return
 	}
 
+	// Editor contents saved from the room's Yjs document take
+	// precedence over what clients send
+	if isYjsPersisted(pm.CodeSessionID) {
+		pm.TimeOnly = true
+	}
+
 	if err = runSessionUpdateQuery(pm.CodeSessionID, pm.Language, pm.Content, pm.TimeOnly); err != nil {
 		sendJsonResponse(w, map[string]string{"status": "failure"})
 		return
@@ -1486,7 +1731,7 @@ func closeEmptyRooms() {
 		// there was a recent check, we don't want to delete the room
 		// since a user may be about to join
 		timeSinceLastExistsCheck := time.Now().Unix() - room.lastExistCheck
-		if len(room.wsockets) == 0 && room.status == "open" && timeSinceLastExistsCheck > 10 {
+		if countWsClients(room) == 0 && room.status == "open" && timeSinceLastExistsCheck > 10 {
 			closeRoom(roomID)
 		}
 	}
@@ -1508,6 +1753,7 @@ func closeRoom(roomID string) {
 	if room.codeSessionID != -1 {
 		updateRoomAccessTime(room.codeSessionID)
 	}
+	saveRecording(room)
 	abortContainer(container)
 }
 
@@ -1616,19 +1862,35 @@ func stopAndRemoveContainer(containername string) error {
 
 func main() {
 	initClient()
-	initSesClient()
+	initEmailSender()
 	initDBConnectionPool()
+	initRunTimeouts()
+	initTermHistLimits()
+	initOutputLimits()
+	initRecordingLimits()
+	initTermSizePolicy()
+	initInputLog()
+	initYjsServer()
+	initYjsTokens()
+	initEmailOutbox()
+	initOAuthProviders()
+	initSessionStore()
+	initAccountExports()
+	initRateLimits()
+	initVerificationCodes()
 	startRoomCloser()
+	startEmailOutboxWorker()
 	startOrphanedContainerCloser()
-	store.Options = &sessions.Options{
-		SameSite: http.SameSiteStrictMode,
-	}
+	startExpiredSessionCleaner()
+	startAccountExportCleaner()
+	startRateLimitBucketCleaner()
 	router := httprouter.New()
 	router.POST("/api/save-content", saveContent)
 	router.GET("/api/open-ws", openWs)
 	router.POST("/api/create-room", createRoom)
 	router.POST("/api/prepare-room", prepareRoom)
-	router.POST("/api/activate-user", activateUser)
+	router.POST("/api/activate-user", rateLimited(activateUser, codeIPLimit, codeAccountLimit))
+	router.GET("/api/activate-link", rateLimited(activateUserByLink, codeIPLimit))
 	router.GET("/api/does-room-exist", doesRoomExist)
 	router.GET("/api/online-check-ping", onlineCheckPing)
 	router.GET("/api/get-initial-room-data", getInitialRoomData)
@@ -1636,15 +1898,52 @@ func main() {
 	router.GET("/api/get-user-info", getUserInfo)
 	router.POST("/api/switch-language", switchLanguage)
 	router.POST("/api/run-file", runFile)
-	router.POST("/api/sign-up", signUp)
-	router.POST("/api/sign-in", signIn)
+	router.POST("/api/sign-up", rateLimited(signUp, signUpIPLimit, emailSendLimit))
+	router.POST("/api/sign-in", rateLimited(signIn, signInIPLimit, signInAccountLimit))
 	router.POST("/api/sign-out", signOut)
-	router.POST("/api/resend-verification-email", resendVerificationEmail)
-	router.POST("/api/forgot-password", forgotPassword)
-	router.POST("/api/reset-password", resetPassword)
+	router.POST("/api/sign-in-2fa", rateLimited(signInTwoFactor, codeIPLimit, twoFactorLimit))
+	router.GET("/api/sessions", getUserSessions)
+	router.POST("/api/sessions/:id/revoke", revokeUserSession)
+	router.POST("/api/revoke-other-sessions", revokeOtherUserSessions)
+	router.POST("/api/account/username", changeUsername)
+	router.POST("/api/account/password", rateLimited(changePassword, accountLimit))
+	router.POST("/api/account/email", rateLimited(requestEmailChange, accountLimit))
+	router.POST("/api/account/confirm-email", rateLimited(confirmEmailChange, accountLimit))
+	router.POST("/api/account/delete", rateLimited(deleteAccount, accountLimit))
+	router.GET("/api/account/export", exportAccount)
+	router.GET("/api/account/export/:id", getAccountExportStatus)
+	router.GET("/api/account/export/:id/download", downloadAccountExport)
+	router.GET("/api/2fa/status", getTwoFactorStatus)
+	router.POST("/api/2fa/setup", setupTwoFactor)
+	router.POST("/api/2fa/enable", rateLimited(enableTwoFactor, accountLimit))
+	router.POST("/api/2fa/disable", rateLimited(disableTwoFactor, accountLimit))
+	router.POST("/api/2fa/recovery-codes", rateLimited(regenerateRecoveryCodes, accountLimit))
+	router.GET("/api/oauth-providers", getOAuthProviders)
+	router.GET("/api/oauth/:provider/start", startOAuthSignIn)
+	router.GET("/api/oauth/:provider/callback", finishOAuthSignIn)
+	router.POST("/api/resend-verification-email", rateLimited(resendVerificationEmail, signUpIPLimit, emailSendLimit))
+	router.POST("/api/forgot-password", rateLimited(forgotPassword, codeIPLimit, emailSendLimit))
+	router.POST("/api/reset-password", rateLimited(resetPassword, codeIPLimit, codeAccountLimit))
 	router.POST("/api/client-clear-term", clientClearTerm)
 	router.POST("/api/update-code-session", updateCodeSession)
 	router.GET("/api/get-code-sessions", getCodeSessions)
+	router.GET("/api/get-code-session-runs", getCodeSessionRuns)
+	router.POST("/api/rerun-code", rerunCode)
+	router.POST("/api/set-room-run-timeout", setRoomRunTimeout)
+	router.POST("/api/rooms/:id/interrupt", interruptRoomRun)
+	router.POST("/api/rooms/:id/reset-repl", resetRepl)
+	router.POST("/api/rooms/:id/term-size-policy", setTermSizePolicy)
+	router.POST("/api/rooms/:id/editor-read-only", setEditorReadOnly)
+	router.POST("/api/rooms/:id/input-lock", setInputLock)
+	router.GET("/api/rooms/:id/input-log", getInputLog)
+	router.GET("/api/rooms/:id/recording", getRoomRecording)
+	router.POST("/api/rooms/:id/recording-settings", setRoomRecordingSettings)
+	router.GET("/api/code-sessions/:id/recording", getCodeSessionRecording)
+	router.GET("/api/admin/stats", getAdminStats)
+	router.GET("/api/admin/yjs-stats", getYjsStats)
+	router.GET("/api/admin/email-outbox", getEmailOutboxStats)
+	router.GET("/api/yjs/:roomID", openYjsWs)
+	router.GET("/api/rooms/:id/yjs-token", getYjsToken)
 	router.POST("/api/get-code-session-id", getCodeSessionID)
 	router.POST("/api/set-room-status-open", setRoomStatusOpen)
 	port := 8080
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Outgoing emails are stored in the email_outbox table and sent by
+// a background worker, so that a failure of the email service
+// doesn't lose them. Failed sends are retried with exponential
+// backoff; messages that still haven't gone out after
+// maxAttempts tries are marked dead and kept for inspection. The
+// bodies of sent and dead messages are cleared, since they hold
+// verification and reset codes.
+
+// Outbox message statuses
+const (
+	emailPending = "pending"
+	emailSent    = "sent"
+	emailDead    = "dead"
+)
+
+// Can be set with the EMAIL_OUTBOX_POLL, EMAIL_MAX_ATTEMPTS,
+// EMAIL_RETRY_BASE and EMAIL_OUTBOX_RETENTION env variables (times
+// in seconds)
+var outboxSettings = struct {
+	pollInterval time.Duration
+	maxAttempts  int
+	retryBase    time.Duration
+	retryMax     time.Duration
+	// Time a message is leased to the worker sending it. Has to be
+	// longer than a send can take (SMTP_TIMEOUT).
+	lease time.Duration
+	// Time sent and dead messages are kept for
+	retention time.Duration
+	batchSize int
+}{
+	pollInterval: 5 * time.Second,
+	maxAttempts:  8,
+	retryBase:    30 * time.Second,
+	retryMax:     time.Hour,
+	lease:        5 * time.Minute,
+	retention:    7 * 24 * time.Hour,
+	batchSize:    10,
+}
+
+// Wakes the worker up when a message is queued
+var outboxWake = make(chan struct{}, 1)
+
+func initEmailOutbox() {
+	outboxSettings.pollInterval = getEnvSeconds("EMAIL_OUTBOX_POLL", outboxSettings.pollInterval)
+	outboxSettings.maxAttempts = getEnvInt("EMAIL_MAX_ATTEMPTS", outboxSettings.maxAttempts)
+	outboxSettings.retryBase = getEnvSeconds("EMAIL_RETRY_BASE", outboxSettings.retryBase)
+	outboxSettings.retention = getEnvSeconds("EMAIL_OUTBOX_RETENTION", outboxSettings.retention)
+	if smtpTimeout := getEnvSeconds("SMTP_TIMEOUT", 30*time.Second); outboxSettings.lease < 2*smtpTimeout {
+		outboxSettings.lease = 2 * smtpTimeout
+	}
+}
+
+func enqueueEmail(msg *emailMessage) error {
+	now := time.Now().Unix()
+	query := "INSERT INTO email_outbox(from_addr, to_addr, subject, body, html_body, status, attempts, next_attempt, when_created) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+	if _, err := getDBPool().Exec(context.Background(), query, msg.from, msg.to, msg.subject, msg.body, msg.htmlBody, emailPending, 0, now, now); err != nil {
+		return err
+	}
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Delay before the next try after the given number of failed
+// attempts, with some jitter so that retries don't all line up
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxSettings.retryBase
+	for i := 1; i < attempts && delay < outboxSettings.retryMax; i++ {
+		delay *= 2
+	}
+	if delay > outboxSettings.retryMax {
+		delay = outboxSettings.retryMax
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/4+1))
+}
+
+func startEmailOutboxWorker() {
+	go func() {
+		lastCleanup := time.Time{}
+		for {
+			// Keep going while batches come back full, since there
+			// may be more messages waiting
+			for processEmailOutbox() == outboxSettings.batchSize {
+			}
+			if time.Since(lastCleanup) > time.Hour {
+				cleanUpEmailOutbox()
+				lastCleanup = time.Now()
+			}
+			select {
+			case <-outboxWake:
+			case <-time.After(outboxSettings.pollInterval):
+			}
+		}
+	}()
+}
+
+type outboxMessage struct {
+	id       int
+	msg      emailMessage
+	attempts int
+}
+
+// Lease a due message, so that it isn't picked up again while it
+// is being sent. Returns nil if the message has been taken (or
+// sent) in the meantime.
+func leaseOutboxMessage(id int) (*outboxMessage, error) {
+	now := time.Now()
+	query := `UPDATE email_outbox SET next_attempt = $1
+WHERE id = $2 AND status = $3 AND next_attempt <= $4
+RETURNING id, from_addr, to_addr, subject, body, html_body, attempts`
+	var m outboxMessage
+	err := getDBPool().QueryRow(context.Background(), query, now.Add(outboxSettings.lease).Unix(), id, emailPending, now.Unix()).Scan(&m.id, &m.msg.from, &m.msg.to, &m.msg.subject, &m.msg.body, &m.msg.htmlBody, &m.attempts)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Send the messages that are due. Each message is leased right
+// before it is sent, so that a slow send doesn't run the lease of
+// the messages after it out. Returns the number of messages tried.
+func processEmailOutbox() int {
+	query := "SELECT id FROM email_outbox WHERE status = $1 AND next_attempt <= $2 ORDER BY id LIMIT $3"
+	rows, err := getDBPool().Query(context.Background(), query, emailPending, time.Now().Unix(), outboxSettings.batchSize)
+	if err != nil {
+		logger.Println("Unable to read email outbox: ", err)
+		return 0
+	}
+	var due []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			logger.Println("Unable to read email outbox: ", err)
+			continue
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+
+	for _, id := range due {
+		m, err := leaseOutboxMessage(id)
+		if err != nil {
+			logger.Printf("Unable to lease email %d in outbox: %s", id, err)
+			continue
+		}
+		if m == nil {
+			continue
+		}
+		attempts := m.attempts + 1
+		sendErr := emailSender.Send(&m.msg)
+		var query string
+		var args []interface{}
+		switch {
+		case sendErr == nil:
+			logger.Printf("Email %d sent to %s (attempt %d)", m.id, m.msg.to, attempts)
+			query = "UPDATE email_outbox SET status = $1, attempts = $2, when_sent = $3, last_error = NULL, body = '', html_body = '' WHERE id = $4"
+			args = []interface{}{emailSent, attempts, time.Now().Unix(), m.id}
+		case attempts >= outboxSettings.maxAttempts:
+			logger.Printf("Email %d to %s failed %d times, giving up: %s", m.id, m.msg.to, attempts, sendErr)
+			query = "UPDATE email_outbox SET status = $1, attempts = $2, last_error = $3, body = '', html_body = '' WHERE id = $4"
+			args = []interface{}{emailDead, attempts, sendErr.Error(), m.id}
+		default:
+			retry := time.Now().Add(outboxBackoff(attempts))
+			logger.Printf("Email %d to %s failed (attempt %d), retrying at %s: %s", m.id, m.msg.to, attempts, retry.Format(time.RFC3339), sendErr)
+			query = "UPDATE email_outbox SET attempts = $1, next_attempt = $2, last_error = $3 WHERE id = $4"
+			args = []interface{}{attempts, retry.Unix(), sendErr.Error(), m.id}
+		}
+		if _, err := getDBPool().Exec(context.Background(), query, args...); err != nil {
+			logger.Printf("Unable to update email %d in outbox: %s", m.id, err)
+		}
+	}
+	return len(due)
+}
+
+// Remove old sent and dead messages
+func cleanUpEmailOutbox() {
+	cutoff := time.Now().Add(-outboxSettings.retention).Unix()
+	query := "DELETE FROM email_outbox WHERE status <> $1 AND when_created < $2"
+	if _, err := getDBPool().Exec(context.Background(), query, emailPending, cutoff); err != nil {
+		logger.Println("Unable to clean up email outbox: ", err)
+	}
+}
+
+// Number of messages in each status, and the most recent dead
+// messages. Admin only.
+func getEmailOutboxStats(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	type deadMessage struct {
+		ID          int    `json:"id"`
+		To          string `json:"to"`
+		Subject     string `json:"subject"`
+		Attempts    int    `json:"attempts"`
+		LastError   string `json:"lastError"`
+		WhenCreated int64  `json:"whenCreated"`
+	}
+	type responseModel struct {
+		Status string         `json:"status"`
+		Counts map[string]int `json:"counts"`
+		Dead   []deadMessage  `json:"dead"`
+	}
+	response := &responseModel{Counts: map[string]int{}, Dead: []deadMessage{}}
+
+	rows, err := getDBPool().Query(context.Background(), "SELECT status, COUNT(*) FROM email_outbox GROUP BY status")
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err == nil {
+			response.Counts[status] = count
+		}
+	}
+	rows.Close()
+
+	query := "SELECT id, to_addr, subject, attempts, COALESCE(last_error, ''), when_created FROM email_outbox WHERE status = $1 ORDER BY id DESC LIMIT 50"
+	rows, err = getDBPool().Query(context.Background(), query, emailDead)
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+	for rows.Next() {
+		var m deadMessage
+		if err := rows.Scan(&m.ID, &m.To, &m.Subject, &m.Attempts, &m.LastError, &m.WhenCreated); err == nil {
+			response.Dead = append(response.Dead, m)
+		}
+	}
+	rows.Close()
+
+	response.Status = "success"
+	sendJsonResponse(w, response)
+}
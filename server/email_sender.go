@@ -1,66 +1,342 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sesv2"
 	sesTypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-var sesCli *sesv2.Client
+type emailMessage struct {
+	from    string
+	to      string
+	subject string
+	body    string
+	// HTML version of the body (optional)
+	htmlBody string
+}
 
-func initSesClient() {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		logger.Println("error in loading AWS SES config: ", err)
+// Something that can deliver emails. The backend is chosen with the
+// EMAIL_BACKEND env variable: "ses" (the default), "smtp" or
+// "file".
+type EmailSender interface {
+	Send(msg *emailMessage) error
+}
+
+var emailSender EmailSender
+
+func initEmailSender() {
+	initEmailBranding()
+	switch backend := os.Getenv("EMAIL_BACKEND"); backend {
+	case "", "ses":
+		emailSender = newSesEmailSender()
+	case "smtp":
+		emailSender = newSmtpEmailSender()
+	case "file":
+		emailSender = newFileEmailSender()
+	default:
+		logger.Printf("Unknown EMAIL_BACKEND %s. Using ses instead.", backend)
+		emailSender = newSesEmailSender()
 	}
-	sesCli = sesv2.NewFromConfig(cfg)
 }
 
-func sendPasswordResetEmail(emailAddr, resetCode string) error {
-	subject := "Your password reset code"
-	body := buildPasswordResetEmailBody(resetCode)
-	if err := sendEmail(emailAddr, subject, body); err != nil {
+// The link, if there is one, takes the place of the code
+func sendPasswordResetEmail(emailAddr, resetCode, link, locale string) error {
+	return sendTemplatedEmail(emailAddr, "password_reset", locale, emailTemplateData{Code: resetCode, Link: link})
+}
+
+func sendVerificationEmail(username, emailAddr, activationCode, link, locale string) error {
+	return sendTemplatedEmail(emailAddr, "verification", locale, emailTemplateData{
+		Username: username,
+		Code:     activationCode,
+		Link:     link,
+	})
+}
+
+func sendEmailChangeEmail(username, emailAddr, code, locale string) error {
+	return sendTemplatedEmail(emailAddr, "email_change", locale, emailTemplateData{
+		Username: username,
+		Code:     code,
+	})
+}
+
+// Notice to the old address that the account's email has changed
+func sendEmailChangedEmail(username, oldEmailAddr, newEmailAddr, locale string) error {
+	return sendTemplatedEmail(oldEmailAddr, "email_changed", locale, emailTemplateData{
+		Username: username,
+		NewEmail: newEmailAddr,
+	})
+}
+
+func sendAccountLockedEmail(username, emailAddr, locale string) error {
+	return sendTemplatedEmail(emailAddr, "account_locked", locale, emailTemplateData{Username: username})
+}
+
+// Render an email and queue it in the outbox, from where the
+// outbox worker sends it
+func sendTemplatedEmail(emailAddr, name, locale string, data emailTemplateData) error {
+	subject, body, htmlBody, err := renderEmail(name, locale, data)
+	if err != nil {
 		return err
 	}
-	return nil
+	return enqueueEmail(&emailMessage{
+		from:     emailBranding.from,
+		to:       emailAddr,
+		subject:  subject,
+		body:     body,
+		htmlBody: htmlBody,
+	})
 }
 
-func sendVerificationEmail(username, emailAddr, activationCode string) error {
-	subject := "Verify your email address"
-	body := buildVerificationEmailBody(username, activationCode)
-	if err := sendEmail(emailAddr, subject, body); err != nil {
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(s, "\n", "\r\n"))); err != nil {
 		return err
 	}
-	return nil
+	return qp.Close()
+}
+
+// Message in RFC 5322 format, for the backends that don't build
+// it themselves. Messages with an HTML body are sent as
+// multipart/alternative, with the text version first.
+func buildRawEmail(msg *emailMessage) ([]byte, error) {
+	var body bytes.Buffer
+	contentType := "text/plain; charset=UTF-8"
+	if msg.htmlBody == "" {
+		if err := writeQuotedPrintable(&body, msg.body); err != nil {
+			return nil, err
+		}
+	} else {
+		mw := multipart.NewWriter(&body)
+		for _, part := range [][2]string{{"text/plain", msg.body}, {"text/html", msg.htmlBody}} {
+			w, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {part[0] + "; charset=UTF-8"},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if err := writeQuotedPrintable(w, part[1]); err != nil {
+				return nil, err
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+		contentType = "multipart/alternative; boundary=" + mw.Boundary()
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(msg.from); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i != -1 {
+			domain = addr.Address[i+1:]
+		}
+	}
+
+	var raw bytes.Buffer
+	headers := [][2]string{
+		{"From", msg.from},
+		{"To", msg.to},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", contentType},
+	}
+	if msg.htmlBody == "" {
+		headers = append(headers, [2]string{"Content-Transfer-Encoding", "quoted-printable"})
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&raw, "%s: %s\r\n", h[0], h[1])
+	}
+	raw.WriteString("\r\n")
+	raw.Write(body.Bytes())
+	return raw.Bytes(), nil
+}
+
+// Amazon SES, configured the usual AWS way (env variables or
+// shared config files)
+type sesEmailSender struct {
+	cli *sesv2.Client
 }
 
-func sendEmail(emailAddr, subject, body string) error {
-	fromAddr := "codeconnected <contact@codeconnected.dev>"
+func newSesEmailSender() *sesEmailSender {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		logger.Println("error in loading AWS SES config: ", err)
+	}
+	return &sesEmailSender{cli: sesv2.NewFromConfig(cfg)}
+}
+
+func (s *sesEmailSender) Send(msg *emailMessage) error {
 	destAddr := sesTypes.Destination{
-		ToAddresses: []string{emailAddr},
+		ToAddresses: []string{msg.to},
 	}
 	simpleMessage := sesTypes.Message{
 		Subject: &sesTypes.Content{
-			Data: &subject,
+			Data: &msg.subject,
 		},
 		Body: &sesTypes.Body{
 			Text: &sesTypes.Content{
-				Data: &body,
+				Data: &msg.body,
 			},
 		},
 	}
+	if msg.htmlBody != "" {
+		simpleMessage.Body.Html = &sesTypes.Content{
+			Data: &msg.htmlBody,
+		}
+	}
 	emailContent := sesTypes.EmailContent{
 		Simple: &simpleMessage,
 	}
 	email := sesv2.SendEmailInput{
 		Destination:      &destAddr,
-		FromEmailAddress: &fromAddr,
+		FromEmailAddress: &msg.from,
 		Content:          &emailContent,
 	}
-	_, err := sesCli.SendEmail(context.Background(), &email)
+	_, err := s.cli.SendEmail(context.Background(), &email)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// Plain SMTP server, set with the SMTP_HOST, SMTP_PORT (default
+// 587), SMTP_USERNAME and SMTP_PASSWORD env variables. STARTTLS is
+// required unless SMTP_STARTTLS is set to "false" (e.g. for a
+// local relay).
+type smtpEmailSender struct {
+	host     string
+	port     int
+	username string
+	password string
+	startTLS bool
+	timeout  time.Duration
+}
+
+func newSmtpEmailSender() *smtpEmailSender {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		logger.Println("SMTP_HOST not set; emails can't be sent")
+	}
+	return &smtpEmailSender{
+		host:     host,
+		port:     getEnvInt("SMTP_PORT", 587),
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		startTLS: os.Getenv("SMTP_STARTTLS") != "false",
+		timeout:  getEnvSeconds("SMTP_TIMEOUT", 30*time.Second),
+	}
+}
+
+func (s *smtpEmailSender) Send(msg *emailMessage) error {
+	raw, err := buildRawEmail(msg)
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(msg.from)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(msg.to)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(s.host, fmt.Sprint(s.port)), s.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	} else if s.startTLS {
+		return fmt.Errorf("SMTP server %s does not support STARTTLS", s.host)
+	}
+	if s.username != "" {
+		// PlainAuth refuses to send the password unless the
+		// connection is encrypted (or to localhost)
+		if err := c.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Development backend: each email is written to an .eml file in
+// the EMAIL_FILE_DIR directory (default "emails") instead of being
+// sent
+type fileEmailSender struct {
+	dir string
+}
+
+func newFileEmailSender() *fileEmailSender {
+	dir := os.Getenv("EMAIL_FILE_DIR")
+	if dir == "" {
+		dir = "emails"
+	}
+	return &fileEmailSender{dir: dir}
+}
+
+func (s *fileEmailSender) Send(msg *emailMessage) error {
+	raw, err := buildRawEmail(msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(s.dir, name), raw, 0o644)
+}
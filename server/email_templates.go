@@ -1,39 +1,184 @@
 package main
 
 import (
+	"bytes"
+	"embed"
+	"encoding/json"
 	"fmt"
+	htmlTemplate "html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	textTemplate "text/template"
 )
 
-// Templates
-const verificationEmailTemplate = `Hi %s!
+// Each email has a text template (<name>.txt) and an HTML template
+// (<name>.html, shown inside layout.html), with the wording taken
+// from the locales/<locale>.json translations. Files in the
+// EMAIL_TEMPLATE_DIR directory, if set, take the place of the
+// built-in ones, so that operators can change them without
+// recompiling.
 
-Your verification code is %s.
+//go:embed email_templates
+var builtinEmailTemplates embed.FS
 
-Enter it in the codeconnected sign-up dialog to complete your registration.
+// Locale used when the user's language isn't available, and for
+// translations missing from other locales
+const defaultEmailLocale = "en"
 
-If you have any questions, please reply to this email.
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})?$`)
 
-Thanks!
-The codeconnected team
-
-Note: This email was sent as part of an automated sign-up process. If you were not expecting it, you can safely ignore it. No account will be created using this email without your consent.`
+// Branding used in emails. Can be set with the EMAIL_PRODUCT_NAME,
+// EMAIL_FROM and EMAIL_FOOTER env variables.
+var emailBranding = struct {
+	productName string
+	from        string
+	footer      string
+}{
+	productName: "codeconnected",
+	from:        "codeconnected <contact@codeconnected.dev>",
+}
 
-const passwordResetEmailTemplate = `Hi!
+func initEmailBranding() {
+	if name := os.Getenv("EMAIL_PRODUCT_NAME"); name != "" {
+		emailBranding.productName = name
+	}
+	if from := os.Getenv("EMAIL_FROM"); from != "" {
+		emailBranding.from = from
+	}
+	emailBranding.footer = os.Getenv("EMAIL_FOOTER")
+}
 
-Your password reset code is %s.
+func readEmailTemplateFile(name string) ([]byte, error) {
+	if dir := os.Getenv("EMAIL_TEMPLATE_DIR"); dir != "" {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+			return b, nil
+		}
+	}
+	return builtinEmailTemplates.ReadFile("email_templates/" + name)
+}
 
-Enter it in the codeconnected password reset dialog to complete the reset process.
+// Translations for the locale, with the default locale's filling
+// in the gaps
+func loadEmailTranslations(locale string) (map[string]string, error) {
+	translations := make(map[string]string)
+	for _, l := range []string{defaultEmailLocale, locale} {
+		b, err := readEmailTemplateFile("locales/" + l + ".json")
+		if err != nil {
+			if l == defaultEmailLocale {
+				return nil, err
+			}
+			continue
+		}
+		var t map[string]string
+		if err := json.Unmarshal(b, &t); err != nil {
+			return nil, fmt.Errorf("locale %s: %w", l, err)
+		}
+		for k, v := range t {
+			translations[k] = v
+		}
+	}
+	return translations, nil
+}
 
-If you have any questions, please reply to this email.
+func hasEmailLocale(locale string) bool {
+	if !localePattern.MatchString(locale) {
+		return false
+	}
+	_, err := readEmailTemplateFile("locales/" + locale + ".json")
+	return err == nil
+}
 
-Thanks!
-The codeconnected team`
+// Locale for emails sent in response to the request, from the
+// browser's language preferences (Accept-Language)
+func emailLocale(r *http.Request) string {
+	for _, lang := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		lang = strings.ToLower(strings.TrimSpace(strings.SplitN(lang, ";", 2)[0]))
+		if lang == "" || lang == "*" {
+			continue
+		}
+		if hasEmailLocale(lang) {
+			return lang
+		}
+		if base := strings.SplitN(lang, "-", 2)[0]; base != lang && hasEmailLocale(base) {
+			return base
+		}
+	}
+	return defaultEmailLocale
+}
 
-// Builders
-func buildVerificationEmailBody(username, activationCode string) string {
-	return fmt.Sprintf(verificationEmailTemplate, username, activationCode)
+type emailTemplateData struct {
+	Locale   string
+	Subject  string
+	Product  string
+	Footer   string
+	Username string
+	Code     string
+	// Magic link, for emails that have one instead of a code
+	Link string
+	// New address, in the notice sent to the old one
+	NewEmail string
 }
 
-func buildPasswordResetEmailBody(resetCode string) string {
-	return fmt.Sprintf(passwordResetEmailTemplate, resetCode)
+// Subject, text and HTML bodies of the named email
+func renderEmail(name, locale string, data emailTemplateData) (string, string, string, error) {
+	if !localePattern.MatchString(locale) {
+		locale = defaultEmailLocale
+	}
+	translations, err := loadEmailTranslations(locale)
+	if err != nil {
+		return "", "", "", err
+	}
+	translate := func(key string, args ...interface{}) string {
+		s, ok := translations[key]
+		if !ok {
+			return key
+		}
+		if len(args) > 0 {
+			return fmt.Sprintf(s, args...)
+		}
+		return s
+	}
+
+	data.Locale = locale
+	data.Product = emailBranding.productName
+	data.Footer = emailBranding.footer
+	data.Subject = translate(name + ".subject")
+
+	textSource, err := readEmailTemplateFile(name + ".txt")
+	if err != nil {
+		return "", "", "", err
+	}
+	textTmpl, err := textTemplate.New(name).Funcs(textTemplate.FuncMap{"t": translate}).Parse(string(textSource))
+	if err != nil {
+		return "", "", "", err
+	}
+	var text bytes.Buffer
+	if err := textTmpl.Execute(&text, data); err != nil {
+		return "", "", "", err
+	}
+
+	layoutSource, err := readEmailTemplateFile("layout.html")
+	if err != nil {
+		return "", "", "", err
+	}
+	htmlSource, err := readEmailTemplateFile(name + ".html")
+	if err != nil {
+		return "", "", "", err
+	}
+	htmlTmpl, err := htmlTemplate.New("layout").Funcs(htmlTemplate.FuncMap{"t": translate}).Parse(string(layoutSource))
+	if err != nil {
+		return "", "", "", err
+	}
+	if _, err := htmlTmpl.Parse(string(htmlSource)); err != nil {
+		return "", "", "", err
+	}
+	var html bytes.Buffer
+	if err := htmlTmpl.Execute(&html, data); err != nil {
+		return "", "", "", err
+	}
+
+	return data.Subject, strings.TrimSpace(text.String()) + "\n", html.String(), nil
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max number of entries kept in each room's input log. Can be set
+// with the INPUT_LOG_ENTRIES env variable.
+var maxInputLogEntries = 1000
+
+func initInputLog() {
+	maxInputLogEntries = getEnvInt("INPUT_LOG_ENTRIES", maxInputLogEntries)
+}
+
+// A piece of terminal input and the participant who typed it
+type inputLogEntry struct {
+	Time     int64  `json:"time"`
+	ClientID int    `json:"clientID"`
+	Name     string `json:"name"`
+	Data     string `json:"data"`
+}
+
+// Record who sent a piece of input. Consecutive input from the
+// same participant within a second goes into the same entry.
+func logInput(room *room, client *wsClient, data []byte) {
+	room.wsMu.Lock()
+	defer room.wsMu.Unlock()
+
+	now := time.Now().UnixMilli()
+	if n := len(room.inputLog); n > 0 {
+		last := &room.inputLog[n-1]
+		if last.ClientID == client.id && now-last.Time < 1000 {
+			last.Data += string(data)
+			return
+		}
+	}
+	if room.lastInputClientID != client.id {
+		// Mark the change of driver in the recording
+		room.recording.recordMarker("input from " + client.name)
+		room.lastInputClientID = client.id
+	}
+	if len(room.inputLog) >= maxInputLogEntries && len(room.inputLog) > 0 {
+		room.inputLog = append(room.inputLog[:0], room.inputLog[1:]...)
+	}
+	if maxInputLogEntries > 0 {
+		room.inputLog = append(room.inputLog, inputLogEntry{
+			Time:     now,
+			ClientID: client.id,
+			Name:     client.name,
+			Data:     string(data),
+		})
+	}
+}
+
+func lockHolderMessage(holder *wsClient) []byte {
+	if holder == nil {
+		return []byte("LOCKHOLDER:")
+	}
+	return []byte(fmt.Sprintf("LOCKHOLDER:%d:%s", holder.id, holder.name))
+}
+
+func inputLockMessage(enabled bool) []byte {
+	if enabled {
+		return []byte("INPUTLOCK:on")
+	}
+	return []byte("INPUTLOCK:off")
+}
+
+// Whether input from the client should go to the REPL
+func canSendInput(room *room, client *wsClient) bool {
+	room.wsMu.Lock()
+	defer room.wsMu.Unlock()
+	return !room.inputLockEnabled || room.lockHolder == client
+}
+
+// Whether a request made on behalf of a websocket client (given by
+// its token) may drive the REPL: running code, interrupting a run
+// and resetting the REPL are held to the same lock as typing
+func canControlRepl(room *room, clientToken string) bool {
+	room.wsMu.Lock()
+	enabled := room.inputLockEnabled
+	holder := room.lockHolder
+	room.wsMu.Unlock()
+	if !enabled {
+		return true
+	}
+	client := findWsClientByToken(room, clientToken)
+	return client != nil && client == holder
+}
+
+const inputLockedReason = "Request control of the terminal first"
+
+func setLockHolder(room *room, holder *wsClient) {
+	room.wsMu.Lock()
+	room.lockHolder = holder
+	room.wsMu.Unlock()
+	sendControlMessage(room, lockHolderMessage(holder))
+}
+
+// Handle the lock messages a client can send:
+//
+//	LOCKREQUEST          take the lock if it is free, otherwise ask
+//	                     the holder for it
+//	LOCKPASS:<clientID>  pass the lock on (holder only)
+//	LOCKRELEASE          give the lock up (holder only)
+func handleLockMessage(room *room, client *wsClient, message []byte) {
+	room.wsMu.Lock()
+	enabled := room.inputLockEnabled
+	holder := room.lockHolder
+	room.wsMu.Unlock()
+	if !enabled {
+		return
+	}
+
+	switch {
+	case string(message) == "LOCKREQUEST":
+		if holder == nil {
+			setLockHolder(room, client)
+		} else if holder != client {
+			holder.send([]byte(fmt.Sprintf("LOCKREQUESTED:%d:%s", client.id, client.name)))
+		}
+	case bytes.HasPrefix(message, []byte("LOCKPASS:")):
+		if holder != client {
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(string(message), "LOCKPASS:"))
+		if err != nil {
+			return
+		}
+		if next := findWsClient(room, id); next != nil {
+			setLockHolder(room, next)
+		}
+	case string(message) == "LOCKRELEASE":
+		if holder == client {
+			setLockHolder(room, nil)
+		}
+	}
+}
+
+func isLockMessage(message []byte) bool {
+	return string(message) == "LOCKREQUEST" ||
+		string(message) == "LOCKRELEASE" ||
+		bytes.HasPrefix(message, []byte("LOCKPASS:"))
+}
+
+func findWsClient(room *room, id int) *wsClient {
+	room.wsMu.Lock()
+	defer room.wsMu.Unlock()
+	for _, c := range room.wsockets {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// Give up the lock held by a client that is leaving the room
+func releaseClientLock(room *room, client *wsClient) {
+	room.wsMu.Lock()
+	held := room.lockHolder == client
+	room.wsMu.Unlock()
+	if held {
+		setLockHolder(room, nil)
+	}
+}
+
+// Only the room owner can turn input locking on or off. The owner
+// gets the lock when it is turned on.
+func setInputLock(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type paramsModel struct {
+		Enabled bool
+	}
+	roomID := p.ByName("id")
+	room, ok := rooms[roomID]
+	if !ok {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	userID, err := getSessionUserID(r)
+	if err != nil || userID == -1 || userID != room.creatorUserID {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+
+	var pm paramsModel
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if err = json.Unmarshal(body, &pm); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+
+	room.wsMu.Lock()
+	room.inputLockEnabled = pm.Enabled
+	var holder *wsClient
+	if pm.Enabled {
+		for _, c := range room.wsockets {
+			if c.isOwner {
+				holder = c
+				break
+			}
+		}
+	}
+	room.lockHolder = holder
+	room.wsMu.Unlock()
+
+	sendControlMessage(room, inputLockMessage(pm.Enabled))
+	sendControlMessage(room, lockHolderMessage(holder))
+
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+// Input log for the room, oldest first. Owner only.
+func getInputLog(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type responseModel struct {
+		Status  string          `json:"status"`
+		Entries []inputLogEntry `json:"entries"`
+	}
+	roomID := p.ByName("id")
+	room, ok := rooms[roomID]
+	if !ok {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+	userID, err := getSessionUserID(r)
+	if err != nil || userID == -1 || userID != room.creatorUserID {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+
+	room.wsMu.Lock()
+	entries := append([]inputLogEntry{}, room.inputLog...)
+	room.wsMu.Unlock()
+
+	sendJsonResponse(w, &responseModel{Status: "success", Entries: entries})
+}
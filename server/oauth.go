@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Sign-in through OAuth2 / OpenID Connect providers. Providers are
+// enabled by setting their client credentials:
+//
+//	GitHub         OAUTH_GITHUB_CLIENT_ID, OAUTH_GITHUB_CLIENT_SECRET
+//	Google         OAUTH_GOOGLE_CLIENT_ID, OAUTH_GOOGLE_CLIENT_SECRET
+//	Generic OIDC   OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET
+//	               (and optionally OIDC_DISPLAY_NAME)
+//
+// The redirect URI registered with each provider is
+// <OAUTH_REDIRECT_BASE>/api/oauth/<provider>/callback, where the
+// provider is github, google or oidc. If OAUTH_REDIRECT_BASE isn't
+// set, it is worked out from the request.
+//
+// Identities are kept in the user_identities table. The first time
+// someone signs in with a provider, the identity is linked to the
+// user with the same email (if the provider has verified the
+// email), or a new user is created.
+
+type oauthProvider struct {
+	name         string
+	displayName  string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	// GitHub isn't an OpenID provider; user details come from its
+	// API instead
+	github bool
+	// OpenID providers' endpoints are looked up from the issuer the
+	// first time they are needed
+	issuer      string
+	discoverMu  sync.Mutex
+	authURL     string
+	tokenURL    string
+	userInfoURL string
+}
+
+// Details of the user signed in at the provider
+type oauthIdentity struct {
+	subject       string
+	email         string
+	emailVerified bool
+	username      string
+}
+
+var (
+	oauthProviders     = make(map[string]*oauthProvider)
+	oauthProviderOrder []string
+	oauthClient        = &http.Client{Timeout: 10 * time.Second}
+)
+
+var errOAuthNoEmail = errors.New("your account with the provider has no verified email address")
+var errOAuthUnverifiedEmail = errors.New("an account with this email already exists; sign in with your password instead")
+var errOAuthEmailTooLong = errors.New("the email address of your account with the provider is too long (at most 50 characters)")
+
+func addOAuthProvider(p *oauthProvider) {
+	oauthProviders[p.name] = p
+	oauthProviderOrder = append(oauthProviderOrder, p.name)
+}
+
+func initOAuthProviders() {
+	if id := os.Getenv("OAUTH_GITHUB_CLIENT_ID"); id != "" {
+		addOAuthProvider(&oauthProvider{
+			name:         "github",
+			displayName:  "GitHub",
+			clientID:     id,
+			clientSecret: os.Getenv("OAUTH_GITHUB_CLIENT_SECRET"),
+			scopes:       []string{"read:user", "user:email"},
+			github:       true,
+			authURL:      "https://github.com/login/oauth/authorize",
+			tokenURL:     "https://github.com/login/oauth/access_token",
+			userInfoURL:  "https://api.github.com/user",
+		})
+	}
+	if id := os.Getenv("OAUTH_GOOGLE_CLIENT_ID"); id != "" {
+		addOAuthProvider(&oauthProvider{
+			name:         "google",
+			displayName:  "Google",
+			clientID:     id,
+			clientSecret: os.Getenv("OAUTH_GOOGLE_CLIENT_SECRET"),
+			scopes:       []string{"openid", "email", "profile"},
+			issuer:       "https://accounts.google.com",
+		})
+	}
+	if issuer, id := os.Getenv("OIDC_ISSUER"), os.Getenv("OIDC_CLIENT_ID"); issuer != "" && id != "" {
+		displayName := os.Getenv("OIDC_DISPLAY_NAME")
+		if displayName == "" {
+			displayName = "single sign-on"
+		}
+		addOAuthProvider(&oauthProvider{
+			name:         "oidc",
+			displayName:  displayName,
+			clientID:     id,
+			clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			scopes:       []string{"openid", "email", "profile"},
+			issuer:       strings.TrimSuffix(issuer, "/"),
+		})
+	}
+}
+
+// Look up the provider's endpoints in its OpenID configuration
+func (p *oauthProvider) discover() error {
+	p.discoverMu.Lock()
+	defer p.discoverMu.Unlock()
+	if p.issuer == "" || p.authURL != "" {
+		return nil
+	}
+	var config struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := oauthGetJSON(p.issuer+"/.well-known/openid-configuration", "", &config); err != nil {
+		return err
+	}
+	if strings.TrimSuffix(config.Issuer, "/") != p.issuer {
+		return fmt.Errorf("issuer mismatch in OpenID configuration: %s", config.Issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.UserinfoEndpoint == "" {
+		return errors.New("incomplete OpenID configuration")
+	}
+	p.authURL = config.AuthorizationEndpoint
+	p.tokenURL = config.TokenEndpoint
+	p.userInfoURL = config.UserinfoEndpoint
+	return nil
+}
+
+func oauthGetJSON(u, accessToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	res, err := oauthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func oauthRedirectURI(r *http.Request, provider string) string {
+	base := os.Getenv("OAUTH_REDIRECT_BASE")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return strings.TrimSuffix(base, "/") + "/api/oauth/" + provider + "/callback"
+}
+
+// The main session cookie is SameSite=Strict, so it isn't sent
+// when the provider redirects back. The state of a sign-in in
+// progress is kept in a separate, short-lived Lax cookie.
+func getOAuthSession(r *http.Request) *sessions.Session {
+	session, _ := getSessStore().Get(r, "oauth")
+	session.Options = &sessions.Options{
+		Path:     "/api/oauth",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+	return session
+}
+
+// Enabled providers, for the sign-in form
+func getOAuthProviders(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type providerModel struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	}
+	providers := []providerModel{}
+	for _, name := range oauthProviderOrder {
+		providers = append(providers, providerModel{Name: name, DisplayName: oauthProviders[name].displayName})
+	}
+	sendJsonResponse(w, map[string]interface{}{"status": "success", "providers": providers})
+}
+
+// Send the user to the provider to sign in. The optional return
+// query parameter is the (local) path to come back to.
+func startOAuthSignIn(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	provider, ok := oauthProviders[params.ByName("provider")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err := provider.discover(); err != nil {
+		logger.Printf("OAuth provider %s unavailable: %s", provider.name, err)
+		redirectAuthError(w, r, "Sign-in provider unavailable")
+		return
+	}
+	state, err := randomURLString(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// PKCE code verifier
+	verifier, err := randomURLString(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	returnPath := r.URL.Query().Get("return")
+	if !strings.HasPrefix(returnPath, "/") || strings.HasPrefix(returnPath, "//") || strings.HasPrefix(returnPath, "/\\") {
+		returnPath = "/"
+	}
+
+	session := getOAuthSession(r)
+	session.Values["provider"] = provider.name
+	session.Values["state"] = state
+	session.Values["verifier"] = verifier
+	session.Values["return"] = returnPath
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.clientID},
+		"redirect_uri":          {oauthRedirectURI(r, provider.name)},
+		"scope":                 {strings.Join(provider.scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(provider.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, provider.authURL+sep+query.Encode(), http.StatusFound)
+}
+
+// Send the user to the sign-in form, which shows the message
+func redirectAuthError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, "/?authError="+url.QueryEscape(message), http.StatusFound)
+}
+
+// The provider sends the user back here after sign-in
+func finishOAuthSignIn(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	provider, ok := oauthProviders[params.ByName("provider")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	oauthSession := getOAuthSession(r)
+	expectedState, _ := oauthSession.Values["state"].(string)
+	verifier, _ := oauthSession.Values["verifier"].(string)
+	sessionProvider, _ := oauthSession.Values["provider"].(string)
+	returnPath, _ := oauthSession.Values["return"].(string)
+	// The state is only good once
+	oauthSession.Options.MaxAge = -1
+	oauthSession.Save(r, w)
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		logger.Printf("OAuth sign-in with %s failed: %s", provider.name, e)
+		redirectAuthError(w, r, "Sign-in was cancelled or failed")
+		return
+	}
+	state := query.Get("state")
+	if expectedState == "" || sessionProvider != provider.name ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(expectedState)) != 1 {
+		redirectAuthError(w, r, "Sign-in session expired. Please try again.")
+		return
+	}
+
+	accessToken, err := provider.exchangeCode(query.Get("code"), verifier, oauthRedirectURI(r, provider.name))
+	if err != nil {
+		logger.Printf("OAuth token exchange with %s failed: %s", provider.name, err)
+		redirectAuthError(w, r, "Sign-in failed. Please try again.")
+		return
+	}
+	identity, err := provider.fetchIdentity(accessToken)
+	if err != nil {
+		logger.Printf("Unable to get user details from %s: %s", provider.name, err)
+		redirectAuthError(w, r, "Sign-in failed. Please try again.")
+		return
+	}
+	userID, username, email, err := findOrCreateOAuthUser(provider.name, identity)
+	if err != nil {
+		if err != errOAuthNoEmail && err != errOAuthUnverifiedEmail && err != errOAuthEmailTooLong {
+			logger.Printf("Unable to sign in user from %s: %s", provider.name, err)
+			err = errors.New("sign-in failed; please try again")
+		}
+		redirectAuthError(w, r, err.Error())
+		return
+	}
+
+	session, err := getSessStore().Get(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	twoFactorPending, err := beginUserSession(session, userID, username, email)
+	if err != nil {
+		logger.Printf("Unable to sign in user from %s: %s", provider.name, err)
+		redirectAuthError(w, r, "sign-in failed; please try again")
+		return
+	}
+	if err = session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if twoFactorPending {
+		// The sign-in form asks for the code
+		returnPath = "/?twoFactor=1"
+	} else {
+		recordSignIn(r, userID, provider.name)
+	}
+	if returnPath == "" {
+		returnPath = "/"
+	}
+	http.Redirect(w, r, returnPath, http.StatusFound)
+}
+
+func (p *oauthProvider) exchangeCode(code, verifier, redirectURI string) (string, error) {
+	if code == "" {
+		return "", errors.New("no authorization code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err := oauthClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&token); err != nil {
+		return "", fmt.Errorf("token response (%s): %w", res.Status, err)
+	}
+	if token.Error != "" {
+		return "", fmt.Errorf("%s: %s", token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("no access token (%s)", res.Status)
+	}
+	return token.AccessToken, nil
+}
+
+func (p *oauthProvider) fetchIdentity(accessToken string) (*oauthIdentity, error) {
+	if p.github {
+		return fetchGitHubIdentity(p.userInfoURL, accessToken)
+	}
+	var info struct {
+		Subject           string          `json:"sub"`
+		Email             string          `json:"email"`
+		EmailVerified     json.RawMessage `json:"email_verified"`
+		Name              string          `json:"name"`
+		PreferredUsername string          `json:"preferred_username"`
+	}
+	if err := oauthGetJSON(p.userInfoURL, accessToken, &info); err != nil {
+		return nil, err
+	}
+	if info.Subject == "" {
+		return nil, errors.New("no subject in user info")
+	}
+	// Some providers send email_verified as a string
+	verified, _ := strconv.ParseBool(strings.Trim(string(info.EmailVerified), `"`))
+	username := info.PreferredUsername
+	if username == "" {
+		username = info.Name
+	}
+	return &oauthIdentity{
+		subject:       info.Subject,
+		email:         info.Email,
+		emailVerified: verified,
+		username:      username,
+	}, nil
+}
+
+func fetchGitHubIdentity(userURL, accessToken string) (*oauthIdentity, error) {
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+	}
+	if err := oauthGetJSON(userURL, accessToken, &user); err != nil {
+		return nil, err
+	}
+	if user.ID == 0 {
+		return nil, errors.New("no user ID from GitHub")
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := oauthGetJSON(userURL+"/emails", accessToken, &emails); err != nil {
+		return nil, err
+	}
+	identity := &oauthIdentity{subject: strconv.FormatInt(user.ID, 10), username: user.Login}
+	// Primary email if it is verified, otherwise any verified one
+	for _, e := range emails {
+		if e.Verified && (identity.email == "" || e.Primary) {
+			identity.email = e.Email
+			identity.emailVerified = true
+		}
+	}
+	return identity, nil
+}
+
+// User signed in through the provider: the linked user if there is
+// one, otherwise the user with the same email, who gets linked,
+// otherwise a new user. Linking and creating a user both need an
+// email the provider has verified.
+func findOrCreateOAuthUser(provider string, identity *oauthIdentity) (int, string, string, error) {
+	ctx := context.Background()
+	var userID int
+	var username, email string
+	now := time.Now().Unix()
+
+	query := "SELECT u.id, u.username, u.email FROM user_identities i INNER JOIN users u ON i.user_id = u.id WHERE i.provider = $1 AND i.subject = $2"
+	err := getDBPool().QueryRow(ctx, query, provider, identity.subject).Scan(&userID, &username, &email)
+	if err == nil {
+		query = "UPDATE user_identities SET email = $1, when_last_used = $2 WHERE provider = $3 AND subject = $4"
+		if _, err := getDBPool().Exec(ctx, query, identity.email, now, provider, identity.subject); err != nil {
+			logger.Println("Unable to update user identity: ", err)
+		}
+		return userID, username, email, nil
+	}
+	if err != pgx.ErrNoRows {
+		return 0, "", "", err
+	}
+
+	if identity.email == "" {
+		return 0, "", "", errOAuthNoEmail
+	}
+	if utf8.RuneCountInString(identity.email) > 50 {
+		return 0, "", "", errOAuthEmailTooLong
+	}
+	tx, err := getDBPool().Begin(ctx)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	query = "SELECT id, username, email FROM users WHERE email = $1"
+	err = tx.QueryRow(ctx, query, identity.email).Scan(&userID, &username, &email)
+	switch {
+	case err == nil && !identity.emailVerified:
+		// Linking on an email the provider hasn't checked would let
+		// anybody take the account over
+		return 0, "", "", errOAuthUnverifiedEmail
+	case err == pgx.ErrNoRows && !identity.emailVerified:
+		return 0, "", "", errOAuthNoEmail
+	case err == pgx.ErrNoRows:
+		username = identity.username
+		if username == "" {
+			username = strings.SplitN(identity.email, "@", 2)[0]
+		}
+		if runes := []rune(username); len(runes) > 50 {
+			username = string(runes[:50])
+		}
+		email = identity.email
+		// No password; the user can only sign in through the
+		// provider (or after a password reset)
+		query = "INSERT INTO users(username, email, encrypted_pw) VALUES($1, $2, $3) RETURNING id"
+		if err := tx.QueryRow(ctx, query, username, email, "").Scan(&userID); err != nil {
+			return 0, "", "", err
+		}
+		if _, err := tx.Exec(ctx, "DELETE FROM pending_activations WHERE email = $1", email); err != nil {
+			return 0, "", "", err
+		}
+	case err != nil:
+		return 0, "", "", err
+	}
+
+	query = "INSERT INTO user_identities(user_id, provider, subject, email, when_created, when_last_used) VALUES($1, $2, $3, $4, $5, $6)"
+	if _, err := tx.Exec(ctx, query, userID, provider, identity.subject, identity.email, now, now); err != nil {
+		return 0, "", "", err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, "", "", err
+	}
+	return userID, username, email, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Rate limiting for the sign-in, sign-up and code checking
+// endpoints, with token buckets kept in the rate_limit_buckets
+// table so that the limits hold across server instances and
+// restarts. Each request takes a token from a bucket for the
+// client's IP address and, where there is one, a bucket for the
+// account it is about; a bucket gets a token back every interval,
+// up to its capacity. Requests finding a bucket empty get a 429
+// response with a Retry-After header.
+//
+// On top of that, accounts are locked for LOCKOUT_DURATION seconds
+// (default 15 minutes) after LOCKOUT_THRESHOLD (default 10) failed
+// sign-ins in a row, and the owner is sent an email about it.
+
+type rateLimit struct {
+	name     string
+	capacity float64
+	interval time.Duration
+	// Identifies the bucket for the request ("" for none)
+	key func(r *http.Request) string
+}
+
+var (
+	signInIPLimit      = rateLimit{"sign-in-ip", 30, 20 * time.Second, rateLimitIPKey}
+	signInAccountLimit = rateLimit{"sign-in-account", 10, time.Minute, rateLimitEmailKey}
+	codeIPLimit        = rateLimit{"code-ip", 20, 30 * time.Second, rateLimitIPKey}
+	codeAccountLimit   = rateLimit{"code-account", 6, 2 * time.Minute, rateLimitEmailKey}
+	signUpIPLimit      = rateLimit{"sign-up-ip", 5, 10 * time.Minute, rateLimitIPKey}
+	emailSendLimit     = rateLimit{"email-send", 3, 5 * time.Minute, rateLimitEmailKey}
+	twoFactorLimit     = rateLimit{"2fa-account", 6, time.Minute, rateLimitPendingUserKey}
+	accountLimit       = rateLimit{"account", 10, time.Minute, rateLimitUserKey}
+)
+
+var lockoutSettings = struct {
+	threshold int
+	duration  time.Duration
+}{
+	threshold: 10,
+	duration:  15 * time.Minute,
+}
+
+func initRateLimits() {
+	lockoutSettings.threshold = getEnvInt("LOCKOUT_THRESHOLD", lockoutSettings.threshold)
+	lockoutSettings.duration = getEnvSeconds("LOCKOUT_DURATION", lockoutSettings.duration)
+}
+
+// Key of the limit's bucket for the request ("" for none)
+func (limit rateLimit) bucketKey(r *http.Request) string {
+	key := limit.key(r)
+	if key == "" {
+		return ""
+	}
+	return limit.name + ":" + key
+}
+
+func rateLimitIPKey(r *http.Request) string {
+	return getClientIP(r)
+}
+
+// The email address in the request's JSON body, which is put back
+// for the handler to read
+func rateLimitEmailKey(r *http.Request) string {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var params struct {
+		Email string `json:"email"`
+	}
+	if json.Unmarshal(body, &params) != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(params.Email))
+}
+
+func rateLimitUserKey(r *http.Request) string {
+	userID, err := getSessionUserID(r)
+	if err != nil || userID == -1 {
+		return ""
+	}
+	return fmt.Sprint(userID)
+}
+
+// User waiting for the second sign-in step
+func rateLimitPendingUserKey(r *http.Request) string {
+	session, err := getSessStore().Get(r, "session")
+	if err != nil {
+		return ""
+	}
+	if userID, ok := session.Values["pending2faUserID"].(int); ok {
+		return fmt.Sprint(userID)
+	}
+	return ""
+}
+
+// Take a token from the bucket. If there are none, returns the
+// time until there will be one.
+func takeRateLimitToken(key string, capacity float64, interval time.Duration) (bool, time.Duration, error) {
+	ctx := context.Background()
+	now := float64(time.Now().UnixNano()) / 1e9
+	tx, err := getDBPool().Begin(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := "INSERT INTO rate_limit_buckets(key, tokens, when_updated, when_full) VALUES($1, $2, $3, $3) ON CONFLICT (key) DO NOTHING"
+	if _, err := tx.Exec(ctx, query, key, capacity, now); err != nil {
+		return false, 0, err
+	}
+	var tokens, updated float64
+	query = "SELECT tokens, when_updated FROM rate_limit_buckets WHERE key = $1 FOR UPDATE"
+	if err := tx.QueryRow(ctx, query, key).Scan(&tokens, &updated); err != nil {
+		return false, 0, err
+	}
+
+	tokens = math.Min(capacity, tokens+(now-updated)/interval.Seconds())
+	allowed := tokens >= 1
+	var retryAfter time.Duration
+	if allowed {
+		tokens--
+	} else {
+		retryAfter = time.Duration((1 - tokens) * float64(interval))
+	}
+	full := now + (capacity-tokens)*interval.Seconds()
+	query = "UPDATE rate_limit_buckets SET tokens = $1, when_updated = $2, when_full = $3 WHERE key = $4"
+	if _, err := tx.Exec(ctx, query, tokens, now, full, key); err != nil {
+		return false, 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, nil
+}
+
+func sendTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, reason string) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	// Forms show either the reason or the message
+	json.NewEncoder(w).Encode(map[string]string{"status": "failure", "reason": reason, "message": reason})
+}
+
+// Wrap the handler with the rate limits. If the database can't be
+// reached, requests are let through.
+func rateLimited(handle httprouter.Handle, limits ...rateLimit) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var wait time.Duration
+		for _, limit := range limits {
+			key := limit.bucketKey(r)
+			if key == "" {
+				continue
+			}
+			allowed, retryAfter, err := takeRateLimitToken(key, limit.capacity, limit.interval)
+			if err != nil {
+				logger.Printf("Unable to check rate limit %s: %s", limit.name, err)
+				continue
+			}
+			if !allowed && retryAfter > wait {
+				wait = retryAfter
+			}
+		}
+		if wait > 0 {
+			sendTooManyRequests(w, wait, "Too many attempts — please wait a while and try again")
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// Remove buckets that have filled up again, since a missing
+// bucket is a full one
+func startRateLimitBucketCleaner() {
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			query := "DELETE FROM rate_limit_buckets WHERE when_full < $1"
+			if _, err := getDBPool().Exec(context.Background(), query, float64(time.Now().Unix())); err != nil {
+				logger.Println("Unable to clean up rate limit buckets: ", err)
+			}
+		}
+	}()
+}
+
+// Time left on the account's lockout, if it's locked
+func getAccountLockout(userID int) time.Duration {
+	var lockedUntil int64
+	query := "SELECT locked_until FROM users WHERE id = $1"
+	if err := getDBPool().QueryRow(context.Background(), query, userID).Scan(&lockedUntil); err != nil {
+		if err != pgx.ErrNoRows {
+			logger.Println("Unable to check account lockout: ", err)
+		}
+		return 0
+	}
+	if left := time.Until(time.Unix(lockedUntil, 0)); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// Count a failed sign-in, locking the account (and letting the
+// owner know) once there have been too many in a row
+func recordFailedSignIn(r *http.Request, userID int, username, email string) {
+	var failures int
+	query := "UPDATE users SET failed_sign_ins = failed_sign_ins + 1 WHERE id = $1 RETURNING failed_sign_ins"
+	if err := getDBPool().QueryRow(context.Background(), query, userID).Scan(&failures); err != nil {
+		logger.Println("Unable to record failed sign-in: ", err)
+		return
+	}
+	if failures < lockoutSettings.threshold {
+		return
+	}
+	lockedUntil := time.Now().Add(lockoutSettings.duration).Unix()
+	query = "UPDATE users SET failed_sign_ins = 0, locked_until = $1 WHERE id = $2"
+	if _, err := getDBPool().Exec(context.Background(), query, lockedUntil, userID); err != nil {
+		logger.Println("Unable to lock account: ", err)
+		return
+	}
+	logger.Printf("Account %d locked after %d failed sign-ins", userID, failures)
+	if err := sendAccountLockedEmail(username, email, emailLocale(r)); err != nil {
+		logger.Println("Error in queuing account locked email:", err)
+	}
+}
+
+// Clear the failed sign-in count and any lockout
+func clearFailedSignIns(userID int) {
+	query := "UPDATE users SET failed_sign_ins = 0, locked_until = 0 WHERE id = $1 AND (failed_sign_ins > 0 OR locked_until > 0)"
+	if _, err := getDBPool().Exec(context.Background(), query, userID); err != nil {
+		logger.Println("Unable to clear failed sign-ins: ", err)
+	}
+}
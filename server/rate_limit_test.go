@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		realIP string
+		want   string
+	}{
+		// Passed on by the proxy
+		{"203.0.113.7", "203.0.113.7"},
+		{"198.51.100.20", "198.51.100.20"},
+		// Straight from the connection without it
+		{"", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/api/sign-in", nil)
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		if got := getClientIP(r); got != test.want {
+			t.Errorf("X-Real-IP %q: client IP is %q, want %q", test.realIP, got, test.want)
+		}
+		if got, want := signInIPLimit.bucketKey(r), "sign-in-ip:"+test.want; got != want {
+			t.Errorf("X-Real-IP %q: bucket key is %q, want %q", test.realIP, got, want)
+		}
+	}
+}
+
+func TestClientsGetTheirOwnIPBuckets(t *testing.T) {
+	// All requests come from the proxy's address
+	a := httptest.NewRequest("POST", "/api/sign-up", nil)
+	a.Header.Set("X-Real-IP", "203.0.113.7")
+	b := httptest.NewRequest("POST", "/api/sign-up", nil)
+	b.Header.Set("X-Real-IP", "198.51.100.20")
+	if a.RemoteAddr != b.RemoteAddr {
+		t.Fatal("requests should share the remote address")
+	}
+	if keyA, keyB := signUpIPLimit.bucketKey(a), signUpIPLimit.bucketKey(b); keyA == keyB {
+		t.Errorf("both clients use bucket %q", keyA)
+	}
+}
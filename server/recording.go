@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Max size of the events kept in a room's recording. Can be set
+// with the RECORDING_MAX_BYTES env variable.
+var maxRecordingBytes = 4 << 20
+
+// Number of recordings kept for each code session, newest first.
+// Can be set with the RECORDINGS_PER_SESSION env variable.
+var maxSessionRecordings = 5
+
+// Events closer together than this are merged into one
+const recordingMergeWindow = 10 * time.Millisecond
+
+func initRecordingLimits() {
+	maxRecordingBytes = getEnvInt("RECORDING_MAX_BYTES", maxRecordingBytes)
+	maxSessionRecordings = getEnvInt("RECORDINGS_PER_SESSION", maxSessionRecordings)
+}
+
+type recordingEvent struct {
+	at   time.Duration
+	kind string
+	data []byte
+}
+
+// Timestamped record of a room's terminal session, exported in
+// asciicast v2 format. Output is always recorded; input only if
+// the room owner has turned it on. Only recordings of rooms where
+// it has been turned on are stored when the room closes.
+type termRecording struct {
+	mu          sync.Mutex
+	start       time.Time
+	rows        int
+	cols        int
+	recordInput bool
+	optedIn     bool
+	events      []recordingEvent
+	bytes       int
+	truncated   bool
+}
+
+func newTermRecording() *termRecording {
+	rows, cols := sanitizeTermSize(0, 0)
+	return &termRecording{start: time.Now(), rows: rows, cols: cols}
+}
+
+func (rec *termRecording) setSize(rows, cols int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.rows, rec.cols = sanitizeTermSize(rows, cols)
+}
+
+func (rec *termRecording) setRecordInput(recordInput bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.recordInput = recordInput
+	if recordInput {
+		rec.optedIn = true
+	}
+}
+
+func (rec *termRecording) recordOutput(data []byte) {
+	rec.add("o", data)
+}
+
+func (rec *termRecording) recordInputData(data []byte) {
+	rec.mu.Lock()
+	recordInput := rec.recordInput
+	rec.mu.Unlock()
+	if recordInput {
+		rec.add("i", data)
+	}
+}
+
+// Markers show who is typing when input is being recorded
+func (rec *termRecording) recordMarker(label string) {
+	rec.mu.Lock()
+	recordInput := rec.recordInput
+	rec.mu.Unlock()
+	if recordInput {
+		rec.add("m", []byte(label))
+	}
+}
+
+func (rec *termRecording) recordResize(cols, rows int) {
+	rec.add("r", []byte(fmt.Sprintf("%dx%d", cols, rows)))
+}
+
+func (rec *termRecording) add(kind string, data []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.truncated {
+		return
+	}
+	if rec.bytes+len(data) > maxRecordingBytes {
+		rec.truncated = true
+		return
+	}
+	rec.bytes += len(data)
+
+	at := time.Since(rec.start)
+	if n := len(rec.events); n > 0 {
+		last := &rec.events[n-1]
+		if last.kind == kind && (kind == "o" || kind == "i") && at-last.at < recordingMergeWindow {
+			last.data = append(last.data, data...)
+			return
+		}
+	}
+	rec.events = append(rec.events, recordingEvent{
+		at:   at,
+		kind: kind,
+		data: append([]byte{}, data...),
+	})
+}
+
+// Write the recording as an asciicast v2 file: a header line
+// followed by one JSON array per event
+func (rec *termRecording) writeCast(w io.Writer, title string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	type castHeader struct {
+		Version   int               `json:"version"`
+		Width     int               `json:"width"`
+		Height    int               `json:"height"`
+		Timestamp int64             `json:"timestamp"`
+		Title     string            `json:"title,omitempty"`
+		Env       map[string]string `json:"env"`
+	}
+	header, err := json.Marshal(&castHeader{
+		Version:   2,
+		Width:     rec.cols,
+		Height:    rec.rows,
+		Timestamp: rec.start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "%s\n", header); err != nil {
+		return err
+	}
+	for _, event := range rec.events {
+		line, err := json.Marshal([]interface{}{
+			event.at.Seconds(),
+			event.kind,
+			string(event.data),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "%s\n", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendCastFile(w http.ResponseWriter, filename string, cast []byte) {
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.Write(cast)
+}
+
+// The recording can include everything typed in the room, so only
+// the room owner can download it
+func getRoomRecording(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	roomID := p.ByName("id")
+	room, ok := rooms[roomID]
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	userID, err := getSessionUserID(r)
+	if err != nil || userID == -1 || userID != room.creatorUserID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var cast bytes.Buffer
+	if err := room.recording.writeCast(&cast, "Room "+roomID); err != nil {
+		logger.Println("Error writing recording: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sendCastFile(w, "room-"+roomID+".cast", cast.Bytes())
+}
+
+// Only the room owner can turn input recording on or off
+func setRoomRecordingSettings(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type paramsModel struct {
+		RecordInput bool
+	}
+	roomID := p.ByName("id")
+	room, ok := rooms[roomID]
+	if !ok {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	userID, err := getSessionUserID(r)
+	if err != nil || userID == -1 || userID != room.creatorUserID {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+
+	var pm paramsModel
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if err = json.Unmarshal(body, &pm); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	room.recording.setRecordInput(pm.RecordInput)
+
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+// Store the recording of a room that is closing, so that it can
+// be exported later from the code session. Only rooms where input
+// recording has been turned on keep their recording, and only the
+// latest maxSessionRecordings of each code session are kept.
+func saveRecording(room *room) {
+	if room.codeSessionID == -1 || maxSessionRecordings <= 0 {
+		return
+	}
+	room.recording.mu.Lock()
+	empty := len(room.recording.events) == 0
+	optedIn := room.recording.optedIn
+	truncated := room.recording.truncated
+	room.recording.mu.Unlock()
+	if empty || !optedIn {
+		return
+	}
+
+	var cast bytes.Buffer
+	if err := room.recording.writeCast(&cast, ""); err != nil {
+		logger.Println("Error writing recording: ", err)
+		return
+	}
+	query := "INSERT INTO recordings(coding_session_id, cast_data, truncated, when_created) VALUES($1, $2, $3, $4)"
+	if _, err := pool.Exec(context.Background(), query, room.codeSessionID, cast.String(), truncated, time.Now().Unix()); err != nil {
+		logger.Println("Unable to insert recording: ", err)
+		return
+	}
+	query = "DELETE FROM recordings WHERE coding_session_id = $1 AND id NOT IN (SELECT id FROM recordings WHERE coding_session_id = $1 ORDER BY when_created DESC, id DESC LIMIT $2)"
+	if _, err := pool.Exec(context.Background(), query, room.codeSessionID, maxSessionRecordings); err != nil {
+		logger.Println("Unable to delete old recordings: ", err)
+	}
+}
+
+// Export the latest recording stored for a code session (or the
+// one given by the recordingID query param). Only the owner of the
+// code session has access.
+func getCodeSessionRecording(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	userID, err := getSessionUserID(r)
+	if err != nil || userID == -1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	codeSessionID, err := strconv.Atoi(p.ByName("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	query := "SELECT r.cast_data FROM recordings r INNER JOIN coding_sessions c ON r.coding_session_id = c.id WHERE c.id = $1 AND c.user_id = $2"
+	args := []interface{}{codeSessionID, userID}
+	if recordingID := r.URL.Query().Get("recordingID"); recordingID != "" {
+		id, err := strconv.Atoi(recordingID)
+		if err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		query += " AND r.id = $3"
+		args = append(args, id)
+	}
+	query += " ORDER BY r.when_created DESC, r.id DESC LIMIT 1"
+
+	var cast string
+	if err := pool.QueryRow(context.Background(), query, args...).Scan(&cast); err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	sendCastFile(w, fmt.Sprintf("code-session-%d.cast", codeSessionID), []byte(cast))
+}
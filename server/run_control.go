@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func getRunCancelledMessage(username string) []byte {
+	return []byte(fmt.Sprintf("\r\nRun cancelled by %s.\r\n", username))
+}
+
+// Let everybody in the room know who cancelled the run
+func broadcastRunCancelled(roomID, username string) {
+	writeToWebsockets([]byte("RUNCANCELLED:"+username), roomID)
+}
+
+// Name to show for the user making a request. Signed in users
+// get their account username; otherwise the name of the guest's
+// websocket client (if known) is used.
+func getRequestUsername(r *http.Request, clientName string) string {
+	if userID, err := getSessionUserID(r); err == nil && userID != -1 {
+		session, err := getSessStore().Get(r, "session")
+		if err == nil {
+			if username, ok := session.Values["username"].(string); ok && username != "" {
+				return username
+			}
+		}
+	}
+	if clientName = strings.TrimSpace(clientName); clientName != "" {
+		return clientName
+	}
+	return "a guest"
+}
+
+// Stop the run in progress. The request is attributed to the
+// signed in user or to the websocket client whose token is given.
+func interruptRoomRun(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type paramsModel struct {
+		ClientToken string
+	}
+	roomID := p.ByName("id")
+	room, ok := rooms[roomID]
+	if !ok {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+
+	// The body is optional
+	var pm paramsModel
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &pm); err != nil {
+			sendJsonResponse(w, map[string]string{"status": "failure"})
+			return
+		}
+	}
+	if !canControlRepl(room, pm.ClientToken) {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": inputLockedReason})
+		return
+	}
+	var clientName string
+	if client := findWsClientByToken(room, pm.ClientToken); client != nil {
+		clientName = getWsClientName(room, client)
+	}
+	username := getRequestUsername(r, clientName)
+
+	if !room.isRunInProgress() {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "No run in progress"})
+		return
+	}
+	// Let runCode do the interrupting, so that it can finish up the
+	// run properly. The run may still be starting up, so give it a
+	// moment to start listening.
+	select {
+	case room.interruptChan <- username:
+	case <-time.After(5 * time.Second):
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+// Restart the REPL for the room's current language inside the
+// existing container. For Postgres, the user's database can also
+// be dropped and recreated, to get rid of any tables etc. left
+// over from earlier runs.
+func resetRepl(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type paramsModel struct {
+		DropDatabase bool
+		ClientToken  string
+	}
+	roomID := p.ByName("id")
+	room, ok := rooms[roomID]
+	if !ok {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+
+	var pm paramsModel
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &pm); err != nil {
+			sendJsonResponse(w, map[string]string{"status": "failure"})
+			return
+		}
+	}
+
+	if !canControlRepl(room, pm.ClientToken) {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": inputLockedReason})
+		return
+	}
+
+	closeLanguageConnection(room)
+
+	var dropErr error
+	if room.lang == "postgres" && pm.DropDatabase {
+		if dropErr = recreateUserDatabase(room.container.ID); dropErr != nil {
+			logger.Printf("Error recreating database in room %s: %s\n", roomID, dropErr)
+		}
+	}
+
+	// The REPL is restarted even if the database couldn't be reset
+	if err := openLanguageConnection(room.lang, roomID); err != nil {
+		writeToWebsockets([]byte("CONTAINERERROR"), roomID)
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if dropErr != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Unable to reset database"})
+		return
+	}
+
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+// Drop the codeuser database and create a new, empty one in its
+// place. This needs to be done as the postgres superuser, and
+// each command needs to be run outside of a transaction.
+func recreateUserDatabase(containerID string) error {
+	cmd := []string{"psql", "-d", "postgres",
+		"-c", "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = 'codeuser' AND pid <> pg_backend_pid();",
+		"-c", "DROP DATABASE IF EXISTS codeuser;",
+		"-c", "CREATE DATABASE codeuser OWNER codeuser;"}
+	output, err := executeSingleCmdInContainerAs(containerID, "postgres", cmd)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(output, []byte("ERROR:")) {
+		return fmt.Errorf("psql error: %s", bytes.TrimSpace(output))
+	}
+	return nil
+}
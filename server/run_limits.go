@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How the run time limits combine: the limit is the one the room
+// owner has set, or the language default (RUN_TIMEOUT_<LANG>) if
+// there is none, and the lower of that and the cap for the owner's
+// plan (RUN_TIMEOUT_CAP_<PLAN>) is used. Rooms of users who aren't
+// signed in use the anonymous plan's cap, so they get the lower of
+// the language default and RUN_TIMEOUT_CAP_ANONYMOUS.
+
+// Run time limit used when nothing else is configured
+const defaultRunTimeout = 10 * time.Second
+
+// Plan used for rooms created by users who aren't signed in
+const anonPlan = "anonymous"
+
+// Default run time limit for each language. Can be overridden
+// with RUN_TIMEOUT_<LANG> env variables (in seconds).
+var langRunTimeouts = map[string]time.Duration{
+	"ruby":     defaultRunTimeout,
+	"node":     defaultRunTimeout,
+	"postgres": defaultRunTimeout,
+}
+
+// Highest run time limit allowed for rooms created by users on
+// each plan. Can be overridden with RUN_TIMEOUT_CAP_<PLAN> env
+// variables (in seconds).
+var planRunTimeoutCaps = map[string]time.Duration{
+	anonPlan: defaultRunTimeout,
+	"free":   30 * time.Second,
+	"pro":    120 * time.Second,
+}
+
+func initRunTimeouts() {
+	for lang, timeout := range langRunTimeouts {
+		langRunTimeouts[lang] = getEnvSeconds("RUN_TIMEOUT_"+strings.ToUpper(lang), timeout)
+	}
+	for plan, timeoutCap := range planRunTimeoutCaps {
+		planRunTimeoutCaps[plan] = getEnvSeconds("RUN_TIMEOUT_CAP_"+strings.ToUpper(plan), timeoutCap)
+	}
+	// Point out language defaults that a plan's cap cuts short
+	for lang, timeout := range langRunTimeouts {
+		for plan, timeoutCap := range planRunTimeoutCaps {
+			if timeout > timeoutCap {
+				logger.Printf("Run time limit for %s (%s) is above the cap for the %s plan; rooms on that plan get %s", lang, timeout, plan, timeoutCap)
+			}
+		}
+	}
+}
+
+func getEnvSeconds(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		logger.Printf("Invalid value for %s: %s. Using %s instead.", name, value, fallback)
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Highest run time limit the room owner can choose
+func (r *room) runTimeLimitCap() time.Duration {
+	if timeoutCap, ok := planRunTimeoutCaps[r.creatorPlan]; ok {
+		return timeoutCap
+	}
+	return planRunTimeoutCaps[anonPlan]
+}
+
+// Run time limit currently in effect in the room: the lower of
+// the owner's limit (or the language default if there is none) and
+// the cap for the owner's plan
+func (r *room) runTimeLimit() time.Duration {
+	limit, ok := langRunTimeouts[r.lang]
+	if !ok {
+		limit = defaultRunTimeout
+	}
+	if r.runTimeout > 0 {
+		limit = r.runTimeout
+	}
+	return minDuration(limit, r.runTimeLimitCap())
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func getUserPlan(userID int) string {
+	if userID == -1 {
+		return anonPlan
+	}
+	var plan string
+	query := "SELECT plan FROM users WHERE id = $1"
+	if err := pool.QueryRow(context.Background(), query, userID).Scan(&plan); err != nil {
+		logger.Println("Unable to get user plan: ", err)
+		return anonPlan
+	}
+	return plan
+}
+
+func setRoomRunTimeout(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type paramsModel struct {
+		RoomID  string
+		Seconds int
+	}
+	type responseModel struct {
+		Status       string `json:"status"`
+		RunTimeLimit int    `json:"runTimeLimit"`
+	}
+	var pm paramsModel
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+	err = json.Unmarshal(body, &pm)
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+
+	room, ok := rooms[pm.RoomID]
+	if !ok {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+
+	// Only the (signed in) room owner can change the limit
+	userID, err := getSessionUserID(r)
+	if err != nil || userID == -1 || userID != room.creatorUserID {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+
+	// Zero or less resets the room to the language default. Larger
+	// values are clamped to the cap for the owner's plan.
+	if pm.Seconds <= 0 {
+		room.runTimeout = 0
+	} else {
+		room.runTimeout = minDuration(time.Duration(pm.Seconds)*time.Second, room.runTimeLimitCap())
+	}
+
+	sendJsonResponse(w, &responseModel{
+		Status:       "success",
+		RunTimeLimit: int(room.runTimeLimit() / time.Second),
+	})
+}
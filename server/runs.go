@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max number of bytes of each kind of output saved with a run
+const runOutputCap = 64000
+
+// Record describing a single code run
+type runResult struct {
+	RunID          string     `json:"runID"`
+	Language       string     `json:"language"`
+	StartTime      int64      `json:"startTime"`
+	EndTime        int64      `json:"endTime"`
+	WallTimeMs     int64      `json:"wallTimeMs"`
+	ExitStatus     *int       `json:"exitStatus"`
+	ExceptionClass string     `json:"exceptionClass"`
+	TimedOut       bool       `json:"timedOut"`
+	Interrupted    bool       `json:"interrupted"`
+	OutputBytes    int        `json:"outputBytes"`
+	Split          bool       `json:"split"`
+	Output         *runOutput `json:"-"`
+	Code           string     `json:"-"`
+	// Output captured from the REPL (not sent in the json, since
+	// it's already on everybody's terminal)
+	ReplOutput []byte `json:"-"`
+	start      time.Time
+}
+
+// Regexps used to find the class of an uncaught exception in run
+// output. REPL and split (non-TTY) runs report errors differently.
+var replExceptionPatterns = map[string]*regexp.Regexp{
+	"ruby":     regexp.MustCompile(`(?m)^([A-Z][\w:]*(?:Error|Exception|Interrupt)):`),
+	"node":     regexp.MustCompile(`Uncaught ([A-Z]\w*)`),
+	"postgres": regexp.MustCompile(`(?m)^(?:psql:[^:]*:\d+: )?(ERROR|FATAL):`),
+}
+var splitExceptionPatterns = map[string]*regexp.Regexp{
+	"ruby":     regexp.MustCompile(`(?m)\(([A-Z][\w:]*)\)$`),
+	"node":     regexp.MustCompile(`(?m)^([A-Z]\w*(?:Error|Exception))\b`),
+	"postgres": regexp.MustCompile(`(?m)^(?:psql:[^:]*:\d+: )?(ERROR|FATAL):`),
+}
+var ansiEscapePattern = regexp.MustCompile("\x1B(?:[@-Z\\-_]|[[0-?]*[ -/]*[@-~])")
+
+func generateRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to a time based ID, like room IDs
+		return generateRoomID()
+	}
+	return hex.EncodeToString(b)
+}
+
+func newRunResult(lang string, split bool) *runResult {
+	now := time.Now()
+	return &runResult{
+		RunID:     generateRunID(),
+		Language:  lang,
+		StartTime: now.UnixMilli(),
+		Split:     split,
+		start:     now,
+	}
+}
+
+// Fill in the end time and output related fields once the run
+// is over
+func (rr *runResult) finish() {
+	end := time.Now()
+	rr.EndTime = end.UnixMilli()
+	rr.WallTimeMs = end.Sub(rr.start).Milliseconds()
+	var patterns map[string]*regexp.Regexp
+	var output []byte
+	if rr.Split {
+		patterns = splitExceptionPatterns
+		if rr.Output != nil {
+			rr.OutputBytes = rr.Output.stdoutBytes + rr.Output.stderrBytes
+			output = rr.Output.Stderr
+		}
+	} else {
+		patterns = replExceptionPatterns
+		rr.OutputBytes = len(rr.ReplOutput)
+		output = ansiEscapePattern.ReplaceAll(rr.ReplOutput, []byte(""))
+	}
+	if re, ok := patterns[rr.Language]; ok {
+		if match := re.FindSubmatch(output); match != nil {
+			rr.ExceptionClass = string(match[1])
+		}
+	}
+}
+
+// Send the run result to everybody in the room and save it with
+// the code session, if there is one
+func recordRunResult(roomID string, rr *runResult) {
+	room, ok := rooms[roomID]
+	if !ok {
+		return
+	}
+	if room.codeSessionID != -1 {
+		if err := saveRunResult(room.codeSessionID, rr); err != nil {
+			logger.Println("unable to insert record into runs: ", err)
+		}
+	}
+	message, err := json.Marshal(rr)
+	if err != nil {
+		logger.Println("err in marshaling run result: ", err)
+		return
+	}
+	writeToWebsockets(append([]byte("RUNRESULT:"), message...), roomID)
+}
+
+var codeFilenames = map[string]string{
+	"ruby":     "code.rb",
+	"node":     "code.js",
+	"postgres": "code.sql",
+}
+
+// Make output safe to store in a TEXT column, cutting it down to
+// runOutputCap bytes. Returns whether the output was truncated.
+func prepareOutputForStorage(output []byte) (string, bool) {
+	truncated := false
+	if len(output) > runOutputCap {
+		output = output[:runOutputCap]
+		truncated = true
+	}
+	// Postgres won't store null bytes or invalid UTF-8 in TEXT
+	output = bytes.ReplaceAll(output, []byte("\x00"), []byte(""))
+	return strings.ToValidUTF8(string(output), ""), truncated
+}
+
+func saveRunResult(codeSessionID int, rr *runResult) error {
+	var output, stdout, stderr string
+	var truncated, stdoutTruncated, stderrTruncated bool
+	if rr.Split && rr.Output != nil {
+		stdout, stdoutTruncated = prepareOutputForStorage(rr.Output.Stdout)
+		stderr, stderrTruncated = prepareOutputForStorage(rr.Output.Stderr)
+		// The streams may already have been cut down during the run
+		stdoutTruncated = stdoutTruncated || rr.Output.stdoutBytes > len(rr.Output.Stdout)
+		stderrTruncated = stderrTruncated || rr.Output.stderrBytes > len(rr.Output.Stderr)
+		truncated = stdoutTruncated || stderrTruncated
+	} else {
+		output, truncated = prepareOutputForStorage(rr.ReplOutput)
+	}
+	queryLines :=
+		[]string{
+			"INSERT INTO runs(coding_session_id, run_uid, lang, code, output, stdout, stderr,",
+			"output_truncated, split, exit_status, exception_class, timed_out, interrupted,",
+			"output_bytes, when_started, when_ended, wall_time_ms)",
+			"VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)"}
+	query := strings.Join(queryLines, " ")
+	_, err := pool.Exec(context.Background(), query, codeSessionID, rr.RunID, rr.Language,
+		rr.Code, output, stdout, stderr, truncated, rr.Split, rr.ExitStatus, rr.ExceptionClass,
+		rr.TimedOut, rr.Interrupted, rr.OutputBytes, rr.StartTime, rr.EndTime, rr.WallTimeMs)
+	return err
+}
+
+// A run as stored in the runs table
+type savedRun struct {
+	ID              int    `json:"id"`
+	RunID           string `json:"runID"`
+	Language        string `json:"language"`
+	Code            string `json:"code"`
+	Output          string `json:"output"`
+	Stdout          string `json:"stdout"`
+	Stderr          string `json:"stderr"`
+	OutputTruncated bool   `json:"outputTruncated"`
+	Split           bool   `json:"split"`
+	ExitStatus      *int   `json:"exitStatus"`
+	ExceptionClass  string `json:"exceptionClass"`
+	TimedOut        bool   `json:"timedOut"`
+	Interrupted     bool   `json:"interrupted"`
+	OutputBytes     int    `json:"outputBytes"`
+	StartTime       int64  `json:"startTime"`
+	EndTime         int64  `json:"endTime"`
+	WallTimeMs      int64  `json:"wallTimeMs"`
+}
+
+const savedRunColumns = "r.id, r.run_uid, r.lang, r.code, r.output, r.stdout, r.stderr, " +
+	"r.output_truncated, r.split, r.exit_status, r.exception_class, r.timed_out, " +
+	"r.interrupted, r.output_bytes, r.when_started, r.when_ended, r.wall_time_ms"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSavedRun(row rowScanner) (savedRun, error) {
+	var sr savedRun
+	var exceptionClass *string
+	err := row.Scan(&sr.ID, &sr.RunID, &sr.Language, &sr.Code, &sr.Output, &sr.Stdout,
+		&sr.Stderr, &sr.OutputTruncated, &sr.Split, &sr.ExitStatus, &exceptionClass,
+		&sr.TimedOut, &sr.Interrupted, &sr.OutputBytes, &sr.StartTime, &sr.EndTime,
+		&sr.WallTimeMs)
+	if exceptionClass != nil {
+		sr.ExceptionClass = *exceptionClass
+	}
+	return sr, err
+}
+
+func getCodeSessionRuns(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type responseModel struct {
+		Status string     `json:"status"`
+		Runs   []savedRun `json:"runs"`
+	}
+
+	userID, err := getSessionUserID(r)
+	if err != nil || userID == -1 {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+	codeSessionID, err := strconv.Atoi(r.URL.Query().Get("codeSessionID"))
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+
+	queryLines :=
+		[]string{
+			"SELECT", savedRunColumns,
+			"FROM runs r INNER JOIN coding_sessions c ON r.coding_session_id = c.id",
+			"WHERE c.id = $1 AND c.user_id = $2",
+			"ORDER BY r.when_started DESC LIMIT 50"}
+	query := strings.Join(queryLines, " ")
+	rows, err := pool.Query(context.Background(), query, codeSessionID, userID)
+	if err != nil {
+		logger.Println("Query unsuccessful: ", err)
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+	defer rows.Close()
+
+	runs := []savedRun{}
+	for rows.Next() {
+		sr, err := scanSavedRun(rows)
+		if err != nil {
+			logger.Println("Error iterating dataset: ", err)
+			sendJsonResponse(w, &responseModel{Status: "failure"})
+			return
+		}
+		runs = append(runs, sr)
+	}
+
+	sendJsonResponse(w, &responseModel{Status: "success", Runs: runs})
+}
+
+// Run the code from a saved run again in the given room
+func rerunCode(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type paramsModel struct {
+		RoomID          string
+		ID              int
+		PromptLineEmpty bool
+		ClientToken     string
+	}
+	type responseModel struct {
+		Status string     `json:"status"`
+		Reason string     `json:"reason,omitempty"`
+		Result *runResult `json:"result"`
+	}
+	var pm paramsModel
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+	err = json.Unmarshal(body, &pm)
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+
+	room, ok := rooms[pm.RoomID]
+	if !ok {
+		sendJsonResponse(w, &responseModel{Status: "failure", Reason: "Room does not exist"})
+		return
+	}
+
+	userID, err := getSessionUserID(r)
+	if err != nil || userID == -1 {
+		sendJsonResponse(w, &responseModel{Status: "failure", Reason: "Not signed in"})
+		return
+	}
+	if !canControlRepl(room, pm.ClientToken) {
+		sendJsonResponse(w, &responseModel{Status: "failure", Reason: inputLockedReason})
+		return
+	}
+
+	// Users can only rerun runs from their own code sessions
+	queryLines :=
+		[]string{
+			"SELECT", savedRunColumns,
+			"FROM runs r INNER JOIN coding_sessions c ON r.coding_session_id = c.id",
+			"WHERE r.id = $1 AND c.user_id = $2"}
+	query := strings.Join(queryLines, " ")
+	sr, err := scanSavedRun(pool.QueryRow(context.Background(), query, pm.ID, userID))
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure", Reason: "Run not found"})
+		return
+	}
+
+	if sr.Language != room.lang {
+		sendJsonResponse(w, &responseModel{Status: "failure", Reason: "Run language does not match room language"})
+		return
+	}
+
+	if err := copyCodeToContainer(pm.RoomID, sr.Code, codeFilenames[sr.Language]); err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+
+	lines := strings.Count(sr.Code, "\n") + 1
+	result, err := runCode(pm.RoomID, sr.Language, lines, pm.PromptLineEmpty, sr.Split)
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure", Result: result})
+		return
+	}
+
+	sendJsonResponse(w, &responseModel{Status: "success", Result: result})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"github.com/gorilla/sessions"
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Sessions are kept in the user_sessions table. The cookie only
+// holds a random session token, and the table only its hash, so
+// that sessions can be listed and revoked (a revoked session's
+// cookie is worthless) and a copy of the table can't be used to
+// sign in.
+//
+// Sessions last SESSION_MAX_AGE seconds (default 30 days) from the
+// last time they were saved.
+
+// Time between updates of a session's last-seen time
+const sessionLastSeenInterval = time.Minute
+
+const sessionUserAgentMaxLength = 255
+
+type pgSessionStore struct {
+	// Default options for new sessions
+	Options *sessions.Options
+}
+
+func newPgSessionStore() *pgSessionStore {
+	return &pgSessionStore{
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+}
+
+func initSessionStore() {
+	store.Options = &sessions.Options{
+		Path:     "/api",
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+		MaxAge:   int(getEnvSeconds("SESSION_MAX_AGE", 30*24*time.Hour).Seconds()),
+	}
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// The session for the request, cached for the rest of the request
+func (s *pgSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// Load the session named in the request's cookie. Unknown, expired
+// and revoked sessions come back as new (empty) ones.
+func (s *pgSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil || c.Value == "" {
+		return session, nil
+	}
+	var data []byte
+	var lastSeen int64
+	tokenHash := hashSessionToken(c.Value)
+	now := time.Now()
+	query := "SELECT data, when_last_seen FROM user_sessions WHERE token_hash = $1 AND name = $2 AND when_expires > $3"
+	err = getDBPool().QueryRow(context.Background(), query, tokenHash, name, now.Unix()).Scan(&data, &lastSeen)
+	if err == pgx.ErrNoRows {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		logger.Println("Unable to decode session: ", err)
+		return session, nil
+	}
+	session.ID = c.Value
+	session.IsNew = false
+
+	if now.Sub(time.Unix(lastSeen, 0)) > sessionLastSeenInterval {
+		query = "UPDATE user_sessions SET when_last_seen = $1 WHERE token_hash = $2"
+		if _, err := getDBPool().Exec(context.Background(), query, now.Unix(), tokenHash); err != nil {
+			logger.Println("Unable to update session: ", err)
+		}
+	}
+	return session, nil
+}
+
+// Write the session to the table and set its cookie. A session
+// with a negative MaxAge is deleted.
+func (s *pgSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			query := "DELETE FROM user_sessions WHERE token_hash = $1"
+			if _, err := getDBPool().Exec(context.Background(), query, hashSessionToken(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	// Nothing worth a session yet
+	if session.ID == "" && len(session.Values) == 0 {
+		return nil
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+	var userID *int
+	if id, ok := session.Values["userID"].(int); ok {
+		userID = &id
+	}
+	now := time.Now()
+	expires := now.Add(time.Duration(session.Options.MaxAge) * time.Second).Unix()
+
+	if session.ID != "" {
+		query := "UPDATE user_sessions SET data = $1, user_id = $2, when_expires = $3, when_last_seen = $4 WHERE token_hash = $5"
+		tag, err := getDBPool().Exec(context.Background(), query, data.Bytes(), userID, expires, now.Unix(), hashSessionToken(session.ID))
+		if err != nil {
+			return err
+		}
+		// The session may have been revoked since it was loaded, in
+		// which case it isn't brought back
+		if tag.RowsAffected() == 0 {
+			http.SetCookie(w, sessions.NewCookie(session.Name(), "", &sessions.Options{Path: session.Options.Path, MaxAge: -1}))
+			return nil
+		}
+	} else {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		token := base64.RawURLEncoding.EncodeToString(b)
+		query := "INSERT INTO user_sessions(token_hash, name, user_id, data, user_agent, when_created, when_last_seen, when_expires) VALUES($1, $2, $3, $4, $5, $6, $7, $8)"
+		if _, err := getDBPool().Exec(context.Background(), query, hashSessionToken(token), session.Name(), userID, data.Bytes(), truncateUserAgent(r.UserAgent()), now.Unix(), now.Unix(), expires); err != nil {
+			return err
+		}
+		session.ID = token
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+// Give the session a new token, so that a token picked up before
+// the session signed in (or got more rights) can't be used with
+// it. The old token's row is deleted; the new one is written when
+// the session is saved.
+func renewSessionID(session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	query := "DELETE FROM user_sessions WHERE token_hash = $1"
+	if _, err := getDBPool().Exec(context.Background(), query, hashSessionToken(session.ID)); err != nil {
+		return err
+	}
+	session.ID = ""
+	session.IsNew = true
+	return nil
+}
+
+// User agent cut down to what the tables hold (in characters, not
+// bytes)
+func truncateUserAgent(userAgent string) string {
+	if runes := []rune(userAgent); len(runes) > sessionUserAgentMaxLength {
+		return string(runes[:sessionUserAgentMaxLength])
+	}
+	return userAgent
+}
+
+// Sign the user out everywhere (e.g. after a password change),
+// except for the session with the given token, if any
+func revokeUserSessions(userID int, exceptToken string) error {
+	query := "DELETE FROM user_sessions WHERE user_id = $1 AND token_hash <> $2"
+	_, err := getDBPool().Exec(context.Background(), query, userID, hashSessionToken(exceptToken))
+	return err
+}
+
+func startExpiredSessionCleaner() {
+	go func() {
+		for {
+			query := "DELETE FROM user_sessions WHERE when_expires < $1"
+			if _, err := getDBPool().Exec(context.Background(), query, time.Now().Unix()); err != nil {
+				logger.Println("Unable to delete expired sessions: ", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// The signed-in user's sessions, most recently used first
+func getUserSessions(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	type sessionModel struct {
+		ID           int    `json:"id"`
+		UserAgent    string `json:"userAgent"`
+		WhenCreated  int64  `json:"whenCreated"`
+		WhenLastSeen int64  `json:"whenLastSeen"`
+		Current      bool   `json:"current"`
+	}
+	type responseModel struct {
+		Status   string         `json:"status"`
+		Sessions []sessionModel `json:"sessions"`
+	}
+
+	query := "SELECT id, token_hash, user_agent, when_created, when_last_seen FROM user_sessions WHERE user_id = $1 AND when_expires > $2 ORDER BY when_last_seen DESC"
+	rows, err := getDBPool().Query(context.Background(), query, userID, time.Now().Unix())
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+	defer rows.Close()
+	currentHash := hashSessionToken(session.ID)
+	response := &responseModel{Status: "success", Sessions: []sessionModel{}}
+	for rows.Next() {
+		var s sessionModel
+		var tokenHash string
+		if err := rows.Scan(&s.ID, &tokenHash, &s.UserAgent, &s.WhenCreated, &s.WhenLastSeen); err != nil {
+			sendJsonResponse(w, &responseModel{Status: "failure"})
+			return
+		}
+		s.Current = tokenHash == currentHash
+		response.Sessions = append(response.Sessions, s)
+	}
+	sendJsonResponse(w, response)
+}
+
+// Sign one of the user's sessions out
+func revokeUserSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(p.ByName("id"))
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	var tokenHash string
+	query := "DELETE FROM user_sessions WHERE id = $1 AND user_id = $2 RETURNING token_hash"
+	err = getDBPool().QueryRow(context.Background(), query, id, userID).Scan(&tokenHash)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			logger.Println("Unable to revoke session: ", err)
+		}
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if tokenHash == hashSessionToken(session.ID) {
+		// Revoking the current session is signing out
+		session.Options.MaxAge = -1
+		session.Save(r, w)
+	}
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+// Sign the user out of all sessions but the current one
+func revokeOtherUserSessions(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+	if err := revokeUserSessions(userID, session.ID); err != nil {
+		logger.Println("Unable to revoke sessions: ", err)
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"strconv"
+	"time"
+)
+
+// Prefixes for split mode output messages, so that the client can
+// tell stdout and stderr apart (and colour them differently)
+var streamTags = map[string][]byte{
+	"stdout": []byte("STDOUT:"),
+	"stderr": []byte("STDERR:"),
+}
+
+// Output of a split mode run, with stdout and stderr kept apart.
+// Only the first runOutputCap bytes of each stream are kept.
+type runOutput struct {
+	Stdout []byte `json:"stdout"`
+	Stderr []byte `json:"stderr"`
+	// Total bytes written to each stream, including any that
+	// weren't kept
+	stdoutBytes int
+	stderrBytes int
+}
+
+// Forwards one of the streams of a split mode run to the room's
+// websockets, keeping a copy of the start of it
+type streamWriter struct {
+	stream  string
+	roomID  string
+	buf     *[]byte
+	written *int
+}
+
+func (sw streamWriter) Write(p []byte) (int, error) {
+	*sw.written += len(p)
+	if space := runOutputCap - len(*sw.buf); space > 0 {
+		if len(p) < space {
+			space = len(p)
+		}
+		*sw.buf = append(*sw.buf, p[:space]...)
+	}
+	// There is no TTY in split mode, so we need to add the carriage
+	// returns ourselves
+	writeStreamToWebsockets(sw.stream, bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n")), sw.roomID)
+	return len(p), nil
+}
+
+func getSplitRunCmd(lang string, timeLimit time.Duration) []string {
+	var cmd []string
+	switch lang {
+	case "ruby":
+		cmd = []string{"ruby", "code.rb"}
+	case "node":
+		cmd = []string{"node", "code.js"}
+	case "postgres":
+		cmd = []string{"psql", "-f", "code.sql"}
+	default:
+		return nil
+	}
+	// Make sure the program is killed inside the container even if
+	// we lose track of it. Give it an extra second so that our own
+	// run timer fires first.
+	seconds := strconv.Itoa(int(timeLimit/time.Second) + 1)
+	return append([]string{"timeout", "-s", "KILL", seconds}, cmd...)
+}
+
+// Runs the saved code file directly (not through the REPL) in a
+// non-TTY exec, so that stdout and stderr can be captured
+// separately. The REPL is left untouched, except for clearing the
+// prompt line if it isn't empty.
+func runCodeSplit(roomID string, lang string, promptLineEmpty bool, result *runResult) error {
+	room := rooms[roomID]
+	cn := room.container
+	room.echo = false
+
+	if !promptLineEmpty {
+		// send ctrl-c
+		if err := room.awaitSideEffect("promptReady", func() { cn.runner.Write([]byte("\x03")) }, 2*time.Second, false); err != nil {
+			writeToWebsockets([]byte("TIMEOUT"), roomID)
+			return errors.New("Container Timeout")
+		}
+	}
+
+	timeLimit := room.runTimeLimit()
+	cmd := getSplitRunCmd(lang, timeLimit)
+	if cmd == nil {
+		room.echo = true
+		return errors.New("no split run command for language " + lang)
+	}
+
+	writeToWebsockets([]byte("\r\n\r\nRunning your code...\r\n"), roomID)
+
+	ctx := context.Background()
+	execOpts := types.ExecConfig{
+		User:         "codeuser",
+		Tty:          false,
+		AttachStdin:  false,
+		AttachStdout: true,
+		AttachStderr: true,
+		WorkingDir:   "/home/codeuser",
+		Cmd:          cmd,
+	}
+	resp, err := cli.ContainerExecCreate(ctx, cn.ID, execOpts)
+	if err != nil {
+		writeToWebsockets([]byte("CONTAINERERROR"), roomID)
+		return containerExecCreateError{dockerErrMessage: err.Error()}
+	}
+	connection, err := cli.ContainerExecAttach(ctx, resp.ID, types.ExecStartCheck{})
+	if err != nil {
+		writeToWebsockets([]byte("CONTAINERERROR"), roomID)
+		return containerExecAttachError{dockerErrMessage: err.Error()}
+	}
+	defer connection.Close()
+
+	output := &runOutput{}
+	result.Output = output
+	stdout := streamWriter{stream: "stdout", roomID: roomID, buf: &output.Stdout, written: &output.stdoutBytes}
+	stderr := streamWriter{stream: "stderr", roomID: roomID, buf: &output.Stderr, written: &output.stderrBytes}
+	copyDoneChan := make(chan error, 1)
+	go func() {
+		// Docker multiplexes the two streams when there is no TTY
+		_, err := stdcopy.StdCopy(stdout, stderr, connection.Reader)
+		copyDoneChan <- err
+	}()
+	// Stop reading output when the run is cut short. The copy has to
+	// be finished before the output in the result is looked at.
+	stopCopy := func() {
+		connection.Close()
+		<-copyDoneChan
+	}
+
+	room.runTimeoutTimer = time.NewTimer(timeLimit)
+	select {
+	case <-room.runTimeoutTimer.C:
+		// Closing the connection stops the output; the timeout
+		// wrapper takes care of the process itself
+		stopCopy()
+		result.TimedOut = true
+		room.screen.EndBurst()
+		writeToWebsockets([]byte("CANCELRUN"), roomID)
+		writeToWebsockets(getTimeLimitMessage(room), roomID)
+		displayInitialPrompt(roomID, false, "1")
+		room.echo = true
+		return errors.New("Container or run timeout")
+	case <-room.abortRunChan:
+		stopCopy()
+		result.Interrupted = true
+		return errors.New("Container or run timeout")
+	case username := <-room.interruptChan:
+		room.runTimeoutTimer.Stop()
+		stopCopy()
+		// Signal the timeout wrapper, which passes the signal on to
+		// the program
+		killCmd := []string{"pkill", "-TERM", "-f", "^timeout -s KILL"}
+		if _, err := executeSingleCmdInContainer(cn.ID, killCmd); err != nil {
+			logger.Println("error in stopping split run:", err, "in room:", roomID)
+		}
+		result.Interrupted = true
+		room.screen.EndBurst()
+		writeToWebsockets([]byte("CANCELRUN"), roomID)
+		writeToWebsockets(getRunCancelledMessage(username), roomID)
+		displayInitialPrompt(roomID, false, "1")
+		room.echo = true
+		broadcastRunCancelled(roomID, username)
+		return errors.New("Run cancelled by user")
+	case err := <-copyDoneChan:
+		room.runTimeoutTimer.Stop()
+		if err != nil {
+			logger.Println("error in reading split run output:", err, "in room:", roomID)
+		}
+	}
+
+	if inspect, err := cli.ContainerExecInspect(ctx, resp.ID); err != nil {
+		logger.Println("error in inspecting split run exec:", err, "in room:", roomID)
+	} else {
+		exitStatus := inspect.ExitCode
+		result.ExitStatus = &exitStatus
+	}
+
+	// There is no REPL prompt to end the burst of output when a
+	// split run is over
+	room.screen.EndBurst()
+	// Program output doesn't necessarily end with a newline
+	if len(output.Stdout) > 0 || len(output.Stderr) > 0 {
+		writeToWebsockets([]byte("\r\n"), roomID)
+	}
+	displayInitialPrompt(roomID, false, "1")
+	room.echo = true
+	writeToWebsockets([]byte("RUNDONE"), roomID)
+	return nil
+}
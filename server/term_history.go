@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"unsafe"
+)
+
+// Limits on the terminal history kept for each room
+type termHistLimits struct {
+	// Max number of lines kept after they scroll off the top of
+	// the screen
+	maxLines int
+	// Max number of bytes used by those lines
+	maxBytes int
+	// Max number of bytes of a single burst of output (output
+	// between two prompts) that goes into the history
+	maxBurstBytes int
+}
+
+// Limits used for new rooms. Can be set with the
+// TERM_SCROLLBACK_LINES, TERM_SCROLLBACK_BYTES and
+// TERM_BURST_BYTES env variables.
+var histLimits = termHistLimits{
+	maxLines:      1000,
+	maxBytes:      2 << 20,
+	maxBurstBytes: 256 << 10,
+}
+
+// Marker written to the history in place of the rest of an output
+// burst that is too long to keep
+const burstTruncatedMarker = "\r\n\x1b[0;7m[output truncated]\x1b[0m\r\n"
+
+const termCellSize = int(unsafe.Sizeof(termCell{}))
+
+func initTermHistLimits() {
+	histLimits.maxLines = getEnvInt("TERM_SCROLLBACK_LINES", histLimits.maxLines)
+	histLimits.maxBytes = getEnvInt("TERM_SCROLLBACK_BYTES", histLimits.maxBytes)
+	histLimits.maxBurstBytes = getEnvInt("TERM_BURST_BYTES", histLimits.maxBurstBytes)
+}
+
+func getEnvInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		logger.Printf("Invalid value for %s: %s. Using %d instead.", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// Ring buffer of scrollback lines, bounded both in number of
+// lines and in bytes. The oldest lines are dropped to make room
+// for new ones.
+type lineRing struct {
+	lines    []termLine
+	start    int
+	count    int
+	bytes    int
+	maxLines int
+	maxBytes int
+}
+
+func newLineRing(maxLines, maxBytes int) *lineRing {
+	return &lineRing{maxLines: maxLines, maxBytes: maxBytes}
+}
+
+func lineBytes(line termLine) int {
+	return len(line.cells) * termCellSize
+}
+
+func (lr *lineRing) push(line termLine) {
+	size := lineBytes(line)
+	if lr.maxLines <= 0 || size > lr.maxBytes {
+		return
+	}
+	for lr.count > 0 && (lr.count >= lr.maxLines || lr.bytes+size > lr.maxBytes) {
+		lr.popOldest()
+	}
+	if lr.count < len(lr.lines) {
+		lr.lines[(lr.start+lr.count)%len(lr.lines)] = line
+	} else {
+		// No free slots, but the ring is still below maxLines
+		// lines, so it can grow. Unwrap it first if needed.
+		if lr.start != 0 {
+			lines := make([]termLine, lr.count, 2*lr.count)
+			copy(lines, lr.lines[lr.start:])
+			copy(lines[len(lr.lines)-lr.start:], lr.lines[:lr.start])
+			lr.lines = lines
+			lr.start = 0
+		}
+		lr.lines = append(lr.lines, line)
+	}
+	lr.count++
+	lr.bytes += size
+}
+
+func (lr *lineRing) popOldest() {
+	lr.bytes -= lineBytes(lr.lines[lr.start])
+	lr.lines[lr.start] = termLine{}
+	lr.start = (lr.start + 1) % len(lr.lines)
+	lr.count--
+}
+
+func (lr *lineRing) clear() {
+	lr.lines = nil
+	lr.start = 0
+	lr.count = 0
+	lr.bytes = 0
+}
+
+func (lr *lineRing) len() int {
+	return lr.count
+}
+
+// Call fn on each line, oldest first
+func (lr *lineRing) each(fn func(termLine)) {
+	for i := 0; i < lr.count; i++ {
+		fn(lr.lines[(lr.start+i)%len(lr.lines)])
+	}
+}
+
+// Scrollback lines don't need their trailing blanks, unless they
+// are wrapped (the blanks are then part of the text)
+func trimTermLine(line termLine) termLine {
+	if line.wrapped {
+		return line
+	}
+	end := len(line.cells)
+	for end > 0 && line.cells[end-1] == (termCell{ch: ' '}) {
+		end--
+	}
+	cells := make([]termCell, end)
+	copy(cells, line.cells)
+	return termLine{cells: cells}
+}
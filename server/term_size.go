@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// How the terminal size of a room is chosen when its participants
+// have different window sizes
+const (
+	// Largest size that fits in every participant's window
+	termSizeSmallest = "smallest"
+	// The room owner's window size (falls back to smallest when the
+	// owner isn't connected)
+	termSizeOwner = "owner"
+)
+
+// Limits of the terminal size. Sizes reported by clients are
+// clamped to these, since each room keeps a screen model of the
+// terminal.
+const (
+	minTermCols = 20
+	maxTermCols = 400
+	minTermRows = 5
+	maxTermRows = 200
+)
+
+// Policy used for new rooms. Can be set with the TERM_SIZE_POLICY
+// env variable.
+var defaultTermSizePolicy = termSizeSmallest
+
+func initTermSizePolicy() {
+	switch policy := os.Getenv("TERM_SIZE_POLICY"); policy {
+	case "":
+	case termSizeSmallest, termSizeOwner:
+		defaultTermSizePolicy = policy
+	default:
+		logger.Printf("Invalid value for TERM_SIZE_POLICY: %s. Using %s instead.", policy, defaultTermSizePolicy)
+	}
+}
+
+// Parse a "RESIZE:cols,rows" message from a client
+func parseResizeMessage(message []byte) (cols, rows int, ok bool) {
+	text := strings.TrimPrefix(string(message), "RESIZE:")
+	parts := strings.Split(text, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	cols, err := strconv.Atoi(parts[0])
+	if err != nil || cols < 1 || cols > 1000 {
+		return 0, 0, false
+	}
+	rows, err = strconv.Atoi(parts[1])
+	if err != nil || rows < 1 || rows > 1000 {
+		return 0, 0, false
+	}
+	return cols, rows, true
+}
+
+func termSizeMessage(cols, rows int) []byte {
+	return []byte(fmt.Sprintf("TERMSIZE:%d,%d", cols, rows))
+}
+
+// Work out the terminal size the room's policy calls for from the
+// sizes reported by its clients. ok is false if no client has
+// reported a size yet.
+func effectiveTermSize(room *room) (cols, rows int, ok bool) {
+	room.wsMu.Lock()
+	defer room.wsMu.Unlock()
+
+	smallest := func(clients []*wsClient) (int, int, bool) {
+		cols, rows, found := 0, 0, false
+		for _, c := range clients {
+			if c.cols == 0 {
+				continue
+			}
+			if !found || c.cols < cols {
+				cols = c.cols
+			}
+			if !found || c.rows < rows {
+				rows = c.rows
+			}
+			found = true
+		}
+		return cols, rows, found
+	}
+
+	if room.termSizePolicy == termSizeOwner {
+		owners := []*wsClient{}
+		for _, c := range room.wsockets {
+			if c.isOwner {
+				owners = append(owners, c)
+			}
+		}
+		if cols, rows, ok = smallest(owners); ok {
+			return cols, rows, ok
+		}
+	}
+	return smallest(room.wsockets)
+}
+
+// Resize the room's terminal if the effective size has changed,
+// and let every client know the size in effect
+func updateTermSize(room *room) {
+	cols, rows, ok := effectiveTermSize(room)
+	if !ok {
+		return
+	}
+	cols = clamp(cols, minTermCols, maxTermCols)
+	rows = clamp(rows, minTermRows, maxTermRows)
+	if cols == room.termCols && rows == room.termRows {
+		return
+	}
+	room.termCols = cols
+	room.termRows = rows
+	room.screen.Resize(rows, cols)
+	room.recording.recordResize(cols, rows)
+
+	cn := room.container
+	if err := resizeTTY(cn, cols, rows); err != nil {
+		logger.Println("Error resizing container tty: ", err)
+	}
+	if err := resizeExecTTY(cn); err != nil {
+		logger.Println("Error resizing repl tty: ", err)
+	}
+	sendControlMessage(room, termSizeMessage(cols, rows))
+}
+
+// Resize the tty of the REPL exec to the size last set on the
+// container
+func resizeExecTTY(cn *containerDetails) error {
+	if cn.execID == "" || cn.ttyCols == 0 {
+		return nil
+	}
+	resizeOpts := types.ResizeOptions{
+		Height: uint(cn.ttyRows),
+		Width:  uint(cn.ttyCols),
+	}
+	return cli.ContainerExecResize(context.Background(), cn.execID, resizeOpts)
+}
+
+// Only the room owner can change the policy
+func setTermSizePolicy(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type paramsModel struct {
+		Policy string
+	}
+	roomID := p.ByName("id")
+	room, ok := rooms[roomID]
+	if !ok {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	userID, err := getSessionUserID(r)
+	if err != nil || userID == -1 || userID != room.creatorUserID {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+
+	var pm paramsModel
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if err = json.Unmarshal(body, &pm); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if pm.Policy != termSizeSmallest && pm.Policy != termSizeOwner {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	room.termSizePolicy = pm.Policy
+	updateTermSize(room)
+
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
@@ -0,0 +1,869 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// Graphic rendition flags
+const (
+	attrBold uint8 = 1 << iota
+	attrDim
+	attrItalic
+	attrUnderline
+	attrBlink
+	attrInverse
+	attrHidden
+	attrStrike
+)
+
+// Colors are 0 for the default color, 1-256 for palette colors
+// (index + 1) and colorRGB|0xRRGGBB for true colors
+const colorRGB uint32 = 1 << 24
+
+type cellAttr struct {
+	fg    uint32
+	bg    uint32
+	flags uint8
+}
+
+type termCell struct {
+	ch   rune
+	attr cellAttr
+}
+
+type termLine struct {
+	cells []termCell
+	// Set when the line continues on the next line because the
+	// text was wrapped at the last column
+	wrapped bool
+}
+
+// Longer parameter strings are cut off
+const maxCSIParamsLength = 64
+
+// Parser states
+const (
+	stateGround = iota
+	stateEscape
+	stateCharset
+	stateCSI
+	stateOSC
+	stateOSCEscape
+)
+
+// A VT100/xterm screen model. Output sent to the room's terminals
+// is fed into it so that the server always knows what the screen
+// looks like, and can send a compact snapshot to people joining
+// the room. Only the commonly used control sequences are
+// interpreted; anything else is ignored.
+type termScreen struct {
+	mu             sync.Mutex
+	rows           int
+	cols           int
+	lines          []termLine
+	altLines       []termLine
+	altScreen      bool
+	scrollback     *lineRing
+	maxBurstBytes  int
+	burstBytes     int
+	burstTruncated bool
+	// Last (partial) line of output left out of a truncated burst
+	droppedTail     []byte
+	curRow          int
+	curCol          int
+	wrapPending     bool
+	attr            cellAttr
+	savedRow        int
+	savedCol        int
+	savedAttr       cellAttr
+	scrollTop       int
+	scrollBottom    int
+	autoWrap        bool
+	cursorHidden    bool
+	state           int
+	params          []byte
+	partialRune     []byte
+	lastPrintedRune rune
+}
+
+func newTermScreen(rows, cols int, limits termHistLimits) *termScreen {
+	s := &termScreen{
+		scrollback:    newLineRing(limits.maxLines, limits.maxBytes),
+		maxBurstBytes: limits.maxBurstBytes,
+	}
+	s.rows, s.cols = sanitizeTermSize(rows, cols)
+	s.reset()
+	return s
+}
+
+func sanitizeTermSize(rows, cols int) (int, int) {
+	if rows < 1 {
+		rows = 24
+	}
+	if cols < 1 {
+		cols = 80
+	}
+	return rows, cols
+}
+
+func newTermLine(cols int) termLine {
+	cells := make([]termCell, cols)
+	for i := range cells {
+		cells[i].ch = ' '
+	}
+	return termLine{cells: cells}
+}
+
+func newTermLines(rows, cols int) []termLine {
+	lines := make([]termLine, rows)
+	for i := range lines {
+		lines[i] = newTermLine(cols)
+	}
+	return lines
+}
+
+// Reset the screen to its initial state, discarding the
+// scrollback
+func (s *termScreen) reset() {
+	s.lines = newTermLines(s.rows, s.cols)
+	s.altLines = nil
+	s.altScreen = false
+	s.scrollback.clear()
+	s.curRow, s.curCol = 0, 0
+	s.wrapPending = false
+	s.attr = cellAttr{}
+	s.savedRow, s.savedCol, s.savedAttr = 0, 0, cellAttr{}
+	s.scrollTop, s.scrollBottom = 0, s.rows-1
+	s.autoWrap = true
+	s.cursorHidden = false
+	s.state = stateGround
+	s.params = s.params[:0]
+	s.partialRune = nil
+	s.burstBytes = 0
+	s.burstTruncated = false
+	s.droppedTail = nil
+}
+
+func (s *termScreen) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+}
+
+// Clear everything except the line the cursor is on, which is
+// moved to the top of the screen
+func (s *termScreen) ClearKeepingCursorLine() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.lines[s.curRow]
+	s.scrollback.clear()
+	s.lines = newTermLines(s.rows, s.cols)
+	s.lines[0] = current
+	s.curRow = 0
+}
+
+func (s *termScreen) Resize(rows, cols int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, cols = sanitizeTermSize(rows, cols)
+	if rows == s.rows && cols == s.cols {
+		return
+	}
+	// Both buffers are resized, so that switching between them
+	// afterwards is safe. Only the main screen has a scrollback
+	// (scrollback lines are left as they are). While the alternate
+	// screen is shown, the main screen's cursor position is the
+	// saved one.
+	if s.altScreen {
+		s.lines = fitTermLines(s.lines, rows, cols, &s.curRow, nil)
+		s.altLines = fitTermLines(s.altLines, rows, cols, &s.savedRow, s.pushScrollback)
+	} else {
+		s.lines = fitTermLines(s.lines, rows, cols, &s.curRow, s.pushScrollback)
+	}
+	s.rows, s.cols = rows, cols
+	s.scrollTop, s.scrollBottom = 0, rows-1
+	s.curRow = clamp(s.curRow, 0, rows-1)
+	s.curCol = clamp(s.curCol, 0, cols-1)
+	s.savedRow = clamp(s.savedRow, 0, rows-1)
+	s.savedCol = clamp(s.savedCol, 0, cols-1)
+	s.wrapPending = false
+}
+
+// Fit the lines of a screen buffer to a new size. When the screen
+// gets shorter, lines at the top are dropped (and passed to
+// scrolledOut, if given), keeping the line at *cursorRow on
+// screen.
+func fitTermLines(lines []termLine, rows, cols int, cursorRow *int, scrolledOut func(termLine)) []termLine {
+	for i := range lines {
+		lines[i] = resizeTermLine(lines[i], cols)
+	}
+	for len(lines) > rows {
+		if *cursorRow > 0 {
+			if scrolledOut != nil {
+				scrolledOut(lines[0])
+			}
+			lines = lines[1:]
+			*cursorRow--
+		} else {
+			lines = lines[:len(lines)-1]
+		}
+	}
+	for len(lines) < rows {
+		lines = append(lines, newTermLine(cols))
+	}
+	return lines
+}
+
+func resizeTermLine(line termLine, cols int) termLine {
+	if len(line.cells) >= cols {
+		line.cells = line.cells[:cols]
+		return line
+	}
+	for len(line.cells) < cols {
+		line.cells = append(line.cells, termCell{ch: ' '})
+	}
+	return line
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+func (s *termScreen) Write(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.write(p)
+}
+
+func (s *termScreen) write(p []byte) {
+	// Once a burst of output gets too long, the rest of it is left
+	// out, and a marker is shown in its place
+	if s.burstTruncated {
+		s.keepDroppedTail(p)
+		return
+	}
+	s.burstBytes += len(p)
+	if s.maxBurstBytes > 0 && s.burstBytes > s.maxBurstBytes {
+		s.burstTruncated = true
+		s.partialRune = nil
+		s.state = stateGround
+		s.droppedTail = nil
+		s.keepDroppedTail(p)
+		p = []byte(burstTruncatedMarker)
+	}
+	if len(s.partialRune) > 0 {
+		p = append(s.partialRune, p...)
+		s.partialRune = nil
+	}
+	for len(p) > 0 {
+		r, size := utf8.DecodeRune(p)
+		if r == utf8.RuneError && size <= 1 && !utf8.FullRune(p) {
+			// Keep incomplete UTF-8 sequence for the next write
+			s.partialRune = append([]byte{}, p...)
+			return
+		}
+		p = p[size:]
+		s.processRune(r)
+	}
+}
+
+// Like roomOutput.keepDroppedTail, so that the prompt at the end of
+// a truncated burst still makes it onto the screen
+func (s *termScreen) keepDroppedTail(p []byte) {
+	if idx := bytes.LastIndexAny(p, "\r\n"); idx != -1 {
+		s.droppedTail = s.droppedTail[:0]
+		p = p[idx+1:]
+	}
+	if len(s.droppedTail)+len(p) > maxDroppedTail {
+		s.droppedTail = s.droppedTail[:0]
+		return
+	}
+	s.droppedTail = append(s.droppedTail, p...)
+}
+
+// Mark the end of a burst of output (e.g., when the REPL prompt
+// is shown again), so that output goes into the history again.
+// The last line left out of the burst (the prompt, usually) is
+// written to the screen.
+func (s *termScreen) EndBurst() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.burstBytes = 0
+	s.burstTruncated = false
+	if tail := s.droppedTail; len(tail) > 0 {
+		s.droppedTail = nil
+		s.write(tail)
+	}
+}
+
+// Approximate number of bytes used by the screen and its
+// scrollback, and the number of scrollback lines
+func (s *termScreen) MemoryUsage() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.scrollback.bytes
+	for _, line := range s.lines {
+		usage += lineBytes(line)
+	}
+	for _, line := range s.altLines {
+		usage += lineBytes(line)
+	}
+	return usage, s.scrollback.len()
+}
+
+func (s *termScreen) processRune(r rune) {
+	switch s.state {
+	case stateEscape:
+		s.processEscape(r)
+		return
+	case stateCharset:
+		// Character set designations are ignored
+		s.state = stateGround
+		return
+	case stateCSI:
+		if r >= 0x40 && r <= 0x7e {
+			s.processCSI(r)
+			s.state = stateGround
+		} else if r == 0x1b {
+			s.state = stateEscape
+		} else if r < 0x20 {
+			s.processControl(r)
+		} else if len(s.params) < maxCSIParamsLength {
+			s.params = append(s.params, byte(r))
+		}
+		return
+	case stateOSC:
+		// Operating system commands (window title etc.) are ignored
+		if r == 0x07 {
+			s.state = stateGround
+		} else if r == 0x1b {
+			s.state = stateOSCEscape
+		}
+		return
+	case stateOSCEscape:
+		s.state = stateGround
+		if r != '\\' {
+			s.processRune(r)
+		}
+		return
+	}
+
+	if r < 0x20 || r == 0x7f {
+		s.processControl(r)
+		return
+	}
+	s.print(r)
+}
+
+func (s *termScreen) processControl(r rune) {
+	switch r {
+	case '\b':
+		s.wrapPending = false
+		if s.curCol > 0 {
+			s.curCol--
+		}
+	case '\t':
+		s.wrapPending = false
+		s.curCol = clamp((s.curCol/8+1)*8, 0, s.cols-1)
+	case '\n', '\v', '\f':
+		s.wrapPending = false
+		s.index()
+	case '\r':
+		s.wrapPending = false
+		s.curCol = 0
+	case 0x1b:
+		s.state = stateEscape
+	}
+}
+
+func (s *termScreen) processEscape(r rune) {
+	s.state = stateGround
+	switch r {
+	case '[':
+		s.params = s.params[:0]
+		s.state = stateCSI
+	case ']':
+		s.state = stateOSC
+	case '(', ')', '*', '+':
+		s.state = stateCharset
+	case '7':
+		s.saveCursor()
+	case '8':
+		s.restoreCursor()
+	case 'D':
+		s.index()
+	case 'E':
+		s.curCol = 0
+		s.index()
+	case 'M':
+		s.reverseIndex()
+	case 'c':
+		s.reset()
+	}
+}
+
+func (s *termScreen) print(r rune) {
+	if s.wrapPending {
+		if s.autoWrap {
+			s.lines[s.curRow].wrapped = true
+			s.curCol = 0
+			s.index()
+		}
+		s.wrapPending = false
+	}
+	s.lines[s.curRow].cells[s.curCol] = termCell{ch: r, attr: s.attr}
+	s.lastPrintedRune = r
+	if s.curCol == s.cols-1 {
+		s.wrapPending = true
+	} else {
+		s.curCol++
+	}
+}
+
+// Move the cursor down one line, scrolling if it is at the bottom
+// of the scrolling region
+func (s *termScreen) index() {
+	if s.curRow == s.scrollBottom {
+		s.scrollUp(1)
+	} else if s.curRow < s.rows-1 {
+		s.curRow++
+	}
+}
+
+func (s *termScreen) reverseIndex() {
+	if s.curRow == s.scrollTop {
+		s.scrollDown(1)
+	} else if s.curRow > 0 {
+		s.curRow--
+	}
+}
+
+func (s *termScreen) pushScrollback(line termLine) {
+	s.scrollback.push(trimTermLine(line))
+}
+
+func (s *termScreen) scrollUp(n int) {
+	// Only lines leaving the top of the whole main screen go into
+	// the scrollback
+	s.scrollRegionUp(n, s.scrollTop == 0 && !s.altScreen)
+}
+
+func (s *termScreen) scrollRegionUp(n int, keepLines bool) {
+	n = clamp(n, 0, s.scrollBottom-s.scrollTop+1)
+	for i := 0; i < n; i++ {
+		if keepLines {
+			s.pushScrollback(s.lines[s.scrollTop])
+		}
+		copy(s.lines[s.scrollTop:s.scrollBottom], s.lines[s.scrollTop+1:s.scrollBottom+1])
+		s.lines[s.scrollBottom] = newTermLine(s.cols)
+	}
+}
+
+func (s *termScreen) scrollDown(n int) {
+	n = clamp(n, 0, s.scrollBottom-s.scrollTop+1)
+	for i := 0; i < n; i++ {
+		copy(s.lines[s.scrollTop+1:s.scrollBottom+1], s.lines[s.scrollTop:s.scrollBottom])
+		s.lines[s.scrollTop] = newTermLine(s.cols)
+	}
+}
+
+func (s *termScreen) saveCursor() {
+	s.savedRow, s.savedCol, s.savedAttr = s.curRow, s.curCol, s.attr
+}
+
+func (s *termScreen) restoreCursor() {
+	s.curRow, s.curCol, s.attr = s.savedRow, s.savedCol, s.savedAttr
+	s.wrapPending = false
+}
+
+// Parse CSI parameters. Missing parameters are returned as -1.
+func (s *termScreen) parseParams() (bool, []int) {
+	private := false
+	params := s.params
+	if len(params) > 0 && (params[0] == '?' || params[0] == '>' || params[0] == '=') {
+		private = true
+		params = params[1:]
+	}
+	var values []int
+	for _, part := range bytes.Split(params, []byte(";")) {
+		n, err := strconv.Atoi(string(bytes.TrimRight(part, " !\"#$%&'()*+,-./")))
+		if err != nil {
+			n = -1
+		}
+		values = append(values, n)
+	}
+	return private, values
+}
+
+func param(values []int, i, fallback int) int {
+	if i >= len(values) || values[i] <= 0 {
+		return fallback
+	}
+	return values[i]
+}
+
+func (s *termScreen) processCSI(final rune) {
+	private, values := s.parseParams()
+	n := param(values, 0, 1)
+	if final != 'm' && final != 'h' && final != 'l' {
+		s.wrapPending = false
+	}
+	switch final {
+	case 'A':
+		s.curRow = clamp(s.curRow-n, 0, s.rows-1)
+	case 'B', 'e':
+		s.curRow = clamp(s.curRow+n, 0, s.rows-1)
+	case 'C', 'a':
+		s.curCol = clamp(s.curCol+n, 0, s.cols-1)
+	case 'D':
+		s.curCol = clamp(s.curCol-n, 0, s.cols-1)
+	case 'E':
+		s.curRow = clamp(s.curRow+n, 0, s.rows-1)
+		s.curCol = 0
+	case 'F':
+		s.curRow = clamp(s.curRow-n, 0, s.rows-1)
+		s.curCol = 0
+	case 'G', '`':
+		s.curCol = clamp(n-1, 0, s.cols-1)
+	case 'd':
+		s.curRow = clamp(n-1, 0, s.rows-1)
+	case 'H', 'f':
+		s.curRow = clamp(param(values, 0, 1)-1, 0, s.rows-1)
+		s.curCol = clamp(param(values, 1, 1)-1, 0, s.cols-1)
+	case 'J':
+		s.eraseInDisplay(param(values, 0, 0))
+	case 'K':
+		s.eraseInLine(param(values, 0, 0))
+	case 'L':
+		if s.curRow >= s.scrollTop && s.curRow <= s.scrollBottom {
+			top := s.scrollTop
+			s.scrollTop = s.curRow
+			s.scrollDown(n)
+			s.scrollTop = top
+		}
+	case 'M':
+		if s.curRow >= s.scrollTop && s.curRow <= s.scrollBottom {
+			top := s.scrollTop
+			s.scrollTop = s.curRow
+			// Deleted lines don't go into the scrollback
+			s.scrollRegionUp(n, false)
+			s.scrollTop = top
+		}
+	case 'P':
+		cells := s.lines[s.curRow].cells
+		n = clamp(n, 0, s.cols-s.curCol)
+		copy(cells[s.curCol:], cells[s.curCol+n:])
+		s.blankCells(cells[s.cols-n:])
+	case '@':
+		cells := s.lines[s.curRow].cells
+		n = clamp(n, 0, s.cols-s.curCol)
+		copy(cells[s.curCol+n:], cells[s.curCol:s.cols-n])
+		s.blankCells(cells[s.curCol : s.curCol+n])
+	case 'X':
+		cells := s.lines[s.curRow].cells
+		s.blankCells(cells[s.curCol:clamp(s.curCol+n, 0, s.cols)])
+	case 'S':
+		s.scrollUp(n)
+	case 'T':
+		s.scrollDown(n)
+	case 'b':
+		for i := 0; i < n && s.lastPrintedRune != 0; i++ {
+			s.print(s.lastPrintedRune)
+		}
+	case 'm':
+		if !private {
+			s.setGraphicRendition(values)
+		}
+	case 'r':
+		if !private {
+			top := param(values, 0, 1) - 1
+			bottom := param(values, 1, s.rows) - 1
+			if top < bottom && bottom < s.rows {
+				s.scrollTop, s.scrollBottom = top, bottom
+				s.curRow, s.curCol = 0, 0
+			}
+		}
+	case 's':
+		s.saveCursor()
+	case 'u':
+		s.restoreCursor()
+	case 'h', 'l':
+		if private {
+			s.setPrivateMode(values, final == 'h')
+		}
+	}
+}
+
+func (s *termScreen) blankCells(cells []termCell) {
+	for i := range cells {
+		// Erased cells keep the current background color
+		cells[i] = termCell{ch: ' ', attr: cellAttr{bg: s.attr.bg}}
+	}
+}
+
+func (s *termScreen) eraseInDisplay(mode int) {
+	switch mode {
+	case 0:
+		s.eraseInLine(0)
+		for row := s.curRow + 1; row < s.rows; row++ {
+			s.blankCells(s.lines[row].cells)
+			s.lines[row].wrapped = false
+		}
+	case 1:
+		s.eraseInLine(1)
+		for row := 0; row < s.curRow; row++ {
+			s.blankCells(s.lines[row].cells)
+			s.lines[row].wrapped = false
+		}
+	case 2:
+		for row := 0; row < s.rows; row++ {
+			s.blankCells(s.lines[row].cells)
+			s.lines[row].wrapped = false
+		}
+	case 3:
+		s.scrollback.clear()
+	}
+}
+
+func (s *termScreen) eraseInLine(mode int) {
+	cells := s.lines[s.curRow].cells
+	switch mode {
+	case 0:
+		s.blankCells(cells[s.curCol:])
+		s.lines[s.curRow].wrapped = false
+	case 1:
+		s.blankCells(cells[:s.curCol+1])
+	case 2:
+		s.blankCells(cells)
+		s.lines[s.curRow].wrapped = false
+	}
+}
+
+func (s *termScreen) setPrivateMode(values []int, set bool) {
+	for _, mode := range values {
+		switch mode {
+		case 7:
+			s.autoWrap = set
+		case 25:
+			s.cursorHidden = !set
+		case 47, 1047, 1049:
+			if set && !s.altScreen {
+				if mode == 1049 {
+					s.saveCursor()
+				}
+				s.altLines = s.lines
+				s.lines = newTermLines(s.rows, s.cols)
+				s.altScreen = true
+			} else if !set && s.altScreen {
+				s.lines = s.altLines
+				s.altLines = nil
+				s.altScreen = false
+				if mode == 1049 {
+					s.restoreCursor()
+				}
+			}
+		}
+	}
+}
+
+func (s *termScreen) setGraphicRendition(values []int) {
+	for i := 0; i < len(values); i++ {
+		v := values[i]
+		switch {
+		case v <= 0:
+			s.attr = cellAttr{}
+		case v == 1:
+			s.attr.flags |= attrBold
+		case v == 2:
+			s.attr.flags |= attrDim
+		case v == 3:
+			s.attr.flags |= attrItalic
+		case v == 4:
+			s.attr.flags |= attrUnderline
+		case v == 5:
+			s.attr.flags |= attrBlink
+		case v == 7:
+			s.attr.flags |= attrInverse
+		case v == 8:
+			s.attr.flags |= attrHidden
+		case v == 9:
+			s.attr.flags |= attrStrike
+		case v == 22:
+			s.attr.flags &^= attrBold | attrDim
+		case v == 23:
+			s.attr.flags &^= attrItalic
+		case v == 24:
+			s.attr.flags &^= attrUnderline
+		case v == 25:
+			s.attr.flags &^= attrBlink
+		case v == 27:
+			s.attr.flags &^= attrInverse
+		case v == 28:
+			s.attr.flags &^= attrHidden
+		case v == 29:
+			s.attr.flags &^= attrStrike
+		case v >= 30 && v <= 37:
+			s.attr.fg = uint32(v-30) + 1
+		case v == 38 || v == 48:
+			color, consumed := parseExtendedColor(values[i+1:])
+			i += consumed
+			if v == 38 {
+				s.attr.fg = color
+			} else {
+				s.attr.bg = color
+			}
+		case v == 39:
+			s.attr.fg = 0
+		case v >= 40 && v <= 47:
+			s.attr.bg = uint32(v-40) + 1
+		case v == 49:
+			s.attr.bg = 0
+		case v >= 90 && v <= 97:
+			s.attr.fg = uint32(v-90+8) + 1
+		case v >= 100 && v <= 107:
+			s.attr.bg = uint32(v-100+8) + 1
+		}
+	}
+}
+
+// Parse the arguments of an extended (256 or true) color SGR
+// parameter. Returns the color and the number of values used.
+func parseExtendedColor(values []int) (uint32, int) {
+	if len(values) >= 2 && values[0] == 5 {
+		return uint32(clamp(values[1], 0, 255)) + 1, 2
+	}
+	if len(values) >= 4 && values[0] == 2 {
+		r := uint32(clamp(values[1], 0, 255))
+		g := uint32(clamp(values[2], 0, 255))
+		b := uint32(clamp(values[3], 0, 255))
+		return colorRGB | r<<16 | g<<8 | b, 4
+	}
+	return 0, len(values)
+}
+
+// SGR sequence that switches from default rendition to attr
+func sgrSequence(attr cellAttr) []byte {
+	params := []string{"0"}
+	flagCodes := []struct {
+		flag uint8
+		code string
+	}{
+		{attrBold, "1"}, {attrDim, "2"}, {attrItalic, "3"}, {attrUnderline, "4"},
+		{attrBlink, "5"}, {attrInverse, "7"}, {attrHidden, "8"}, {attrStrike, "9"},
+	}
+	for _, fc := range flagCodes {
+		if attr.flags&fc.flag != 0 {
+			params = append(params, fc.code)
+		}
+	}
+	params = append(params, colorParams(attr.fg, "38")...)
+	params = append(params, colorParams(attr.bg, "48")...)
+	var b bytes.Buffer
+	b.WriteString("\x1b[")
+	for i, p := range params {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(p)
+	}
+	b.WriteByte('m')
+	return b.Bytes()
+}
+
+func colorParams(color uint32, prefix string) []string {
+	switch {
+	case color == 0:
+		return nil
+	case color&colorRGB != 0:
+		return []string{prefix, "2",
+			strconv.Itoa(int(color >> 16 & 0xff)),
+			strconv.Itoa(int(color >> 8 & 0xff)),
+			strconv.Itoa(int(color & 0xff))}
+	default:
+		return []string{prefix, "5", strconv.Itoa(int(color - 1))}
+	}
+}
+
+// Build a compact byte sequence that reproduces the scrollback and
+// current screen (text, colors and cursor position) when written
+// to a freshly reset terminal
+func (s *termScreen) Snapshot() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Skip blank lines at the bottom of the screen, but not the
+	// line the cursor is on
+	lastRow := s.curRow
+	for row := s.rows - 1; row > lastRow; row-- {
+		if !isBlankLine(s.lines[row]) {
+			lastRow = row
+			break
+		}
+	}
+	lines := make([]termLine, 0, s.scrollback.len()+lastRow+1)
+	s.scrollback.each(func(line termLine) {
+		lines = append(lines, line)
+	})
+	lines = append(lines, s.lines[:lastRow+1]...)
+
+	var b bytes.Buffer
+	current := cellAttr{}
+	for i, line := range lines {
+		cells := line.cells
+		// Trailing blanks don't need to be written, unless the line
+		// is wrapped, since the terminal would then not wrap it
+		if !line.wrapped {
+			end := len(cells)
+			for end > 0 && cells[end-1] == (termCell{ch: ' '}) {
+				end--
+			}
+			cells = cells[:end]
+		}
+		for _, cell := range cells {
+			if cell.attr != current {
+				b.Write(sgrSequence(cell.attr))
+				current = cell.attr
+			}
+			b.WriteRune(cell.ch)
+		}
+		if i < len(lines)-1 && !line.wrapped {
+			if current.bg != 0 {
+				// Keep background from bleeding into the next line
+				b.WriteString("\x1b[0m")
+				current = cellAttr{}
+			}
+			b.WriteString("\r\n")
+		}
+	}
+
+	// Move the cursor back to where it should be
+	if up := lastRow - s.curRow; up > 0 {
+		b.WriteString("\x1b[" + strconv.Itoa(up) + "A")
+	}
+	b.WriteString("\x1b[" + strconv.Itoa(s.curCol+1) + "G")
+	if current != s.attr {
+		b.Write(sgrSequence(s.attr))
+	}
+	if s.cursorHidden {
+		b.WriteString("\x1b[?25l")
+	}
+	return b.Bytes()
+}
+
+func isBlankLine(line termLine) bool {
+	for _, cell := range line.cells {
+		if cell != (termCell{ch: ' '}) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var testHistLimits = termHistLimits{maxLines: 100, maxBytes: 100000}
+
+// Text of a screen row, without trailing blanks
+func screenRow(s *termScreen, row int) string {
+	var b strings.Builder
+	for _, cell := range s.lines[row].cells {
+		b.WriteRune(cell.ch)
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+func checkScreenShape(t *testing.T, s *termScreen) {
+	t.Helper()
+	buffers := [][]termLine{s.lines}
+	if s.altScreen {
+		buffers = append(buffers, s.altLines)
+	}
+	for _, lines := range buffers {
+		if len(lines) != s.rows {
+			t.Fatalf("buffer has %d rows, want %d", len(lines), s.rows)
+		}
+		for _, line := range lines {
+			if len(line.cells) != s.cols {
+				t.Fatalf("line has %d cells, want %d", len(line.cells), s.cols)
+			}
+		}
+	}
+}
+
+func TestResizeInAltScreen(t *testing.T) {
+	for _, size := range []struct{ rows, cols int }{{40, 80}, {10, 80}, {24, 120}, {5, 20}} {
+		s := newTermScreen(24, 80, testHistLimits)
+		s.Write([]byte("main screen\r\n"))
+		s.Write([]byte("\x1b[?1049h"))
+		s.Write([]byte("alt screen"))
+		s.Resize(size.rows, size.cols)
+		checkScreenShape(t, s)
+		s.Write([]byte("\x1b[?1049l"))
+		checkScreenShape(t, s)
+
+		// Fill the screen and then some, to make sure the whole of it
+		// can be written to
+		for i := 0; i < size.rows+5; i++ {
+			s.Write([]byte(strings.Repeat("x", size.cols+3) + "\r\n"))
+		}
+		s.Write([]byte("\x1b[2L\x1b[3M\x1b[5P\x1b[2@"))
+		checkScreenShape(t, s)
+	}
+}
+
+func TestResizeKeepsMainScreenCursorLine(t *testing.T) {
+	s := newTermScreen(24, 80, testHistLimits)
+	for i := 0; i < 20; i++ {
+		s.Write([]byte("line\r\n"))
+	}
+	s.Write([]byte("prompt> "))
+	s.Write([]byte("\x1b[?1049h"))
+	s.Resize(10, 80)
+	s.Write([]byte("\x1b[?1049l"))
+	if got := screenRow(s, s.curRow); got != "prompt>" {
+		t.Errorf("cursor line is %q, want %q", got, "prompt>")
+	}
+	if got := s.scrollback.len(); got != 14 {
+		t.Errorf("scrollback has %d lines, want 14", got)
+	}
+}
+
+func TestScreenWithRandomInput(t *testing.T) {
+	pieces := []string{
+		"abc", "é中", "\r\n", "\n", "\b", "\t", "\x1b[?1049h", "\x1b[?1049l",
+		"\x1b[?47h", "\x1b[?47l", "\x1b[5;10r", "\x1b[r", "\x1b[3L", "\x1b[3M",
+		"\x1b[4P", "\x1b[4@", "\x1b[6X", "\x1b[2S", "\x1b[2T", "\x1b[10;70H",
+		"\x1b[99B", "\x1b[99C", "\x1b7", "\x1b8", "\x1bM", "\x1b[J", "\x1b[1J",
+		"\x1b[2K", "\x1b[3b", "\x1b[?7l", "\x1b[?7h", "\x1b[31;48;5;100m",
+	}
+	rng := rand.New(rand.NewSource(1))
+	s := newTermScreen(24, 80, testHistLimits)
+	for i := 0; i < 20000; i++ {
+		if rng.Intn(20) == 0 {
+			s.Resize(rng.Intn(60), rng.Intn(200))
+		} else {
+			s.Write([]byte(pieces[rng.Intn(len(pieces))]))
+		}
+		if i%100 == 0 {
+			s.Snapshot()
+		}
+	}
+	checkScreenShape(t, s)
+}
+
+func TestEndBurstKeepsPromptOfTruncatedBurst(t *testing.T) {
+	s := newTermScreen(24, 80, termHistLimits{maxLines: 100, maxBytes: 100000, maxBurstBytes: 100})
+	for i := 0; i < 50; i++ {
+		s.Write([]byte("some output\r\n"))
+	}
+	s.Write([]byte("irb(main):002:0> "))
+	s.EndBurst()
+	if got := screenRow(s, s.curRow); got != "irb(main):002:0>" {
+		t.Errorf("cursor line is %q, want the prompt", got)
+	}
+	s.Write([]byte("more"))
+	if got := screenRow(s, s.curRow); got != "irb(main):002:0> more" {
+		t.Errorf("cursor line is %q, want output after the prompt", got)
+	}
+}
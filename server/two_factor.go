@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Two-factor authentication with time-based one-time passwords
+// (RFC 6238: HMAC-SHA1, 6 digits, 30 second steps), as used by the
+// usual authenticator apps. Users who turn it on get a set of
+// single use recovery codes for when they don't have their
+// authenticator at hand.
+//
+// Roles listed (comma-separated) in the REQUIRE_2FA_ROLES env
+// variable, e.g. "admin,instructor", must use 2FA. Users with those
+// roles who haven't set it up yet are signed in with a session that
+// is only good for setting it up.
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// Steps before and after the current one accepted, to allow for
+	// clock drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	// Time allowed between the password and the second step
+	twoFactorTimeout = 5 * time.Minute
+	// Wrong codes allowed in the second step before starting over
+	maxTwoFactorAttempts = 5
+)
+
+// User roles
+const (
+	roleUser       = "user"
+	roleInstructor = "instructor"
+	roleAdmin      = "admin"
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func isTwoFactorRequired(role string) bool {
+	for _, r := range strings.Split(os.Getenv("REQUIRE_2FA_ROLES"), ",") {
+		if strings.TrimSpace(r) == role {
+			return true
+		}
+	}
+	return false
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// Check a code against the (base32) secret. Returns the time step
+// the code is for, so that it can't be used again.
+func verifyTOTP(encodedSecret, code string, lastStep int64) (int64, bool) {
+	secret, err := base32NoPadding.DecodeString(strings.ToUpper(encodedSecret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpProvisioningURI(secret, email string) string {
+	issuer := emailBranding.productName
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(issuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// Replace the user's recovery codes with new ones, returned in
+// plain text (only their hashes are stored)
+func generateRecoveryCodes(userID int) ([]string, error) {
+	ctx := context.Background()
+	tx, err := getDBPool().Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(base32NoPadding.EncodeToString(b))[:10]
+		code := s[:5] + "-" + s[5:]
+		query := "INSERT INTO user_recovery_codes(user_id, code_hash, when_created) VALUES($1, $2, $3)"
+		if _, err := tx.Exec(ctx, query, userID, hashRecoveryCode(code), time.Now().Unix()); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Check a TOTP or recovery code for the user. Recovery codes are
+// used up.
+func verifySecondFactor(userID int, code string) bool {
+	ctx := context.Background()
+	code = strings.TrimSpace(code)
+	var secret string
+	var lastStep int64
+	query := "SELECT COALESCE(totp_secret, ''), totp_last_step FROM users WHERE id = $1 AND totp_enabled"
+	if err := getDBPool().QueryRow(ctx, query, userID).Scan(&secret, &lastStep); err != nil {
+		return false
+	}
+	if step, ok := verifyTOTP(secret, code, lastStep); ok {
+		// Only if nobody has used the step in the meantime
+		query = "UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1"
+		tag, err := getDBPool().Exec(ctx, query, step, userID)
+		return err == nil && tag.RowsAffected() == 1
+	}
+	query = "UPDATE user_recovery_codes SET when_used = $1 WHERE user_id = $2 AND code_hash = $3 AND when_used IS NULL"
+	tag, err := getDBPool().Exec(ctx, query, time.Now().Unix(), userID, hashRecoveryCode(code))
+	return err == nil && tag.RowsAffected() == 1
+}
+
+func setSessionUser(session *sessions.Session, userID int, username, email, role string) {
+	session.Values["auth"] = true
+	session.Values["email"] = email
+	session.Values["username"] = username
+	session.Values["userID"] = userID
+	session.Values["role"] = role
+	session.Values["signInTime"] = time.Now().Unix()
+	session.Values["2faVerified"] = false
+	delete(session.Values, "pending2faUserID")
+	delete(session.Values, "pending2faTime")
+	delete(session.Values, "pending2faAttempts")
+}
+
+// Sign the user in on the session once the password (or the
+// sign-in provider) has been checked. If the user has 2FA turned
+// on, the session is left waiting for the second step instead, and
+// true is returned. Either way the session gets a new token.
+func beginUserSession(session *sessions.Session, userID int, username, email string) (bool, error) {
+	var role string
+	var totpEnabled bool
+	query := "SELECT role, totp_enabled FROM users WHERE id = $1"
+	if err := getDBPool().QueryRow(context.Background(), query, userID).Scan(&role, &totpEnabled); err != nil {
+		return false, err
+	}
+	if err := renewSessionID(session); err != nil {
+		return false, err
+	}
+	if totpEnabled {
+		session.Values["auth"] = false
+		delete(session.Values, "userID")
+		session.Values["pending2faUserID"] = userID
+		session.Values["pending2faTime"] = time.Now().Unix()
+		session.Values["pending2faAttempts"] = 0
+		return true, nil
+	}
+	setSessionUser(session, userID, username, email, role)
+	if isTwoFactorRequired(role) {
+		session.Values["2faSetupRequired"] = true
+	} else {
+		delete(session.Values, "2faSetupRequired")
+	}
+	return false, nil
+}
+
+// Whether the session is signed in and not restricted to setting
+// up 2FA
+func isFullySignedIn(session *sessions.Session) bool {
+	auth, _ := session.Values["auth"].(bool)
+	setupRequired, _ := session.Values["2faSetupRequired"].(bool)
+	return auth && !setupRequired
+}
+
+func readCodeParam(r *http.Request) (string, error) {
+	type paramsModel struct {
+		Code string `json:"code"`
+	}
+	var pm paramsModel
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(body, &pm); err != nil {
+		return "", err
+	}
+	return pm.Code, nil
+}
+
+// Second step of signing in, with a TOTP or recovery code
+func signInTwoFactor(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, err := getSessStore().Get(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	userID, ok := session.Values["pending2faUserID"].(int)
+	started, _ := session.Values["pending2faTime"].(int64)
+	attempts, _ := session.Values["pending2faAttempts"].(int)
+	if !ok || time.Since(time.Unix(started, 0)) > twoFactorTimeout || attempts >= maxTwoFactorAttempts {
+		delete(session.Values, "pending2faUserID")
+		session.Save(r, w)
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Sign-in expired. Please sign in again.", "restart": "true"})
+		return
+	}
+	code, err := readCodeParam(r)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Error processing sign-in request"})
+		return
+	}
+
+	if !verifySecondFactor(userID, code) {
+		session.Values["pending2faAttempts"] = attempts + 1
+		session.Save(r, w)
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Code incorrect"})
+		return
+	}
+
+	var username, email, role string
+	query := "SELECT username, email, role FROM users WHERE id = $1"
+	if err := getDBPool().QueryRow(context.Background(), query, userID).Scan(&username, &email, &role); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Error processing sign-in request"})
+		return
+	}
+	if err := renewSessionID(session); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Error processing sign-in request"})
+		return
+	}
+	setSessionUser(session, userID, username, email, role)
+	session.Values["2faVerified"] = true
+	delete(session.Values, "2faSetupRequired")
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordSignIn(r, userID, "2fa")
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+// Session and user ID of a signed-in user. Sessions that still
+// have to set up 2FA are turned away.
+func getSignedInUser(w http.ResponseWriter, r *http.Request) (*sessions.Session, int, bool) {
+	return getSessionUser(w, r, false)
+}
+
+// Same as getSignedInUser, but also lets through sessions that are
+// only good for setting up 2FA. For the 2FA setup handlers.
+func getTwoFactorSetupUser(w http.ResponseWriter, r *http.Request) (*sessions.Session, int, bool) {
+	return getSessionUser(w, r, true)
+}
+
+func getSessionUser(w http.ResponseWriter, r *http.Request, allowSetupOnly bool) (*sessions.Session, int, bool) {
+	session, err := getSessStore().Get(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, -1, false
+	}
+	auth, _ := session.Values["auth"].(bool)
+	userID, ok := session.Values["userID"].(int)
+	if !auth || !ok {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Not signed in"})
+		return nil, -1, false
+	}
+	if !allowSetupOnly && !isFullySignedIn(session) {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Set up two-factor authentication first"})
+		return nil, -1, false
+	}
+	return session, userID, true
+}
+
+// Whether the user has 2FA turned on, and whether their role
+// requires it
+func getTwoFactorStatus(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	_, userID, ok := getTwoFactorSetupUser(w, r)
+	if !ok {
+		return
+	}
+	var enabled bool
+	var role string
+	var codesLeft int
+	query := "SELECT totp_enabled, role, (SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = users.id AND when_used IS NULL) FROM users WHERE id = $1"
+	if err := getDBPool().QueryRow(context.Background(), query, userID).Scan(&enabled, &role, &codesLeft); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	sendJsonResponse(w, map[string]interface{}{
+		"status":            "success",
+		"enabled":           enabled,
+		"required":          isTwoFactorRequired(role),
+		"recoveryCodesLeft": codesLeft,
+	})
+}
+
+// Start setting up 2FA: a new secret, kept in the session until
+// the user confirms it with a code from their authenticator. The
+// provisioning URI is what goes in the QR code.
+func setupTwoFactor(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getTwoFactorSetupUser(w, r)
+	if !ok {
+		return
+	}
+	var email string
+	var enabled bool
+	query := "SELECT email, totp_enabled FROM users WHERE id = $1"
+	if err := getDBPool().QueryRow(context.Background(), query, userID).Scan(&email, &enabled); err != nil || enabled {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	secret := base32NoPadding.EncodeToString(b)
+	session.Values["pendingTotpSecret"] = secret
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendJsonResponse(w, map[string]string{
+		"status":          "success",
+		"secret":          secret,
+		"provisioningURI": totpProvisioningURI(secret, email),
+	})
+}
+
+// Turn 2FA on, once the user has shown that their authenticator
+// works. Responds with the recovery codes.
+func enableTwoFactor(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getTwoFactorSetupUser(w, r)
+	if !ok {
+		return
+	}
+	secret, ok := session.Values["pendingTotpSecret"].(string)
+	if !ok {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Set up not started"})
+		return
+	}
+	code, err := readCodeParam(r)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	step, ok := verifyTOTP(secret, strings.TrimSpace(code), 0)
+	if !ok {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Code incorrect"})
+		return
+	}
+
+	query := "UPDATE users SET totp_secret = $1, totp_enabled = true, totp_last_step = $2 WHERE id = $3"
+	if _, err := getDBPool().Exec(context.Background(), query, secret, step, userID); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	codes, err := generateRecoveryCodes(userID)
+	if err != nil {
+		logger.Println("Unable to create recovery codes: ", err)
+	}
+	delete(session.Values, "pendingTotpSecret")
+	delete(session.Values, "2faSetupRequired")
+	session.Values["2faVerified"] = true
+	if err := renewSessionID(session); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendJsonResponse(w, map[string]interface{}{"status": "success", "recoveryCodes": codes})
+}
+
+// Turn 2FA off (not allowed for roles that require it). Needs a
+// current code.
+func disableTwoFactor(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getSignedInUser(w, r)
+	if !ok || !isFullySignedIn(session) {
+		if ok {
+			sendJsonResponse(w, map[string]string{"status": "failure"})
+		}
+		return
+	}
+	code, err := readCodeParam(r)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	var role string
+	if err := getDBPool().QueryRow(context.Background(), "SELECT role FROM users WHERE id = $1", userID).Scan(&role); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if isTwoFactorRequired(role) {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Two-factor authentication is required for your account"})
+		return
+	}
+	if !verifySecondFactor(userID, code) {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Code incorrect"})
+		return
+	}
+
+	query := "UPDATE users SET totp_secret = NULL, totp_enabled = false, totp_last_step = 0 WHERE id = $1"
+	if _, err := getDBPool().Exec(context.Background(), query, userID); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if _, err := getDBPool().Exec(context.Background(), "DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		logger.Println("Unable to delete recovery codes: ", err)
+	}
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+// New set of recovery codes (the old ones stop working). Needs a
+// current code.
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	session, userID, ok := getSignedInUser(w, r)
+	if !ok || !isFullySignedIn(session) {
+		if ok {
+			sendJsonResponse(w, map[string]string{"status": "failure"})
+		}
+		return
+	}
+	code, err := readCodeParam(r)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if !verifySecondFactor(userID, code) {
+		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Code incorrect"})
+		return
+	}
+	codes, err := generateRecoveryCodes(userID)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	sendJsonResponse(w, map[string]interface{}{"status": "success", "recoveryCodes": codes})
+}
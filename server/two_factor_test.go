@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// SHA1 test vectors from RFC 6238, appendix B. The RFC gives 8
+// digit codes; ours are the last 6 digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if got := totpCode(secret, test.time/totpPeriod); got != test.want {
+			t.Errorf("code at %d is %s, want %s", test.time, got, test.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	encoded := base32NoPadding.EncodeToString(secret)
+	// Don't start right before a step ends
+	if time.Now().Unix()%totpPeriod == totpPeriod-1 {
+		time.Sleep(time.Second)
+	}
+	now := time.Now().Unix() / totpPeriod
+
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		got, ok := verifyTOTP(encoded, totpCode(secret, step), 0)
+		if !ok || got != step {
+			t.Errorf("code for step %d: got %d, %v", step-now, got, ok)
+		}
+	}
+	// Lowercase secrets are accepted too
+	if _, ok := verifyTOTP(strings.ToLower(encoded), totpCode(secret, now), 0); !ok {
+		t.Error("code rejected with lowercase secret")
+	}
+	for _, step := range []int64{now - totpSkew - 1, now + totpSkew + 1} {
+		if _, ok := verifyTOTP(encoded, totpCode(secret, step), 0); ok {
+			t.Errorf("code for step %d accepted", step-now)
+		}
+	}
+	// A step that has been used can't be used again
+	if _, ok := verifyTOTP(encoded, totpCode(secret, now), now); ok {
+		t.Error("code for used step accepted")
+	}
+	for _, code := range []string{"", "12345", "1234567"} {
+		if _, ok := verifyTOTP(encoded, code, 0); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+}
@@ -6,23 +6,28 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/crypto/bcrypt"
 	"io"
-	"math/rand"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"time"
 )
 
+// Hash the password is compared with when there is no account (or
+// no password) to check it against
+var dummyPWHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
 func signOut(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	// Delete cookie by sending an immediately expiring cookie with
-	// the same name
-	cookie := &http.Cookie{
-		Name:   "session",
-		Value:  "",
-		Path:   "/api",
-		MaxAge: -1,
+	session, err := getSessStore().Get(r, "session")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Deletes the stored session as well as the cookie
+	session.Options.MaxAge = -1
+	if err = session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	http.SetCookie(w, cookie)
 
 	sendJsonResponse(w, map[string]string{"status": "success"})
 }
@@ -60,28 +65,85 @@ func signIn(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		// Error will throw if no records found
 		emailFound = false
 	}
-
-	if emailFound && bcrypt.CompareHashAndPassword([]byte(encryptedPW), []byte(pepperedPW)) == nil {
+	// A locked account gets the same answer as a wrong password (its
+	// owner has been emailed about the lockout), so that the answer
+	// doesn't tell which emails have accounts. The password is
+	// compared with a dummy hash when there is none to check, to
+	// keep the timing the same as well.
+	locked := emailFound && getAccountLockout(userID) > 0
+	hash := dummyPWHash
+	// Accounts created through a sign-in provider have no password
+	if emailFound && !locked && encryptedPW != "" {
+		hash = []byte(encryptedPW)
+	}
+	pwMatches := bcrypt.CompareHashAndPassword(hash, []byte(pepperedPW)) == nil
+
+	twoFactorPending := false
+	if emailFound && !locked && encryptedPW != "" && pwMatches {
 		// successful sign in
 		signedIn = true
-		session.Values["auth"] = true
-		session.Values["email"] = cm.Email
-		session.Values["username"] = username
-		session.Values["userID"] = userID
+		clearFailedSignIns(userID)
+		if twoFactorPending, err = beginUserSession(session, userID, username, cm.Email); err != nil {
+			sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Error processing sign-in request"})
+			return
+		}
 		if err = session.Save(r, w); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
 
-	if signedIn {
+	if signedIn && twoFactorPending {
+		sendJsonResponse(w, map[string]string{"status": "2fa-required"})
+	} else if signedIn {
+		recordSignIn(r, userID, "password")
 		sendJsonResponse(w, map[string]string{"status": "success"})
 	} else {
-		time.Sleep(2 * time.Second)
+		if emailFound && !locked {
+			recordFailedSignIn(r, userID, username, cm.Email)
+		}
 		sendJsonResponse(w, map[string]string{"status": "failure", "reason": "Username and/or password incorrect"})
 	}
 }
 
+// Address of the client, as passed on by the proxy in front of the
+// server
+func getClientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Add a sign-in to the user's sign-in history
+func recordSignIn(r *http.Request, userID int, method string) {
+	query := "INSERT INTO sign_ins(user_id, method, user_agent, ip_address, when_created) VALUES($1, $2, $3, $4, $5)"
+	if _, err := getDBPool().Exec(context.Background(), query, userID, method, truncateUserAgent(r.UserAgent()), getClientIP(r), time.Now().Unix()); err != nil {
+		logger.Println("Unable to record sign-in: ", err)
+	}
+}
+
+// Get userID from session. If user isn't signed in (or still has
+// to set up 2FA) userID will be -1
+func getSessionUserID(r *http.Request) (int, error) {
+	session, err := getSessStore().Get(r, "session")
+	if err != nil {
+		return -1, err
+	}
+	if setupRequired, _ := session.Values["2faSetupRequired"].(bool); setupRequired {
+		return -1, nil
+	}
+	userID, ok := session.Values["userID"].(int)
+	if !ok {
+		return -1, nil
+	}
+	return userID, nil
+}
+
 func getUserInfo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	session, err := getSessStore().Get(r, "session")
 	if err != nil {
@@ -93,6 +155,9 @@ func getUserInfo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		Auth     bool   `json:"auth"`
 		Username string `json:"username"`
 		Email    string `json:"email"`
+		// Set when the user's role requires 2FA and they haven't
+		// set it up yet
+		TwoFactorSetupRequired bool `json:"twoFactorSetupRequired"`
 	}
 
 	if auth, ok := session.Values["auth"].(bool); !ok || !auth {
@@ -120,10 +185,12 @@ func getUserInfo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		return
 	}
 
+	setupRequired, _ := session.Values["2faSetupRequired"].(bool)
 	response := &responseModel{
-		Auth:     true,
-		Email:    email,
-		Username: username,
+		Auth:                   true,
+		Email:                  email,
+		Username:               username,
+		TwoFactorSetupRequired: setupRequired,
 	}
 
 	sendJsonResponse(w, response)
@@ -155,7 +222,8 @@ func forgotPassword(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 	}
 
 	if !emailFound {
-		sendJsonResponse(w, map[string]string{"status": "failure"})
+		// Same as for known emails, as far as the form is concerned
+		sendJsonResponse(w, map[string]interface{}{"status": "failure", "magicLink": verificationSettings.magicLinks})
 		return
 	}
 
@@ -164,9 +232,18 @@ func forgotPassword(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 
 	// Enter code and expiry into password reset requests
 	expiry := time.Now().Add(resetTimeout * time.Minute).Unix()
-	code := generateRandomCode()
+	code, err := generateVerificationCode()
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	link, err := buildMagicLink(magicLinkReset, cm.Email, code, expiry)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
 	query = "INSERT INTO password_reset_requests(user_id, reset_code, expiry, code_attempts) VALUES($1, $2, $3, $4)"
-	if _, err := getDBPool().Exec(context.Background(), query, userID, code, expiry, 0); err != nil {
+	if _, err := getDBPool().Exec(context.Background(), query, userID, hashVerificationCode(code), expiry, 0); err != nil {
 		sendJsonResponse(w, map[string]string{"status": "failure"})
 		return
 	}
@@ -182,18 +259,12 @@ func forgotPassword(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 		}
 	}()
 
-	if err := sendPasswordResetEmail(cm.Email, code); err != nil {
-		logger.Println("Error in sending password reset email:", err)
+	if err := sendPasswordResetEmail(cm.Email, code, link, emailLocale(r)); err != nil {
+		logger.Println("Error in queuing password reset email:", err)
 		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
 	}
-	sendJsonResponse(w, map[string]string{"status": "success"})
-}
-
-func generateRandomCode() string {
-	max := 999999
-	min := 100000
-	rand.Seed(time.Now().UnixNano())
-	return strconv.Itoa(rand.Intn(max-min) + min)
+	sendJsonResponse(w, map[string]interface{}{"status": "success", "magicLink": link != ""})
 }
 
 func updateResetCodeAttempts(email string) {
@@ -215,6 +286,8 @@ func resetPassword(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 		Email          string `json:"email"`
 		Code           string `json:"code"`
 		NewPlaintextPW string `json:"newPlaintextPW"`
+		// From a magic link, in place of the email and code
+		Token string `json:"token"`
 	}
 	var cm contentModel
 	body, err := io.ReadAll(r.Body)
@@ -228,19 +301,27 @@ func resetPassword(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 		return
 	}
 
+	if cm.Token != "" {
+		claims, err := verifyMagicLinkToken(cm.Token, magicLinkReset)
+		if err != nil {
+			sendJsonResponse(w, map[string]string{"status": "failure", "message": "Reset link expired"})
+			return
+		}
+		cm.Email = claims.Email
+		cm.Code = claims.Code
+	}
+
 	query := "SELECT p.user_id, p.expiry, p.code_attempts, p.reset_code FROM password_reset_requests AS p INNER JOIN users AS u ON p.user_id = u.id WHERE u.email = $1"
 	var resetCode string
 	var userID, codeAttempts int
 	var expiry int64
-	if err := getDBPool().QueryRow(context.Background(), query, cm.Email).Scan(&userID, &expiry, &codeAttempts, &resetCode); err != nil {
-		time.Sleep(2 * time.Second)
+	if err := getDBPool().QueryRow(context.Background(), query, cm.Email).Scan(&userID, &expiry, &codeAttempts, &resetCode); err != nil || time.Now().Unix() > expiry {
 		sendJsonResponse(w, map[string]string{"status": "failure", "message": "Reset code expired"})
 		return
 	}
 
-	if cm.Code != resetCode {
+	if !checkVerificationCode(cm.Code, resetCode) {
 		updateResetCodeAttempts(cm.Email)
-		time.Sleep(2 * time.Second)
 		if codeAttempts > 2 {
 			deleteRequestRec(userID)
 			sendJsonResponse(w, map[string]string{"status": "failure", "message": "Reset attempts exceeded"})
@@ -266,6 +347,12 @@ func resetPassword(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 		return
 	}
 	deleteRequestRec(userID)
+	// The owner can sign in again straight away
+	clearFailedSignIns(userID)
+	// Whoever may have had the old password is signed out
+	if err := revokeUserSessions(userID, ""); err != nil {
+		logger.Println("Unable to revoke sessions after password reset: ", err)
+	}
 	sendJsonResponse(w, map[string]string{"status": "success"})
 }
 
@@ -286,7 +373,6 @@ func deleteActivationRec(email string) error {
 }
 
 func activateUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	session, err := getSessStore().Get(r, "session")
 	type contentModel struct {
 		Code  string `json:"code"`
 		Email string `json:"email"`
@@ -322,58 +408,89 @@ func activateUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		return
 	}
 
+	if err := activatePendingAccount(w, r, cm.Email, cm.Code); err != nil {
+		if err.fatal {
+			fatalFailureRes.Message = err.message
+			sendJsonResponse(w, fatalFailureRes)
+		} else {
+			nonFatalFailureRes.Message = err.message
+			sendJsonResponse(w, nonFatalFailureRes)
+		}
+		return
+	}
+	sendJsonResponse(w, successRes)
+}
+
+// Activation from the link in the verification email (when magic
+// links are on). The user ends up signed in on the home page, or
+// on the sign-in form with the reason it didn't work.
+func activateUserByLink(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims, err := verifyMagicLinkToken(r.URL.Query().Get("token"), magicLinkActivate)
+	if err != nil {
+		redirectAuthError(w, r, err.Error())
+		return
+	}
+	if err := activatePendingAccount(w, r, claims.Email, claims.Code); err != nil {
+		redirectAuthError(w, r, err.message)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// Reason an account couldn't be activated. Fatal errors mean the
+// user has to sign up again.
+type activationError struct {
+	message string
+	fatal   bool
+}
+
+// Check the activation code, create the account and sign the user
+// in
+func activatePendingAccount(w http.ResponseWriter, r *http.Request, email, code string) *activationError {
+	session, err := getSessStore().Get(r, "session")
+	if err != nil {
+		return &activationError{"Something went wrong — please try again", false}
+	}
+
 	query := "SELECT username, encrypted_pw, expiry, code_attempts, activation_code FROM pending_activations WHERE email = $1"
 	var codeAttempts int
 	var username, encryptedPW, activationCode string
 	var expiry int64
-	if err = getDBPool().QueryRow(context.Background(), query, cm.Email).Scan(&username, &encryptedPW, &expiry, &codeAttempts, &activationCode); err != nil {
+	if err = getDBPool().QueryRow(context.Background(), query, email).Scan(&username, &encryptedPW, &expiry, &codeAttempts, &activationCode); err != nil || time.Now().Unix() > expiry {
 		// Will throw error if no record found (i.e., activation
 		// request expired and deleted)
-		fatalFailureRes.Message = "Your activation code has expired."
-		sendJsonResponse(w, fatalFailureRes)
-		return
+		return &activationError{"Your activation code has expired.", true}
 	}
-	if cm.Code != activationCode {
-		updateActivationCodeAttempts(cm.Email)
+	if !checkVerificationCode(code, activationCode) {
+		updateActivationCodeAttempts(email)
 		if codeAttempts > 2 {
-			fatalFailureRes.Message = "Activation attempts exceeded."
-			deleteActivationRec(cm.Email)
-			sendJsonResponse(w, fatalFailureRes)
-			return
+			deleteActivationRec(email)
+			return &activationError{"Activation attempts exceeded.", true}
 		}
-		nonFatalFailureRes.Message = "Activation code incorrect"
-		// Pause briefly after wrong code entered to impede attacks
-		time.Sleep(2 * time.Second)
-		sendJsonResponse(w, nonFatalFailureRes)
-		return
+		return &activationError{"Activation code incorrect", false}
 	}
 
 	userID := -1
-	deleteActivationRec(cm.Email)
+	deleteActivationRec(email)
 	query = "INSERT INTO users(username, email, encrypted_pw) VALUES($1, $2, $3) RETURNING id;"
-	if err := getDBPool().QueryRow(context.Background(), query, username, cm.Email, encryptedPW).Scan(&userID); err != nil {
-		fatalFailureRes.Message = "There was a problem creating your account."
-		sendJsonResponse(w, fatalFailureRes)
-		return
+	if err := getDBPool().QueryRow(context.Background(), query, username, email, encryptedPW).Scan(&userID); err != nil {
+		return &activationError{"There was a problem creating your account.", true}
 	}
 
 	if userID == -1 {
-		fatalFailureRes.Message = "There was a problem creating your account."
-		sendJsonResponse(w, fatalFailureRes)
-		return
+		return &activationError{"There was a problem creating your account.", true}
 	}
 
-	session.Values["auth"] = true
-	session.Values["email"] = cm.Email
-	session.Values["username"] = username
-	session.Values["userID"] = userID
+	// New accounts have the default role and no 2FA yet
+	if _, err = beginUserSession(session, userID, username, email); err != nil {
+		return &activationError{"Your account was created but we were unable to sign you in. Please return to the sign-in form to sign in.", true}
+	}
 	if err = session.Save(r, w); err != nil {
-		fatalFailureRes.Message = "Your account was created but we were unable to sign you in. Please return to the sign-in form to sign in."
-		sendJsonResponse(w, fatalFailureRes)
-		return
+		return &activationError{"Your account was created but we were unable to sign you in. Please return to the sign-in form to sign in.", true}
 	}
 
-	sendJsonResponse(w, successRes)
+	recordSignIn(r, userID, "activation")
+	return nil
 }
 
 func signUp(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -402,7 +519,16 @@ func signUp(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	}
 
 	expiry := time.Now().Add(activationTimeout).Unix()
-	code := generateRandomCode()
+	code, err := generateVerificationCode()
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	link, err := buildMagicLink(magicLinkActivate, cm.Email, code, expiry)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
 
 	// Check whether user has already registered
 	var emailUsed bool
@@ -422,7 +548,7 @@ func signUp(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	if !emailUsed {
 		query = "INSERT INTO pending_activations(username, email, encrypted_pw, activation_code, expiry, code_resends, code_attempts) VALUES($1, $2, $3, $4, $5, $6, $7)"
-		if _, err := getDBPool().Exec(context.Background(), query, cm.Username, cm.Email, encryptedPW, code, expiry, 0, 0); err != nil {
+		if _, err := getDBPool().Exec(context.Background(), query, cm.Username, cm.Email, encryptedPW, hashVerificationCode(code), expiry, 0, 0); err != nil {
 			sendJsonResponse(w, map[string]string{"status": "failure"})
 			return
 		}
@@ -440,16 +566,24 @@ func signUp(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			}
 		}()
 
-		sendVerificationEmail(cm.Username, cm.Email, code)
+		if err := sendVerificationEmail(cm.Username, cm.Email, code, link, emailLocale(r)); err != nil {
+			logger.Println("Error in queuing verification email:", err)
+			deleteActivationRec(cm.Email)
+			sendJsonResponse(w, map[string]string{"status": "failure"})
+			return
+		}
 	}
 
 	type responseModel struct {
 		EmailUsed bool   `json:"emailUsed"`
 		Status    string `json:"status"`
+		// The email has a link to follow instead of a code
+		MagicLink bool `json:"magicLink"`
 	}
 	response := &responseModel{
 		EmailUsed: emailUsed,
 		Status:    "success",
+		MagicLink: link != "",
 	}
 
 	sendJsonResponse(w, response)
@@ -507,16 +641,27 @@ func resendVerificationEmail(w http.ResponseWriter, r *http.Request, p httproute
 	}
 
 	// Update fields
-	activationCode := generateRandomCode()
+	activationCode, err := generateVerificationCode()
+	if err != nil {
+		fatalFailureRes.Message = "Something went wrong — please try again in 10 minutes."
+		sendJsonResponse(w, fatalFailureRes)
+		return
+	}
 	expiry := time.Now().Add(activationTimeout).Unix()
+	link, err := buildMagicLink(magicLinkActivate, cm.Email, activationCode, expiry)
+	if err != nil {
+		fatalFailureRes.Message = "Something went wrong — please try again in 10 minutes."
+		sendJsonResponse(w, fatalFailureRes)
+		return
+	}
 	query = "UPDATE pending_activations SET activation_code = $1, expiry = $2, code_resends = $3, code_attempts = $4 WHERE email = $5"
-	if _, err := getDBPool().Exec(context.Background(), query, activationCode, expiry, codeResends+1, 0, cm.Email); err != nil {
+	if _, err := getDBPool().Exec(context.Background(), query, hashVerificationCode(activationCode), expiry, codeResends+1, 0, cm.Email); err != nil {
 		fatalFailureRes.Message = "Something went wrong — please try again in 10 minutes."
 		sendJsonResponse(w, fatalFailureRes)
 		return
 	}
 
-	if err := sendVerificationEmail(cm.Username, cm.Email, activationCode); err != nil {
+	if err := sendVerificationEmail(cm.Username, cm.Email, activationCode, link, emailLocale(r)); err != nil {
 		fatalFailureRes.Message = "Something went wrong — please try again in 10 minutes."
 		sendJsonResponse(w, fatalFailureRes)
 		return
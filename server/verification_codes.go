@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Codes sent by email to activate accounts, reset passwords and
+// confirm email changes. Codes are generated with crypto/rand and
+// only an HMAC of them is stored (keyed with the CODE_HASH_SECRET
+// env variable, or PWPEPPER if that isn't set; the server won't
+// start without either). The emails holding them are kept in the
+// outbox until they have been sent.
+//
+// With MAGIC_LINKS set to "true", activation and password reset
+// emails have a link instead of a code to type in. The link holds
+// a signed token (see issueMagicLinkToken) with a long random code
+// in place of the six digit one. Links point at MAGIC_LINK_BASE,
+// which has to be set with MAGIC_LINKS (links are never built from
+// the request, whose Host header anybody can set).
+
+// Magic link purposes
+const (
+	magicLinkActivate = "activate"
+	magicLinkReset    = "reset"
+)
+
+var errInvalidMagicLink = errors.New("this link is invalid or has expired")
+
+var verificationSettings = struct {
+	hashKey    []byte
+	linkSecret []byte
+	magicLinks bool
+	linkBase   string
+}{}
+
+func initVerificationCodes() {
+	if secret := os.Getenv("CODE_HASH_SECRET"); secret != "" {
+		verificationSettings.hashKey = []byte(secret)
+	} else {
+		verificationSettings.hashKey = []byte(os.Getenv("PWPEPPER"))
+	}
+	if len(verificationSettings.hashKey) == 0 {
+		logger.Fatalln("CODE_HASH_SECRET or PWPEPPER must be set")
+	}
+	verificationSettings.magicLinks = os.Getenv("MAGIC_LINKS") == "true"
+	verificationSettings.linkBase = strings.TrimSuffix(os.Getenv("MAGIC_LINK_BASE"), "/")
+	if verificationSettings.magicLinks && verificationSettings.linkBase == "" {
+		logger.Fatalln("MAGIC_LINK_BASE must be set when MAGIC_LINKS is on")
+	}
+	// Without MAGIC_LINK_SECRET, links are only good until the
+	// server restarts
+	if secret := os.Getenv("MAGIC_LINK_SECRET"); secret != "" {
+		verificationSettings.linkSecret = []byte(secret)
+		return
+	}
+	verificationSettings.linkSecret = make([]byte, 32)
+	if _, err := rand.Read(verificationSettings.linkSecret); err != nil {
+		panic(err)
+	}
+}
+
+// Six digit code for the user to type in
+func generateRandomCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// Code for an activation or password reset email: a six digit code,
+// or a longer one for magic links, which don't have to be typed
+func generateVerificationCode() (string, error) {
+	if !verificationSettings.magicLinks {
+		return generateRandomCode()
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashVerificationCode(code string) string {
+	mac := hmac.New(sha256.New, verificationSettings.hashKey)
+	mac.Write([]byte(strings.TrimSpace(code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check a code against the stored hash, in constant time
+func checkVerificationCode(code, storedHash string) bool {
+	return hmac.Equal([]byte(hashVerificationCode(code)), []byte(storedHash))
+}
+
+type magicLinkClaims struct {
+	Purpose string `json:"p"`
+	Email   string `json:"e"`
+	Code    string `json:"c"`
+	Expiry  int64  `json:"exp"`
+}
+
+func signMagicLinkToken(payload string) string {
+	mac := hmac.New(sha256.New, verificationSettings.linkSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token in the form <payload>.<signature>, both base64url encoded,
+// like the Yjs room tokens
+func issueMagicLinkToken(purpose, email, code string, expiry int64) (string, error) {
+	encoded, err := json.Marshal(&magicLinkClaims{
+		Purpose: purpose,
+		Email:   email,
+		Code:    code,
+		Expiry:  expiry,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(encoded)
+	return payload + "." + signMagicLinkToken(payload), nil
+}
+
+func verifyMagicLinkToken(token, purpose string) (*magicLinkClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signMagicLinkToken(parts[0]))) {
+		return nil, errInvalidMagicLink
+	}
+	encoded, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidMagicLink
+	}
+	var claims magicLinkClaims
+	if err := json.Unmarshal(encoded, &claims); err != nil {
+		return nil, errInvalidMagicLink
+	}
+	if claims.Purpose != purpose || time.Now().Unix() > claims.Expiry {
+		return nil, errInvalidMagicLink
+	}
+	return &claims, nil
+}
+
+// Link for the email, if magic links are on. Activation links go
+// to the server, which signs the user in and sends them on to the
+// home page; reset links go to the sign-in form.
+func buildMagicLink(purpose, email, code string, expiry int64) (string, error) {
+	if !verificationSettings.magicLinks {
+		return "", nil
+	}
+	token, err := issueMagicLinkToken(purpose, email, code, expiry)
+	if err != nil {
+		return "", err
+	}
+	base := verificationSettings.linkBase
+	if purpose == magicLinkActivate {
+		return base + "/api/activate-link?token=" + url.QueryEscape(token), nil
+	}
+	return base + "/?resetToken=" + url.QueryEscape(token), nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"nhooyr.io/websocket"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on the output sent to the websockets in a room
+type outputLimits struct {
+	// Time output is held back so that it can be sent in a single
+	// frame together with any output that follows it
+	flushInterval time.Duration
+	// Largest frame sent; output beyond this is flushed straight away
+	maxFrameBytes int
+	// Sustained output rate allowed per room, in bytes per second
+	bytesPerSecond int
+	// Output that can be sent in one go above the sustained rate
+	burstBytes int
+	// Number of frames that can be waiting to be sent to a single
+	// websocket. Clients that fall further behind are disconnected.
+	sendQueueLen int
+	// Time allowed for a single frame to be written to a websocket
+	writeTimeout time.Duration
+}
+
+// Limits used for new rooms. Can be set with the WS_FLUSH_MS,
+// WS_MAX_FRAME_BYTES, WS_OUTPUT_RATE, WS_OUTPUT_BURST,
+// WS_SEND_QUEUE_LEN and WS_WRITE_TIMEOUT_MS env variables.
+var outLimits = outputLimits{
+	flushInterval:  20 * time.Millisecond,
+	maxFrameBytes:  16 << 10,
+	bytesPerSecond: 64 << 10,
+	burstBytes:     256 << 10,
+	sendQueueLen:   256,
+	writeTimeout:   5 * time.Second,
+}
+
+// Longest line of dropped output kept to be shown once output
+// resumes (so that the prompt isn't lost)
+const maxDroppedTail = 1024
+
+func initOutputLimits() {
+	outLimits.flushInterval = time.Duration(getEnvInt("WS_FLUSH_MS", int(outLimits.flushInterval/time.Millisecond))) * time.Millisecond
+	outLimits.maxFrameBytes = getEnvInt("WS_MAX_FRAME_BYTES", outLimits.maxFrameBytes)
+	outLimits.bytesPerSecond = getEnvInt("WS_OUTPUT_RATE", outLimits.bytesPerSecond)
+	outLimits.burstBytes = getEnvInt("WS_OUTPUT_BURST", outLimits.burstBytes)
+	outLimits.sendQueueLen = getEnvInt("WS_SEND_QUEUE_LEN", outLimits.sendQueueLen)
+	outLimits.writeTimeout = time.Duration(getEnvInt("WS_WRITE_TIMEOUT_MS", int(outLimits.writeTimeout/time.Millisecond))) * time.Millisecond
+}
+
+// A websocket connected to a room. Frames are queued and written
+// by a goroutine of its own, so that one slow client can't hold up
+// output to everybody else.
+type wsClient struct {
+	conn  *websocket.Conn
+	queue chan []byte
+	// Type of the frames written (text, or binary for Yjs)
+	msgType   websocket.MessageType
+	done      chan struct{}
+	closeOnce sync.Once
+	// Whether the client belongs to the room owner
+	isOwner bool
+	// Per room ID, and the name input from the client is
+	// attributed to. Guarded by room.wsMu.
+	id           int
+	name         string
+	signedInName bool
+	// Secret given to the client when it connects, which it sends
+	// with HTTP requests made on its behalf (interrupting a run
+	// etc.), so that they can be tied to it
+	token string
+	// Terminal size last reported by the client (zero if none).
+	// Guarded by room.wsMu.
+	cols int
+	rows int
+}
+
+func newWsClient(conn *websocket.Conn, isOwner bool) *wsClient {
+	return newWsClientOfType(conn, isOwner, websocket.MessageText)
+}
+
+func newWsClientOfType(conn *websocket.Conn, isOwner bool, msgType websocket.MessageType) *wsClient {
+	c := &wsClient{
+		conn:    conn,
+		queue:   make(chan []byte, outLimits.sendQueueLen),
+		msgType: msgType,
+		done:    make(chan struct{}),
+		isOwner: isOwner,
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err == nil {
+		c.token = hex.EncodeToString(b)
+	}
+	go c.writeLoop()
+	return c
+}
+
+func (c *wsClient) writeLoop() {
+	for {
+		select {
+		case message := <-c.queue:
+			ctx, cancel := context.WithTimeout(context.Background(), outLimits.writeTimeout)
+			err := c.conn.Write(ctx, c.msgType, message)
+			cancel()
+			if err != nil {
+				logger.Println("ws write err:", err)
+				c.close(websocket.StatusGoingAway, "write failed")
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Queue a frame for the client. Returns false if the client's
+// queue is full.
+func (c *wsClient) send(message []byte) bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+	}
+	select {
+	case c.queue <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *wsClient) close(code websocket.StatusCode, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close(code, reason)
+	})
+}
+
+// Output waiting to be sent to a room's websockets, and the state
+// of the room's output rate limit
+type roomOutput struct {
+	mu         sync.Mutex
+	pending    []byte
+	pendingTag string
+	flushTimer *time.Timer
+	tokens     float64
+	lastRefill time.Time
+	throttled  bool
+	// Last (partial) line of output dropped while throttled
+	droppedTail []byte
+}
+
+func newRoomOutput() *roomOutput {
+	return &roomOutput{
+		tokens:     float64(outLimits.burstBytes),
+		lastRefill: time.Now(),
+	}
+}
+
+func (o *roomOutput) refill() {
+	now := time.Now()
+	o.tokens += now.Sub(o.lastRefill).Seconds() * float64(outLimits.bytesPerSecond)
+	if o.tokens > float64(outLimits.burstBytes) {
+		o.tokens = float64(outLimits.burstBytes)
+	}
+	o.lastRefill = now
+}
+
+func (o *roomOutput) keepDroppedTail(text []byte) {
+	if idx := bytes.LastIndexAny(text, "\r\n"); idx != -1 {
+		o.droppedTail = o.droppedTail[:0]
+		text = text[idx+1:]
+	}
+	if len(o.droppedTail)+len(text) > maxDroppedTail {
+		o.droppedTail = o.droppedTail[:0]
+		return
+	}
+	o.droppedTail = append(o.droppedTail, text...)
+}
+
+func addWsClient(room *room, client *wsClient) int {
+	room.wsMu.Lock()
+	defer room.wsMu.Unlock()
+	room.nextClientID++
+	client.id = room.nextClientID
+	room.wsockets = append(room.wsockets, client)
+	return len(room.wsockets)
+}
+
+func setWsClientSize(room *room, client *wsClient, cols, rows int) {
+	room.wsMu.Lock()
+	defer room.wsMu.Unlock()
+	client.cols = cols
+	client.rows = rows
+}
+
+// Guests tell the server the name they are using in the room.
+// Signed in users are always known by their account username.
+func setWsClientName(room *room, client *wsClient, name string) {
+	room.wsMu.Lock()
+	defer room.wsMu.Unlock()
+	if name = strings.TrimSpace(name); name != "" && !client.signedInName {
+		client.name = name
+	}
+}
+
+func countWsClients(room *room) int {
+	room.wsMu.Lock()
+	defer room.wsMu.Unlock()
+	return len(room.wsockets)
+}
+
+// Client with the given token, if it is still in the room
+func findWsClientByToken(room *room, token string) *wsClient {
+	if token == "" {
+		return nil
+	}
+	room.wsMu.Lock()
+	defer room.wsMu.Unlock()
+	for _, c := range room.wsockets {
+		if c.token == token {
+			return c
+		}
+	}
+	return nil
+}
+
+func getWsClientName(room *room, client *wsClient) string {
+	room.wsMu.Lock()
+	defer room.wsMu.Unlock()
+	return client.name
+}
+
+func removeWsClient(room *room, client *wsClient) {
+	room.wsMu.Lock()
+	defer room.wsMu.Unlock()
+	for idx, c := range room.wsockets {
+		if c == client {
+			room.wsockets = append(room.wsockets[:idx], room.wsockets[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Send a frame to every websocket in the room, disconnecting
+// clients that can't keep up
+func broadcast(room *room, message []byte) {
+	room.wsMu.Lock()
+	clients := append([]*wsClient{}, room.wsockets...)
+	room.wsMu.Unlock()
+
+	for _, client := range clients {
+		if !client.send(message) {
+			logger.Println("Disconnecting slow websocket client")
+			client.close(websocket.StatusPolicyViolation, "slow consumer")
+			removeWsClient(room, client)
+		}
+	}
+}
+
+// Add output to what is waiting to be sent to the room. tag is the
+// stream name for split mode runs, or empty for REPL output.
+func queueOutput(room *room, tag string, text []byte) {
+	o := room.output
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// A rate of zero turns the limit off
+	if outLimits.bytesPerSecond <= 0 {
+		appendOutput(room, tag, text)
+		return
+	}
+
+	o.refill()
+	if o.throttled && o.tokens >= float64(outLimits.burstBytes) {
+		resumeOutput(room)
+	}
+	if o.throttled || o.tokens < float64(len(text)) {
+		if !o.throttled {
+			o.throttled = true
+			flushOutput(room)
+			appendOutput(room, "", []byte(burstTruncatedMarker))
+			flushOutput(room)
+			broadcast(room, []byte("OUTPUTTRUNCATED"))
+		}
+		o.keepDroppedTail(text)
+		return
+	}
+	o.tokens -= float64(len(text))
+	appendOutput(room, tag, text)
+}
+
+// Lift the output limit once the room is at a prompt again. Called
+// with room.output.mu held.
+func resumeOutput(room *room) {
+	o := room.output
+	o.throttled = false
+	o.tokens = float64(outLimits.burstBytes)
+	if len(o.droppedTail) > 0 {
+		appendOutput(room, "", o.droppedTail)
+		o.droppedTail = nil
+	}
+}
+
+func endOutputThrottle(room *room) {
+	o := room.output
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.throttled {
+		resumeOutput(room)
+	}
+}
+
+// Called with room.output.mu held
+func appendOutput(room *room, tag string, text []byte) {
+	o := room.output
+	// Also write to history if at least one client connected
+	if countWsClients(room) > 0 {
+		if tag == "stderr" {
+			// Stderr is coloured red in the terminal history, so that
+			// late joiners see the same thing as everybody else
+			room.screen.Write([]byte("\x1b[31m"))
+			room.screen.Write(text)
+			room.screen.Write([]byte("\x1b[0m"))
+		} else {
+			room.screen.Write(text)
+		}
+	}
+	if tag == "stderr" {
+		room.recording.recordOutput([]byte("\x1b[31m" + string(text) + "\x1b[0m"))
+	} else {
+		room.recording.recordOutput(text)
+	}
+
+	if tag != o.pendingTag {
+		flushOutput(room)
+	}
+	o.pendingTag = tag
+	o.pending = append(o.pending, text...)
+	if len(o.pending) >= outLimits.maxFrameBytes {
+		flushOutput(room)
+		return
+	}
+	if o.flushTimer == nil {
+		o.flushTimer = time.AfterFunc(outLimits.flushInterval, func() {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			flushOutput(room)
+		})
+	}
+}
+
+// Send pending output to the room's websockets. Called with
+// room.output.mu held.
+func flushOutput(room *room) {
+	o := room.output
+	if o.flushTimer != nil {
+		o.flushTimer.Stop()
+		o.flushTimer = nil
+	}
+	if len(o.pending) == 0 {
+		return
+	}
+	message := append(append([]byte{}, streamTags[o.pendingTag]...), o.pending...)
+	o.pending = o.pending[:0]
+	broadcast(room, message)
+}
+
+// Control messages go out straight away, but after any output
+// that came before them
+func sendControlMessage(room *room, text []byte) {
+	o := room.output
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	flushOutput(room)
+	broadcast(room, text)
+}
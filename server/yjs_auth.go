@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Roles a Yjs token can grant. Viewers get the document and the
+// other participants' cursors, but their changes are ignored.
+const (
+	yjsRoleOwner  = "owner"
+	yjsRoleEditor = "editor"
+	yjsRoleViewer = "viewer"
+)
+
+var errInvalidYjsToken = errors.New("invalid Yjs token")
+
+// Key the tokens are signed with, set in the YJS_TOKEN_SECRET env
+// variable. If it isn't set, a random key is used, so that tokens
+// are only good until the server restarts.
+var yjsTokenSecret []byte
+
+// How long a token is good for. Can be set with the YJS_TOKEN_TTL
+// env variable (in seconds). Tokens are only checked when the
+// websocket is opened, so the frontend gets a new one from time to
+// time for reconnects.
+var yjsTokenTTL = 5 * time.Minute
+
+func initYjsTokens() {
+	yjsTokenTTL = getEnvSeconds("YJS_TOKEN_TTL", yjsTokenTTL)
+	if secret := os.Getenv("YJS_TOKEN_SECRET"); secret != "" {
+		yjsTokenSecret = []byte(secret)
+		return
+	}
+	yjsTokenSecret = make([]byte, 32)
+	if _, err := rand.Read(yjsTokenSecret); err != nil {
+		panic(err)
+	}
+}
+
+type yjsTokenClaims struct {
+	UserID int    `json:"uid"`
+	RoomID string `json:"room"`
+	Role   string `json:"role"`
+	Expiry int64  `json:"exp"`
+}
+
+func signYjsToken(payload string) string {
+	mac := hmac.New(sha256.New, yjsTokenSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token in the form <payload>.<signature>, both base64url encoded
+func issueYjsToken(userID int, roomID string, role string) (string, error) {
+	claims := &yjsTokenClaims{
+		UserID: userID,
+		RoomID: roomID,
+		Role:   role,
+		Expiry: time.Now().Add(yjsTokenTTL).Unix(),
+	}
+	encoded, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(encoded)
+	return payload + "." + signYjsToken(payload), nil
+}
+
+func verifyYjsToken(token string) (*yjsTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errInvalidYjsToken
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(signYjsToken(parts[0]))) {
+		return nil, errInvalidYjsToken
+	}
+	encoded, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidYjsToken
+	}
+	var claims yjsTokenClaims
+	if err := json.Unmarshal(encoded, &claims); err != nil {
+		return nil, errInvalidYjsToken
+	}
+	if time.Now().Unix() > claims.Expiry {
+		return nil, errors.New("expired Yjs token")
+	}
+	switch claims.Role {
+	case yjsRoleOwner, yjsRoleEditor, yjsRoleViewer:
+	default:
+		return nil, errInvalidYjsToken
+	}
+	return &claims, nil
+}
+
+// Role of the user in the room. The room owner is the signed in
+// user who created it; everybody else with the room link can edit,
+// unless the owner has made the editor read only.
+func getYjsRole(room *room, userID int) string {
+	if userID != -1 && userID == room.creatorUserID {
+		return yjsRoleOwner
+	}
+	if room.editorReadOnly {
+		return yjsRoleViewer
+	}
+	return yjsRoleEditor
+}
+
+func editorReadOnlyMessage(readOnly bool) []byte {
+	if readOnly {
+		return []byte("EDITORREADONLY:on")
+	}
+	return []byte("EDITORREADONLY:off")
+}
+
+// Only the room owner can make the editor read only for everybody
+// else, or let them edit again. Connections already open are
+// switched over straight away.
+func setEditorReadOnly(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type paramsModel struct {
+		ReadOnly bool
+	}
+	roomID := p.ByName("id")
+	room, ok := rooms[roomID]
+	if !ok {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	userID, err := getSessionUserID(r)
+	if err != nil || userID == -1 || userID != room.creatorUserID {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+
+	var pm paramsModel
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	if err = json.Unmarshal(body, &pm); err != nil {
+		sendJsonResponse(w, map[string]string{"status": "failure"})
+		return
+	}
+	room.editorReadOnly = pm.ReadOnly
+	setYjsDocReadOnly(yjsDocPrefix+roomID, pm.ReadOnly)
+	sendControlMessage(room, editorReadOnlyMessage(pm.ReadOnly))
+
+	sendJsonResponse(w, map[string]string{"status": "success"})
+}
+
+// New token for the room's Yjs document, for clients whose token
+// is about to expire
+func getYjsToken(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	type responseModel struct {
+		Status     string `json:"status"`
+		Token      string `json:"token"`
+		TTLSeconds int    `json:"ttlSeconds"`
+	}
+	roomID := p.ByName("id")
+	room, ok := rooms[roomID]
+	if !ok {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+	userID, err := getSessionUserID(r)
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+	token, err := issueYjsToken(userID, roomID, getYjsRole(room, userID))
+	if err != nil {
+		sendJsonResponse(w, &responseModel{Status: "failure"})
+		return
+	}
+
+	sendJsonResponse(w, &responseModel{
+		Status:     "success",
+		Token:      token,
+		TTLSeconds: int(yjsTokenTTL / time.Second),
+	})
+}
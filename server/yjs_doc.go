@@ -0,0 +1,424 @@
+package main
+
+import (
+	"sort"
+	"unicode/utf16"
+)
+
+// Minimal Yjs document model, used to read the editor contents
+// out of a stored document. Items are integrated with the same
+// conflict resolution Yjs uses, so that text comes out in the
+// order clients see it.
+
+type yjsItem struct {
+	id          yjsID
+	length      uint64
+	origin      *yjsID
+	rightOrigin *yjsID
+	left        *yjsItem
+	right       *yjsItem
+	parent      *yjsType
+	parentSub   *string
+	content     yjsContent
+	deleted     bool
+	// GC'd range (or an item whose parent is gone)
+	gc bool
+}
+
+func (it *yjsItem) lastID() yjsID {
+	return yjsID{client: it.id.client, clock: it.id.clock + it.length - 1}
+}
+
+type yjsType struct {
+	start *yjsItem
+	mp    map[string]*yjsItem
+	// Item holding the type, if it isn't a root type
+	item *yjsItem
+}
+
+func newYjsType(item *yjsItem) *yjsType {
+	return &yjsType{mp: make(map[string]*yjsItem), item: item}
+}
+
+type yjsDoc struct {
+	// Items of each client, sorted by clock
+	clients map[uint64][]*yjsItem
+	roots   map[string]*yjsType
+	types   map[*yjsItem]*yjsType
+}
+
+func (doc *yjsDoc) state(client uint64) uint64 {
+	items := doc.clients[client]
+	if len(items) == 0 {
+		return 0
+	}
+	return items[len(items)-1].lastID().clock + 1
+}
+
+func (doc *yjsDoc) root(name string) *yjsType {
+	t, ok := doc.roots[name]
+	if !ok {
+		t = newYjsType(nil)
+		doc.roots[name] = t
+	}
+	return t
+}
+
+func (doc *yjsDoc) findIndex(client uint64, clock uint64) int {
+	items := doc.clients[client]
+	idx := sort.Search(len(items), func(i int) bool {
+		return items[i].id.clock+items[i].length > clock
+	})
+	if idx == len(items) || items[idx].id.clock > clock {
+		return -1
+	}
+	return idx
+}
+
+func (doc *yjsDoc) getItem(id yjsID) *yjsItem {
+	idx := doc.findIndex(id.client, id.clock)
+	if idx == -1 {
+		return nil
+	}
+	return doc.clients[id.client][idx]
+}
+
+// Split an item in two at diff, returning the right part
+func (doc *yjsDoc) splitItem(left *yjsItem, diff uint64) *yjsItem {
+	client, clock := left.id.client, left.id.clock
+	right := &yjsItem{
+		id:          yjsID{client: client, clock: clock + diff},
+		length:      left.length - diff,
+		origin:      &yjsID{client: client, clock: clock + diff - 1},
+		left:        left,
+		right:       left.right,
+		rightOrigin: left.rightOrigin,
+		parent:      left.parent,
+		parentSub:   left.parentSub,
+		deleted:     left.deleted,
+		gc:          left.gc,
+	}
+	if !left.gc {
+		right.content = left.content.splice(diff)
+	}
+	left.length = diff
+	left.right = right
+	if right.right != nil {
+		right.right.left = right
+	}
+	if right.right == nil && right.parentSub != nil && right.parent != nil {
+		right.parent.mp[*right.parentSub] = right
+	}
+
+	idx := doc.findIndex(client, clock)
+	items := doc.clients[client]
+	items = append(items, nil)
+	copy(items[idx+2:], items[idx+1:])
+	items[idx+1] = right
+	doc.clients[client] = items
+	return right
+}
+
+// Item ending at id (splitting if needed)
+func (doc *yjsDoc) getItemCleanEnd(id yjsID) *yjsItem {
+	it := doc.getItem(id)
+	if it != nil && !it.gc && id.clock != it.lastID().clock {
+		doc.splitItem(it, id.clock-it.id.clock+1)
+	}
+	return it
+}
+
+// Item starting at id (splitting if needed)
+func (doc *yjsDoc) getItemCleanStart(id yjsID) *yjsItem {
+	it := doc.getItem(id)
+	if it != nil && !it.gc && it.id.clock < id.clock {
+		return doc.splitItem(it, id.clock-it.id.clock)
+	}
+	return it
+}
+
+func (doc *yjsDoc) addItem(it *yjsItem) {
+	doc.clients[it.id.client] = append(doc.clients[it.id.client], it)
+}
+
+func sameYjsID(a, b *yjsID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Whether everything the struct refers to is in the document
+func (doc *yjsDoc) hasDependencies(s *yjsStruct) bool {
+	for _, id := range []*yjsID{s.origin, s.rightOrigin, s.parentID} {
+		if id != nil && id.client != s.id.client && id.clock >= doc.state(id.client) {
+			return false
+		}
+	}
+	return true
+}
+
+func (doc *yjsDoc) integrate(s *yjsStruct, offset uint64) {
+	it := &yjsItem{
+		id:          s.id,
+		length:      s.length,
+		origin:      s.origin,
+		rightOrigin: s.rightOrigin,
+		parentSub:   s.parentSub,
+		content:     s.content,
+		gc:          s.kind == yjsStructGC,
+	}
+	if offset > 0 {
+		it.id.clock += offset
+		it.length -= offset
+		it.origin = &yjsID{client: it.id.client, clock: it.id.clock - 1}
+		if !it.gc {
+			it.content = it.content.splice(offset)
+		}
+	}
+	if it.gc {
+		it.deleted = true
+		doc.addItem(it)
+		return
+	}
+
+	if it.origin != nil {
+		it.left = doc.getItemCleanEnd(*it.origin)
+		if it.left != nil {
+			last := it.left.lastID()
+			it.origin = &last
+		}
+	}
+	if it.rightOrigin != nil {
+		it.right = doc.getItemCleanStart(*it.rightOrigin)
+		if it.right != nil {
+			it.rightOrigin = &it.right.id
+		}
+	}
+
+	switch {
+	case (it.left != nil && it.left.gc) || (it.right != nil && it.right.gc):
+		it.parent = nil
+	case s.parentKey != nil:
+		it.parent = doc.root(*s.parentKey)
+	case s.parentID != nil:
+		if parentItem := doc.getItem(*s.parentID); parentItem != nil && !parentItem.gc {
+			it.parent = doc.types[parentItem]
+		}
+	default:
+		if it.left != nil {
+			it.parent = it.left.parent
+			it.parentSub = it.left.parentSub
+		}
+		if it.right != nil {
+			it.parent = it.right.parent
+			it.parentSub = it.right.parentSub
+		}
+	}
+	if it.parent == nil {
+		// Parent is gone, so the item is as good as deleted
+		it.gc = true
+		it.deleted = true
+		it.left, it.right = nil, nil
+		doc.addItem(it)
+		return
+	}
+
+	// Find the item's place among items inserted concurrently at
+	// the same position
+	if (it.left == nil && (it.right == nil || it.right.left != nil)) ||
+		(it.left != nil && it.left.right != it.right) {
+		left := it.left
+		var o *yjsItem
+		if left != nil {
+			o = left.right
+		} else if it.parentSub != nil {
+			o = it.parent.mp[*it.parentSub]
+			for o != nil && o.left != nil {
+				o = o.left
+			}
+		} else {
+			o = it.parent.start
+		}
+		conflicting := make(map[*yjsItem]bool)
+		beforeOrigin := make(map[*yjsItem]bool)
+		for o != nil && o != it.right {
+			beforeOrigin[o] = true
+			conflicting[o] = true
+			if sameYjsID(it.origin, o.origin) {
+				if o.id.client < it.id.client {
+					left = o
+					conflicting = make(map[*yjsItem]bool)
+				} else if sameYjsID(it.rightOrigin, o.rightOrigin) {
+					break
+				}
+			} else if o.origin != nil && beforeOrigin[doc.getItem(*o.origin)] {
+				if !conflicting[doc.getItem(*o.origin)] {
+					left = o
+					conflicting = make(map[*yjsItem]bool)
+				}
+			} else {
+				break
+			}
+			o = o.right
+		}
+		it.left = left
+	}
+
+	if it.left != nil {
+		it.right = it.left.right
+		it.left.right = it
+	} else {
+		var r *yjsItem
+		if it.parentSub != nil {
+			r = it.parent.mp[*it.parentSub]
+			for r != nil && r.left != nil {
+				r = r.left
+			}
+		} else {
+			r = it.parent.start
+			it.parent.start = it
+		}
+		it.right = r
+	}
+	if it.right != nil {
+		it.right.left = it
+	} else if it.parentSub != nil {
+		// New value for a map key
+		it.parent.mp[*it.parentSub] = it
+		if it.left != nil {
+			it.left.deleted = true
+		}
+	}
+	doc.addItem(it)
+
+	switch it.content.ref {
+	case yjsContentType:
+		doc.types[it] = newYjsType(it)
+	case yjsContentDeleted:
+		it.deleted = true
+	}
+	if (it.parent.item != nil && it.parent.item.deleted) || (it.parentSub != nil && it.right != nil) {
+		it.deleted = true
+	}
+}
+
+func (doc *yjsDoc) applyDeletes(deletes map[uint64][]yjsRange) {
+	for client, ranges := range deletes {
+		state := doc.state(client)
+		for _, r := range ranges {
+			if r.clock >= state {
+				continue
+			}
+			end := r.clock + r.length
+			if end > state {
+				end = state
+			}
+			it := doc.getItemCleanStart(yjsID{client: client, clock: r.clock})
+			if it == nil {
+				continue
+			}
+			idx := doc.findIndex(client, it.id.clock)
+			items := doc.clients[client]
+			for ; idx < len(items) && items[idx].id.clock < end; idx++ {
+				it := items[idx]
+				if it.id.clock+it.length > end {
+					doc.splitItem(it, end-it.id.clock)
+					items = doc.clients[client]
+				}
+				it.deleted = true
+			}
+		}
+	}
+}
+
+// Build a document from a stored (merged) update
+func loadYjsDoc(update []byte) (*yjsDoc, error) {
+	u, err := decodeYjsUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+	doc := &yjsDoc{
+		clients: make(map[uint64][]*yjsItem),
+		roots:   make(map[string]*yjsType),
+		types:   make(map[*yjsItem]*yjsType),
+	}
+
+	// Integrate structs as soon as what they depend on is there,
+	// each client's structs in clock order
+	queues := make(map[uint64][]*yjsStruct)
+	for client, structs := range u.structs {
+		sort.SliceStable(structs, func(i, j int) bool {
+			return structs[i].id.clock < structs[j].id.clock
+		})
+		queues[client] = structs
+	}
+	for progress := true; progress; {
+		progress = false
+		for client, queue := range queues {
+			for len(queue) > 0 {
+				s := queue[0]
+				state := doc.state(client)
+				if s.kind == yjsStructSkip || s.id.clock > state {
+					// Missing structs; nothing more can be done for
+					// this client
+					queue = nil
+					break
+				}
+				if s.id.clock+s.length <= state {
+					queue = queue[1:]
+					continue
+				}
+				if !doc.hasDependencies(s) {
+					break
+				}
+				doc.integrate(s, state-s.id.clock)
+				queue = queue[1:]
+				progress = true
+			}
+			queues[client] = queue
+		}
+	}
+
+	doc.applyDeletes(u.deletes)
+	return doc, nil
+}
+
+// Contents of a root Y.Text
+func (doc *yjsDoc) getText(name string) string {
+	t, ok := doc.roots[name]
+	if !ok {
+		return ""
+	}
+	var units []uint16
+	for it := t.start; it != nil; it = it.right {
+		if !it.deleted && it.content.ref == yjsContentString {
+			units = append(units, it.content.str...)
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// Values of a root Y.Map. Entries that hold shared types are left
+// out.
+func (doc *yjsDoc) getMap(name string) map[string]interface{} {
+	values := make(map[string]interface{})
+	t, ok := doc.roots[name]
+	if !ok {
+		return values
+	}
+	for key, it := range t.mp {
+		if it.deleted {
+			continue
+		}
+		switch it.content.ref {
+		case yjsContentAny, yjsContentJSON:
+			if n := len(it.content.values); n > 0 {
+				values[key] = it.content.values[n-1]
+			}
+		case yjsContentString:
+			values[key] = string(utf16.Decode(it.content.str))
+		}
+	}
+	return values
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"unicode/utf16"
+)
+
+// Binary encoding used by Yjs and its protocols (from the lib0
+// library)
+
+var errYjsDecode = errors.New("malformed Yjs message")
+
+type yjsDecoder struct {
+	buf []byte
+	pos int
+}
+
+func newYjsDecoder(buf []byte) *yjsDecoder {
+	return &yjsDecoder{buf: buf}
+}
+
+func (d *yjsDecoder) done() bool {
+	return d.pos >= len(d.buf)
+}
+
+func (d *yjsDecoder) readUint8() (byte, error) {
+	if d.pos >= len(d.buf) {
+		return 0, errYjsDecode
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *yjsDecoder) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.buf)-d.pos) {
+		return nil, errYjsDecode
+	}
+	b := d.buf[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// Unsigned integer, 7 bits per byte, least significant group
+// first
+func (d *yjsDecoder) readVarUint() (uint64, error) {
+	var n uint64
+	var shift uint
+	for {
+		b, err := d.readUint8()
+		if err != nil {
+			return 0, err
+		}
+		if shift > 63 {
+			return 0, errYjsDecode
+		}
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return n, nil
+		}
+		shift += 7
+	}
+}
+
+// Signed integer: the first byte holds a continuation bit, a sign
+// bit and 6 bits of the value
+func (d *yjsDecoder) readVarInt() (int64, error) {
+	b, err := d.readUint8()
+	if err != nil {
+		return 0, err
+	}
+	n := int64(b & 0x3f)
+	negative := b&0x40 != 0
+	shift := uint(6)
+	for b&0x80 != 0 {
+		if b, err = d.readUint8(); err != nil {
+			return 0, err
+		}
+		if shift > 62 {
+			return 0, errYjsDecode
+		}
+		n |= int64(b&0x7f) << shift
+		shift += 7
+	}
+	if negative {
+		n = -n
+	}
+	return n, nil
+}
+
+func (d *yjsDecoder) readVarUint8Array() ([]byte, error) {
+	n, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	return d.readBytes(n)
+}
+
+func (d *yjsDecoder) readVarString() (string, error) {
+	b, err := d.readVarUint8Array()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Value encoded with lib0's writeAny
+func (d *yjsDecoder) readAny() (interface{}, error) {
+	t, err := d.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case 127, 126: // undefined, null
+		return nil, nil
+	case 125: // integer
+		return d.readVarInt()
+	case 124: // float32
+		b, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		bits := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+		return float64(math.Float32frombits(bits)), nil
+	case 123: // float64
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		var bits uint64
+		for _, c := range b {
+			bits = bits<<8 | uint64(c)
+		}
+		return math.Float64frombits(bits), nil
+	case 122: // bigint
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return int64(n), nil
+	case 121:
+		return false, nil
+	case 120:
+		return true, nil
+	case 119:
+		return d.readVarString()
+	case 118: // object
+		n, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		obj := make(map[string]interface{})
+		for i := uint64(0); i < n; i++ {
+			key, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+			if obj[key], err = d.readAny(); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	case 117: // array
+		n, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		arr := []interface{}{}
+		for i := uint64(0); i < n; i++ {
+			v, err := d.readAny()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case 116: // Uint8Array
+		return d.readVarUint8Array()
+	}
+	return nil, errYjsDecode
+}
+
+type yjsEncoder struct {
+	buf []byte
+}
+
+func (e *yjsEncoder) writeUint8(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *yjsEncoder) writeVarUint(n uint64) {
+	for n >= 0x80 {
+		e.buf = append(e.buf, byte(n&0x7f)|0x80)
+		n >>= 7
+	}
+	e.buf = append(e.buf, byte(n))
+}
+
+func (e *yjsEncoder) writeVarUint8Array(b []byte) {
+	e.writeVarUint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *yjsEncoder) writeVarString(s string) {
+	e.writeVarUint8Array([]byte(s))
+}
+
+// Length of a string as JavaScript sees it (UTF-16 code units),
+// which is what Yjs uses for clocks
+func jsStringUnits(s string) []uint16 {
+	return utf16.Encode([]rune(s))
+}
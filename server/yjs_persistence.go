@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Yjs documents are named after their room: this prefix followed
+// by the room ID
+const yjsDocPrefix = "nicks-cm-room-"
+
+// Largest editor contents saved for a code session (same limit as
+// updateCodeSession)
+const maxEditorContentsBytes = 64000
+
+func getYjsDocRoom(docName string) (string, *room, bool) {
+	if !strings.HasPrefix(docName, yjsDocPrefix) {
+		return "", nil, false
+	}
+	roomID := strings.TrimPrefix(docName, yjsDocPrefix)
+	room, ok := rooms[roomID]
+	return roomID, room, ok
+}
+
+// Editor contents (one entry per language) as stored in
+// coding_sessions.editor_contents. The shared "editor contents"
+// map only gets the current language's code when the autosaver
+// runs, so the code in the editor is taken from the shared text
+// instead.
+func buildEditorContents(editorContents map[string]string, editorText *string, lang string) (string, error) {
+	contents := make(map[string]string)
+	for k, v := range editorContents {
+		contents[k] = v
+	}
+	if editorText != nil && lang != "" {
+		contents[lang] = *editorText
+	}
+	encoded, err := json.Marshal(contents)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// Default persistence for the Yjs server: the document state is
+// kept with the room, and the editor contents are saved to the
+// room's code session (which is where a reopened session's editor
+// is filled from)
+type roomYjsPersistence struct{}
+
+func (roomYjsPersistence) bindState(docName string) ([]byte, error) {
+	_, room, ok := getYjsDocRoom(docName)
+	if !ok {
+		return nil, nil
+	}
+	return room.yjsState, nil
+}
+
+func (roomYjsPersistence) writeState(docName string, state []byte) error {
+	roomID, room, ok := getYjsDocRoom(docName)
+	if !ok {
+		// Room already closed
+		return nil
+	}
+	room.yjsState = state
+	if room.codeSessionID == -1 {
+		return nil
+	}
+
+	doc, err := loadYjsDoc(state)
+	if err != nil {
+		return err
+	}
+	// Don't save while a language switch is in progress, since the
+	// editor text may belong to either language
+	if active, _ := doc.getMap("switch language status")["active"].(bool); active {
+		return nil
+	}
+	editorContents := make(map[string]string)
+	for lang, code := range doc.getMap("editor contents") {
+		if code, ok := code.(string); ok {
+			editorContents[lang] = code
+		}
+	}
+	editorText := doc.getText("codemirror")
+	content, err := buildEditorContents(editorContents, &editorText, room.lang)
+	if err != nil {
+		return err
+	}
+	if len(content) > maxEditorContentsBytes {
+		return fmt.Errorf("editor contents for room %s too large (%d bytes)", roomID, len(content))
+	}
+
+	query := "UPDATE coding_sessions SET when_accessed = $1, lang = $2, editor_contents = $3 WHERE id = $4"
+	if _, err := pool.Exec(context.Background(), query, time.Now().Unix(), room.lang, content, room.codeSessionID); err != nil {
+		return err
+	}
+	room.yjsPersisted = true
+	return nil
+}
+
+// Whether editor contents for the code session are being saved
+// from the Yjs document, in which case they shouldn't be
+// overwritten by clients
+func isYjsPersisted(codeSessionID int) bool {
+	if codeSessionID == -1 {
+		return false
+	}
+	for _, room := range rooms {
+		if room.codeSessionID == codeSessionID && room.yjsPersisted {
+			return true
+		}
+	}
+	return false
+}
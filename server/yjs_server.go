@@ -0,0 +1,610 @@
+package main
+
+import (
+	"context"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"nhooyr.io/websocket"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server side of the y-websocket protocol, used by the editor to
+// share its Yjs document between the participants of a room.
+// Updates are relayed between clients and kept (merged) so that
+// clients joining later get the whole document.
+
+// Message types
+const (
+	yjsMessageSync           = 0
+	yjsMessageAwareness      = 1
+	yjsMessageAuth           = 2
+	yjsMessageQueryAwareness = 3
+)
+
+// Sync message types
+const (
+	yjsSyncStep1  = 0
+	yjsSyncStep2  = 1
+	yjsSyncUpdate = 2
+)
+
+const (
+	yjsPingInterval = 30 * time.Second
+	// The document is saved once no update has come in for
+	// yjsPersistWait, and at least every yjsPersistMaxWait while
+	// updates keep coming in
+	yjsPersistWait    = 2 * time.Second
+	yjsPersistMaxWait = 10 * time.Second
+	// Number of stored updates at which they are merged into one
+	yjsCompactUpdates = 100
+)
+
+// Largest message accepted from a client. Can be set with the
+// YJS_MAX_MESSAGE_BYTES env variable.
+var yjsMaxMessageBytes = 8 << 20
+
+func initYjsServer() {
+	yjsMaxMessageBytes = getEnvInt("YJS_MAX_MESSAGE_BYTES", yjsMaxMessageBytes)
+}
+
+// Where Yjs documents are loaded from when they are first opened,
+// and saved to while they are edited and when the last client
+// leaves
+type yjsPersistence interface {
+	// Stored document state (a Yjs update), or nil if there is none
+	bindState(docName string) ([]byte, error)
+	writeState(docName string, state []byte) error
+}
+
+var yjsStore yjsPersistence = roomYjsPersistence{}
+
+// Counters for the admin stats. Updated atomically.
+var yjsMetrics struct {
+	connections         int64
+	rejectedConnections int64
+	messagesIn          int64
+	messagesOut         int64
+	bytesIn             int64
+	bytesOut            int64
+	updates             int64
+	invalidMessages     int64
+	readOnlyUpdates     int64
+	compactions         int64
+	compactionErrors    int64
+	persistWrites       int64
+	persistErrors       int64
+}
+
+type yjsAwarenessState struct {
+	clock uint64
+	state string
+}
+
+type yjsConn struct {
+	client *wsClient
+	// Set for viewers, whose document updates are ignored. Guarded
+	// by the document's mu.
+	readOnly bool
+	// Awareness client IDs set by this connection, removed for
+	// everybody when it closes
+	awarenessIDs map[uint64]bool
+}
+
+type yjsSharedDoc struct {
+	name  string
+	mu    sync.Mutex
+	conns map[*yjsConn]bool
+	// Updates received since the document was loaded or last
+	// merged, the stored state first
+	updates   [][]byte
+	awareness map[uint64]yjsAwarenessState
+	// Pending save of the document
+	persistTimer *time.Timer
+	firstUnsaved time.Time
+}
+
+var (
+	yjsDocs   = make(map[string]*yjsSharedDoc)
+	yjsDocsMu sync.Mutex
+)
+
+// Add a connection to a document, loading the document if no one
+// has it open
+func openYjsSharedDoc(docName string, c *yjsConn) *yjsSharedDoc {
+	yjsDocsMu.Lock()
+	defer yjsDocsMu.Unlock()
+	doc, ok := yjsDocs[docName]
+	if !ok {
+		doc = &yjsSharedDoc{
+			name:      docName,
+			conns:     make(map[*yjsConn]bool),
+			awareness: make(map[uint64]yjsAwarenessState),
+		}
+		state, err := yjsStore.bindState(docName)
+		if err != nil {
+			logger.Printf("Unable to load Yjs document %s: %s", docName, err)
+		} else if len(state) > 0 {
+			doc.updates = [][]byte{state}
+		}
+		yjsDocs[docName] = doc
+	}
+	doc.mu.Lock()
+	doc.conns[c] = true
+	doc.mu.Unlock()
+	atomic.AddInt64(&yjsMetrics.connections, 1)
+	return doc
+}
+
+// Make everybody but the owner a viewer of an open document, or
+// let them edit again
+func setYjsDocReadOnly(docName string, readOnly bool) {
+	yjsDocsMu.Lock()
+	doc, ok := yjsDocs[docName]
+	yjsDocsMu.Unlock()
+	if !ok {
+		return
+	}
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	for c := range doc.conns {
+		if !c.client.isOwner {
+			c.readOnly = readOnly
+		}
+	}
+}
+
+func yjsSyncMessage(syncType uint64, payload []byte) []byte {
+	e := &yjsEncoder{}
+	e.writeVarUint(yjsMessageSync)
+	e.writeVarUint(syncType)
+	e.writeVarUint8Array(payload)
+	return e.buf
+}
+
+func yjsAwarenessMessage(states map[uint64]yjsAwarenessState) []byte {
+	clients := make([]uint64, 0, len(states))
+	for client := range states {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+
+	update := &yjsEncoder{}
+	update.writeVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		update.writeVarUint(client)
+		update.writeVarUint(states[client].clock)
+		update.writeVarString(states[client].state)
+	}
+	e := &yjsEncoder{}
+	e.writeVarUint(yjsMessageAwareness)
+	e.writeVarUint8Array(update.buf)
+	return e.buf
+}
+
+// Queue a message for a connection. Clients that can't keep up are
+// disconnected.
+func (c *yjsConn) send(message []byte) {
+	if !c.client.send(message) {
+		c.client.close(websocket.StatusPolicyViolation, "slow consumer")
+		return
+	}
+	atomic.AddInt64(&yjsMetrics.messagesOut, 1)
+	atomic.AddInt64(&yjsMetrics.bytesOut, int64(len(message)))
+}
+
+// Send to every connection except skip (which may be nil). Must be
+// called with doc.mu held.
+func (doc *yjsSharedDoc) broadcast(message []byte, skip *yjsConn) {
+	for c := range doc.conns {
+		if c != skip {
+			c.send(message)
+		}
+	}
+}
+
+// Merge the stored updates into one. Must be called with doc.mu
+// held.
+func (doc *yjsSharedDoc) compact() ([]byte, error) {
+	switch len(doc.updates) {
+	case 0:
+		return emptyYjsUpdate(), nil
+	case 1:
+		return doc.updates[0], nil
+	}
+	merged, err := mergeYjsUpdates(doc.updates)
+	if err != nil {
+		atomic.AddInt64(&yjsMetrics.compactionErrors, 1)
+		return nil, err
+	}
+	atomic.AddInt64(&yjsMetrics.compactions, 1)
+	doc.updates = [][]byte{merged}
+	return merged, nil
+}
+
+// Tell a new connection what the server has, so that it sends
+// what is missing, and who else is there
+func (doc *yjsSharedDoc) greet(c *yjsConn) {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+
+	stateVector := []byte{0}
+	if state, err := doc.compact(); err == nil {
+		if sv, err := yjsStateVector(state); err == nil {
+			stateVector = sv
+		}
+	}
+	c.send(yjsSyncMessage(yjsSyncStep1, stateVector))
+	if len(doc.awareness) > 0 {
+		c.send(yjsAwarenessMessage(doc.awareness))
+	}
+}
+
+// Answer a client's sync step 1 with the whole document. Clients
+// ignore the parts they already have.
+func (doc *yjsSharedDoc) sendState(c *yjsConn) {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+
+	state, err := doc.compact()
+	if err != nil {
+		// Send the updates one by one instead
+		logger.Printf("Unable to merge Yjs document %s: %s", doc.name, err)
+		for _, update := range doc.updates {
+			c.send(yjsSyncMessage(yjsSyncUpdate, update))
+		}
+		state = emptyYjsUpdate()
+	}
+	c.send(yjsSyncMessage(yjsSyncStep2, state))
+}
+
+// Store an update from a client and pass it on to everybody else
+func (doc *yjsSharedDoc) applyUpdate(from *yjsConn, update []byte) {
+	if _, err := decodeYjsUpdate(update); err != nil {
+		atomic.AddInt64(&yjsMetrics.invalidMessages, 1)
+		logger.Printf("Invalid Yjs update for %s: %s", doc.name, err)
+		return
+	}
+	if len(update) == 2 && update[0] == 0 && update[1] == 0 {
+		// Nothing in it
+		return
+	}
+	atomic.AddInt64(&yjsMetrics.updates, 1)
+
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	doc.updates = append(doc.updates, update)
+	if len(doc.updates) >= yjsCompactUpdates {
+		if _, err := doc.compact(); err != nil {
+			logger.Printf("Unable to merge Yjs document %s: %s", doc.name, err)
+		}
+	}
+	doc.broadcast(yjsSyncMessage(yjsSyncUpdate, update), from)
+	doc.schedulePersist()
+}
+
+// Must be called with doc.mu held
+func (doc *yjsSharedDoc) schedulePersist() {
+	now := time.Now()
+	if doc.persistTimer == nil {
+		doc.firstUnsaved = now
+		doc.persistTimer = time.AfterFunc(yjsPersistWait, doc.persist)
+		return
+	}
+	wait := yjsPersistWait
+	if remaining := doc.firstUnsaved.Add(yjsPersistMaxWait).Sub(now); remaining < wait {
+		wait = remaining
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	doc.persistTimer.Reset(wait)
+}
+
+func (doc *yjsSharedDoc) persist() {
+	doc.mu.Lock()
+	doc.persistTimer = nil
+	state, err := doc.compact()
+	doc.mu.Unlock()
+	if err != nil {
+		logger.Printf("Unable to merge Yjs document %s: %s", doc.name, err)
+		return
+	}
+	writeYjsState(doc.name, state)
+}
+
+func writeYjsState(docName string, state []byte) {
+	atomic.AddInt64(&yjsMetrics.persistWrites, 1)
+	if err := yjsStore.writeState(docName, state); err != nil {
+		atomic.AddInt64(&yjsMetrics.persistErrors, 1)
+		logger.Printf("Unable to save Yjs document %s: %s", docName, err)
+	}
+}
+
+// Handle an awareness update: keep track of the states and pass
+// the update on to everybody
+func (doc *yjsSharedDoc) applyAwareness(from *yjsConn, update []byte) {
+	d := newYjsDecoder(update)
+	n, err := d.readVarUint()
+	if err != nil {
+		atomic.AddInt64(&yjsMetrics.invalidMessages, 1)
+		return
+	}
+
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	for i := uint64(0); i < n; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			atomic.AddInt64(&yjsMetrics.invalidMessages, 1)
+			return
+		}
+		clock, err := d.readVarUint()
+		if err != nil {
+			atomic.AddInt64(&yjsMetrics.invalidMessages, 1)
+			return
+		}
+		state, err := d.readVarString()
+		if err != nil {
+			atomic.AddInt64(&yjsMetrics.invalidMessages, 1)
+			return
+		}
+		if prev, ok := doc.awareness[client]; ok && prev.clock > clock {
+			continue
+		}
+		if state == "null" {
+			delete(doc.awareness, client)
+			delete(from.awarenessIDs, client)
+		} else {
+			doc.awareness[client] = yjsAwarenessState{clock: clock, state: state}
+			from.awarenessIDs[client] = true
+		}
+	}
+
+	e := &yjsEncoder{}
+	e.writeVarUint(yjsMessageAwareness)
+	e.writeVarUint8Array(update)
+	doc.broadcast(e.buf, nil)
+}
+
+// Remove a closed connection. The document is saved and dropped
+// from memory once the last connection is gone.
+func (doc *yjsSharedDoc) removeConn(c *yjsConn) {
+	// Taken first so that nobody can open the document while it is
+	// being closed (and saved)
+	yjsDocsMu.Lock()
+	defer yjsDocsMu.Unlock()
+	doc.mu.Lock()
+	delete(doc.conns, c)
+	atomic.AddInt64(&yjsMetrics.connections, -1)
+
+	// Let everybody know the connection's users are gone
+	if len(c.awarenessIDs) > 0 {
+		removed := make(map[uint64]yjsAwarenessState)
+		for client := range c.awarenessIDs {
+			removed[client] = yjsAwarenessState{clock: doc.awareness[client].clock + 1, state: "null"}
+			delete(doc.awareness, client)
+		}
+		doc.broadcast(yjsAwarenessMessage(removed), nil)
+	}
+	if len(doc.conns) > 0 {
+		doc.mu.Unlock()
+		return
+	}
+
+	if doc.persistTimer != nil {
+		doc.persistTimer.Stop()
+		doc.persistTimer = nil
+	}
+	state, err := doc.compact()
+	doc.mu.Unlock()
+	delete(yjsDocs, doc.name)
+	if err != nil {
+		logger.Printf("Unable to merge Yjs document %s: %s", doc.name, err)
+		return
+	}
+	writeYjsState(doc.name, state)
+}
+
+func yjsPing(c *yjsConn) {
+	t := time.NewTicker(yjsPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-c.client.done:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), yjsPingInterval)
+		err := c.client.conn.Ping(ctx)
+		cancel()
+		if err != nil {
+			c.client.close(websocket.StatusGoingAway, "websocket no longer available")
+			return
+		}
+	}
+}
+
+// Websocket for a room's Yjs document. Clients need a token for
+// the room from getInitialRoomData (or getYjsToken), passed in the
+// token query parameter.
+func openYjsWs(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	roomID := p.ByName("roomID")
+	if _, ok := rooms[roomID]; !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	claims, err := verifyYjsToken(r.URL.Query().Get("token"))
+	if err != nil {
+		atomic.AddInt64(&yjsMetrics.rejectedConnections, 1)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	// The token must be for this room, and belong to whoever is
+	// signed in
+	userID, err := getSessionUserID(r)
+	if err != nil || claims.RoomID != roomID || claims.UserID != userID {
+		atomic.AddInt64(&yjsMetrics.rejectedConnections, 1)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: []string{"localhost:5000", "codeconnected.dev"},
+	})
+	if err != nil {
+		logger.Println("error in opening Yjs websocket: ", err)
+		return
+	}
+	defer ws.Close(websocket.StatusInternalError, "deferred close")
+	ws.SetReadLimit(int64(yjsMaxMessageBytes))
+
+	c := &yjsConn{
+		client:       newWsClientOfType(ws, claims.Role == yjsRoleOwner, websocket.MessageBinary),
+		readOnly:     claims.Role == yjsRoleViewer,
+		awarenessIDs: make(map[uint64]bool),
+	}
+	defer c.client.close(websocket.StatusInternalError, "deferred close")
+
+	doc := openYjsSharedDoc(yjsDocPrefix+roomID, c)
+	defer doc.removeConn(c)
+
+	doc.greet(c)
+	go yjsPing(c)
+
+	for {
+		_, message, err := ws.Read(context.Background())
+		if err != nil {
+			break
+		}
+		atomic.AddInt64(&yjsMetrics.messagesIn, 1)
+		atomic.AddInt64(&yjsMetrics.bytesIn, int64(len(message)))
+		handleYjsMessage(doc, c, message)
+	}
+}
+
+func handleYjsMessage(doc *yjsSharedDoc, c *yjsConn, message []byte) {
+	d := newYjsDecoder(message)
+	messageType, err := d.readVarUint()
+	if err != nil {
+		atomic.AddInt64(&yjsMetrics.invalidMessages, 1)
+		return
+	}
+	switch messageType {
+	case yjsMessageSync:
+		syncType, err := d.readVarUint()
+		if err != nil {
+			atomic.AddInt64(&yjsMetrics.invalidMessages, 1)
+			return
+		}
+		payload, err := d.readVarUint8Array()
+		if err != nil {
+			atomic.AddInt64(&yjsMetrics.invalidMessages, 1)
+			return
+		}
+		switch syncType {
+		case yjsSyncStep1:
+			doc.sendState(c)
+		case yjsSyncStep2, yjsSyncUpdate:
+			doc.mu.Lock()
+			readOnly := c.readOnly
+			doc.mu.Unlock()
+			if readOnly {
+				atomic.AddInt64(&yjsMetrics.readOnlyUpdates, 1)
+				return
+			}
+			doc.applyUpdate(c, payload)
+		default:
+			atomic.AddInt64(&yjsMetrics.invalidMessages, 1)
+		}
+	case yjsMessageAwareness:
+		update, err := d.readVarUint8Array()
+		if err != nil {
+			atomic.AddInt64(&yjsMetrics.invalidMessages, 1)
+			return
+		}
+		doc.applyAwareness(c, update)
+	case yjsMessageQueryAwareness:
+		doc.mu.Lock()
+		if len(doc.awareness) > 0 {
+			c.send(yjsAwarenessMessage(doc.awareness))
+		}
+		doc.mu.Unlock()
+	default:
+		// Auth messages are only sent by the server
+		atomic.AddInt64(&yjsMetrics.invalidMessages, 1)
+	}
+}
+
+func getYjsStats(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	type docStats struct {
+		Name        string `json:"name"`
+		Connections int    `json:"connections"`
+		Updates     int    `json:"updates"`
+		StateBytes  int    `json:"stateBytes"`
+		Awareness   int    `json:"awareness"`
+	}
+	type responseModel struct {
+		DocCount         int        `json:"docCount"`
+		Connections      int64      `json:"connections"`
+		Rejected         int64      `json:"rejectedConnections"`
+		MessagesIn       int64      `json:"messagesIn"`
+		MessagesOut      int64      `json:"messagesOut"`
+		BytesIn          int64      `json:"bytesIn"`
+		BytesOut         int64      `json:"bytesOut"`
+		Updates          int64      `json:"updates"`
+		InvalidMessages  int64      `json:"invalidMessages"`
+		ReadOnlyUpdates  int64      `json:"readOnlyUpdates"`
+		Compactions      int64      `json:"compactions"`
+		CompactionErrors int64      `json:"compactionErrors"`
+		PersistWrites    int64      `json:"persistWrites"`
+		PersistErrors    int64      `json:"persistErrors"`
+		Docs             []docStats `json:"docs"`
+	}
+
+	response := &responseModel{
+		Connections:      atomic.LoadInt64(&yjsMetrics.connections),
+		Rejected:         atomic.LoadInt64(&yjsMetrics.rejectedConnections),
+		MessagesIn:       atomic.LoadInt64(&yjsMetrics.messagesIn),
+		MessagesOut:      atomic.LoadInt64(&yjsMetrics.messagesOut),
+		BytesIn:          atomic.LoadInt64(&yjsMetrics.bytesIn),
+		BytesOut:         atomic.LoadInt64(&yjsMetrics.bytesOut),
+		Updates:          atomic.LoadInt64(&yjsMetrics.updates),
+		InvalidMessages:  atomic.LoadInt64(&yjsMetrics.invalidMessages),
+		ReadOnlyUpdates:  atomic.LoadInt64(&yjsMetrics.readOnlyUpdates),
+		Compactions:      atomic.LoadInt64(&yjsMetrics.compactions),
+		CompactionErrors: atomic.LoadInt64(&yjsMetrics.compactionErrors),
+		PersistWrites:    atomic.LoadInt64(&yjsMetrics.persistWrites),
+		PersistErrors:    atomic.LoadInt64(&yjsMetrics.persistErrors),
+		Docs:             []docStats{},
+	}
+	yjsDocsMu.Lock()
+	for _, doc := range yjsDocs {
+		doc.mu.Lock()
+		stats := docStats{
+			Name:        doc.name,
+			Connections: len(doc.conns),
+			Updates:     len(doc.updates),
+			Awareness:   len(doc.awareness),
+		}
+		for _, update := range doc.updates {
+			stats.StateBytes += len(update)
+		}
+		doc.mu.Unlock()
+		response.Docs = append(response.Docs, stats)
+	}
+	yjsDocsMu.Unlock()
+	response.DocCount = len(response.Docs)
+	sort.Slice(response.Docs, func(i, j int) bool {
+		return response.Docs[i].StateBytes > response.Docs[j].StateBytes
+	})
+
+	sendJsonResponse(w, response)
+}
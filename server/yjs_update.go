@@ -0,0 +1,533 @@
+package main
+
+import (
+	"sort"
+	"unicode/utf16"
+)
+
+// Decoding and merging of Yjs document updates (the v1 update
+// format). The server doesn't need to understand what is in the
+// structs to relay and store updates, only how long each one is,
+// so they are kept as raw bytes that can be written out again as
+// they are.
+
+// Struct types in an update
+const (
+	yjsStructGC   = 0
+	yjsStructSkip = 10
+)
+
+// Item content types
+const (
+	yjsContentDeleted = 1
+	yjsContentJSON    = 2
+	yjsContentBinary  = 3
+	yjsContentString  = 4
+	yjsContentEmbed   = 5
+	yjsContentFormat  = 6
+	yjsContentType    = 7
+	yjsContentAny     = 8
+	yjsContentDoc     = 9
+)
+
+// Type refs of types that have a name
+const (
+	yjsXmlElementRef = 3
+	yjsXmlHookRef    = 5
+)
+
+type yjsID struct {
+	client uint64
+	clock  uint64
+}
+
+type yjsContent struct {
+	ref byte
+	// Deleted content only has a length
+	length uint64
+	// String content, in UTF-16 code units
+	str []uint16
+	// Any and JSON content, decoded and as encoded
+	values    []interface{}
+	rawValues [][]byte
+	// Type content
+	typeRef uint64
+}
+
+func (c *yjsContent) countable() bool {
+	return c.ref != yjsContentDeleted && c.ref != yjsContentFormat
+}
+
+// Split the content at offset, keeping the first part and
+// returning the second
+func (c *yjsContent) splice(offset uint64) yjsContent {
+	right := yjsContent{ref: c.ref, typeRef: c.typeRef}
+	switch c.ref {
+	case yjsContentString:
+		right.str = append([]uint16{}, c.str[offset:]...)
+		c.str = c.str[:offset]
+	case yjsContentAny, yjsContentJSON:
+		right.values = append([]interface{}{}, c.values[offset:]...)
+		c.values = c.values[:offset]
+		right.rawValues = append([][]byte{}, c.rawValues[offset:]...)
+		c.rawValues = c.rawValues[:offset]
+	}
+	right.length = c.length - offset
+	c.length = offset
+	return right
+}
+
+// A struct from an update: an item, a GC'd range, or a skipped
+// range
+type yjsStruct struct {
+	kind   int
+	id     yjsID
+	length uint64
+	// Encoded struct, from the info byte on
+	raw []byte
+
+	// Item fields
+	info        byte
+	origin      *yjsID
+	rightOrigin *yjsID
+	parentKey   *string
+	parentID    *yjsID
+	parentSub   *string
+	content     yjsContent
+}
+
+type yjsRange struct {
+	clock  uint64
+	length uint64
+}
+
+type yjsUpdate struct {
+	structs map[uint64][]*yjsStruct
+	deletes map[uint64][]yjsRange
+}
+
+func readYjsID(d *yjsDecoder) (*yjsID, error) {
+	client, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	clock, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	return &yjsID{client: client, clock: clock}, nil
+}
+
+func readYjsContent(d *yjsDecoder, ref byte) (yjsContent, error) {
+	c := yjsContent{ref: ref, length: 1}
+	var err error
+	switch ref {
+	case yjsContentDeleted:
+		c.length, err = d.readVarUint()
+	case yjsContentJSON:
+		var n uint64
+		if n, err = d.readVarUint(); err != nil {
+			return c, err
+		}
+		for i := uint64(0); i < n; i++ {
+			start := d.pos
+			var s string
+			if s, err = d.readVarString(); err != nil {
+				return c, err
+			}
+			c.values = append(c.values, s)
+			c.rawValues = append(c.rawValues, d.buf[start:d.pos])
+		}
+		c.length = n
+	case yjsContentBinary:
+		_, err = d.readVarUint8Array()
+	case yjsContentString:
+		var s string
+		if s, err = d.readVarString(); err != nil {
+			return c, err
+		}
+		c.str = jsStringUnits(s)
+		c.length = uint64(len(c.str))
+	case yjsContentEmbed:
+		_, err = d.readVarString()
+	case yjsContentFormat:
+		if _, err = d.readVarString(); err != nil {
+			return c, err
+		}
+		_, err = d.readVarString()
+	case yjsContentType:
+		if c.typeRef, err = d.readVarUint(); err != nil {
+			return c, err
+		}
+		if c.typeRef == yjsXmlElementRef || c.typeRef == yjsXmlHookRef {
+			_, err = d.readVarString()
+		}
+	case yjsContentAny:
+		var n uint64
+		if n, err = d.readVarUint(); err != nil {
+			return c, err
+		}
+		for i := uint64(0); i < n; i++ {
+			start := d.pos
+			var v interface{}
+			if v, err = d.readAny(); err != nil {
+				return c, err
+			}
+			c.values = append(c.values, v)
+			c.rawValues = append(c.rawValues, d.buf[start:d.pos])
+		}
+		c.length = n
+	case yjsContentDoc:
+		if _, err = d.readVarString(); err != nil {
+			return c, err
+		}
+		_, err = d.readAny()
+	default:
+		err = errYjsDecode
+	}
+	return c, err
+}
+
+func readYjsStruct(d *yjsDecoder, id yjsID) (*yjsStruct, error) {
+	start := d.pos
+	info, err := d.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	s := &yjsStruct{id: id, info: info}
+	switch info & 0x1f {
+	case yjsStructGC, yjsStructSkip:
+		s.kind = int(info & 0x1f)
+		if s.length, err = d.readVarUint(); err != nil {
+			return nil, err
+		}
+	default:
+		s.kind = -1
+		if info&0x80 != 0 {
+			if s.origin, err = readYjsID(d); err != nil {
+				return nil, err
+			}
+		}
+		if info&0x40 != 0 {
+			if s.rightOrigin, err = readYjsID(d); err != nil {
+				return nil, err
+			}
+		}
+		// The parent is only written when it can't be taken from
+		// the item's neighbours
+		if info&0xc0 == 0 {
+			isKey, err := d.readVarUint()
+			if err != nil {
+				return nil, err
+			}
+			if isKey == 1 {
+				key, err := d.readVarString()
+				if err != nil {
+					return nil, err
+				}
+				s.parentKey = &key
+			} else if s.parentID, err = readYjsID(d); err != nil {
+				return nil, err
+			}
+			if info&0x20 != 0 {
+				sub, err := d.readVarString()
+				if err != nil {
+					return nil, err
+				}
+				s.parentSub = &sub
+			}
+		}
+		if s.content, err = readYjsContent(d, info&0x1f); err != nil {
+			return nil, err
+		}
+		s.length = s.content.length
+	}
+	if s.length == 0 {
+		return nil, errYjsDecode
+	}
+	s.raw = d.buf[start:d.pos]
+	return s, nil
+}
+
+func decodeYjsUpdate(update []byte) (*yjsUpdate, error) {
+	d := newYjsDecoder(update)
+	u := &yjsUpdate{
+		structs: make(map[uint64][]*yjsStruct),
+		deletes: make(map[uint64][]yjsRange),
+	}
+	numClients, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numClients; i++ {
+		numStructs, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		clock, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < numStructs; j++ {
+			s, err := readYjsStruct(d, yjsID{client: client, clock: clock})
+			if err != nil {
+				return nil, err
+			}
+			clock += s.length
+			u.structs[client] = append(u.structs[client], s)
+		}
+	}
+
+	numClients, err = d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numClients; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		numRanges, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < numRanges; j++ {
+			clock, err := d.readVarUint()
+			if err != nil {
+				return nil, err
+			}
+			length, err := d.readVarUint()
+			if err != nil {
+				return nil, err
+			}
+			u.deletes[client] = append(u.deletes[client], yjsRange{clock: clock, length: length})
+		}
+	}
+	if !d.done() {
+		return nil, errYjsDecode
+	}
+	return u, nil
+}
+
+// The part of a struct from offset on, encoded the way Yjs
+// encodes it (the origin becomes the last clock before offset)
+func sliceYjsStruct(s *yjsStruct, offset uint64) (*yjsStruct, error) {
+	e := &yjsEncoder{}
+	sliced := *s
+	sliced.id.clock += offset
+	sliced.length -= offset
+	switch s.kind {
+	case yjsStructGC:
+		e.writeUint8(yjsStructGC)
+		e.writeVarUint(sliced.length)
+	case yjsStructSkip:
+		e.writeUint8(yjsStructSkip)
+		e.writeVarUint(sliced.length)
+	default:
+		sliced.origin = &yjsID{client: s.id.client, clock: sliced.id.clock - 1}
+		sliced.parentKey, sliced.parentID = nil, nil
+		sliced.info = s.info | 0x80
+		e.writeUint8(sliced.info)
+		e.writeVarUint(sliced.origin.client)
+		e.writeVarUint(sliced.origin.clock)
+		if s.rightOrigin != nil {
+			e.writeVarUint(s.rightOrigin.client)
+			e.writeVarUint(s.rightOrigin.clock)
+		}
+		content := s.content
+		sliced.content = content.splice(offset)
+		switch sliced.content.ref {
+		case yjsContentDeleted:
+			e.writeVarUint(sliced.length)
+		case yjsContentString:
+			e.writeVarString(string(utf16.Decode(sliced.content.str)))
+		case yjsContentAny, yjsContentJSON:
+			e.writeVarUint(sliced.length)
+			for _, raw := range sliced.content.rawValues {
+				e.buf = append(e.buf, raw...)
+			}
+		default:
+			// Other content always has a length of one
+			return nil, errYjsDecode
+		}
+	}
+	sliced.raw = e.buf
+	return &sliced, nil
+}
+
+// Sort structs by clock, dropping skips and anything that is
+// already covered by an earlier struct
+func sortYjsStructs(structs []*yjsStruct) ([]*yjsStruct, error) {
+	sort.SliceStable(structs, func(i, j int) bool {
+		return structs[i].id.clock < structs[j].id.clock
+	})
+	sorted := []*yjsStruct{}
+	var end uint64
+	for _, s := range structs {
+		if s.kind == yjsStructSkip {
+			continue
+		}
+		if len(sorted) > 0 && s.id.clock < end {
+			if s.id.clock+s.length <= end {
+				continue
+			}
+			// Same structs, split up differently by different clients
+			var err error
+			if s, err = sliceYjsStruct(s, end-s.id.clock); err != nil {
+				return nil, err
+			}
+		}
+		sorted = append(sorted, s)
+		end = s.id.clock + s.length
+	}
+	return sorted, nil
+}
+
+func mergeYjsRanges(ranges []yjsRange) []yjsRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].clock < ranges[j].clock
+	})
+	merged := []yjsRange{}
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.clock <= merged[n-1].clock+merged[n-1].length {
+			last := &merged[n-1]
+			if end := r.clock + r.length; end > last.clock+last.length {
+				last.length = end - last.clock
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func sortedClients(m map[uint64][]*yjsStruct) []uint64 {
+	clients := make([]uint64, 0, len(m))
+	for client := range m {
+		clients = append(clients, client)
+	}
+	// Highest client first, like Yjs
+	sort.Slice(clients, func(i, j int) bool { return clients[i] > clients[j] })
+	return clients
+}
+
+// Merge several updates into one equivalent update
+func mergeYjsUpdates(updates [][]byte) ([]byte, error) {
+	all := make(map[uint64][]*yjsStruct)
+	deletes := make(map[uint64][]yjsRange)
+	for _, update := range updates {
+		u, err := decodeYjsUpdate(update)
+		if err != nil {
+			return nil, err
+		}
+		for client, structs := range u.structs {
+			all[client] = append(all[client], structs...)
+		}
+		for client, ranges := range u.deletes {
+			deletes[client] = append(deletes[client], ranges...)
+		}
+	}
+
+	e := &yjsEncoder{}
+	sections := make(map[uint64][]*yjsStruct)
+	for client, structs := range all {
+		sorted, err := sortYjsStructs(structs)
+		if err != nil {
+			return nil, err
+		}
+		if len(sorted) > 0 {
+			sections[client] = sorted
+		}
+	}
+	e.writeVarUint(uint64(len(sections)))
+	for _, client := range sortedClients(sections) {
+		structs := sections[client]
+		// Gaps between structs are filled with skips
+		numStructs := len(structs)
+		for i := 1; i < len(structs); i++ {
+			if structs[i].id.clock > structs[i-1].id.clock+structs[i-1].length {
+				numStructs++
+			}
+		}
+		e.writeVarUint(uint64(numStructs))
+		e.writeVarUint(client)
+		e.writeVarUint(structs[0].id.clock)
+		for i, s := range structs {
+			if i > 0 {
+				if end := structs[i-1].id.clock + structs[i-1].length; s.id.clock > end {
+					e.writeUint8(yjsStructSkip)
+					e.writeVarUint(s.id.clock - end)
+				}
+			}
+			e.buf = append(e.buf, s.raw...)
+		}
+	}
+
+	clients := make([]uint64, 0, len(deletes))
+	for client, ranges := range deletes {
+		if len(ranges) > 0 {
+			clients = append(clients, client)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] > clients[j] })
+	e.writeVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		ranges := mergeYjsRanges(deletes[client])
+		e.writeVarUint(client)
+		e.writeVarUint(uint64(len(ranges)))
+		for _, r := range ranges {
+			e.writeVarUint(r.clock)
+			e.writeVarUint(r.length)
+		}
+	}
+	return e.buf, nil
+}
+
+// State vector of a (merged) update: for each client, the clock up
+// to which all of its structs are present
+func yjsStateVector(update []byte) ([]byte, error) {
+	u, err := decodeYjsUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+	clocks := make(map[uint64]uint64)
+	for client, structs := range u.structs {
+		sort.SliceStable(structs, func(i, j int) bool {
+			return structs[i].id.clock < structs[j].id.clock
+		})
+		var clock uint64
+		for _, s := range structs {
+			if s.kind == yjsStructSkip || s.id.clock > clock {
+				break
+			}
+			if end := s.id.clock + s.length; end > clock {
+				clock = end
+			}
+		}
+		if clock > 0 {
+			clocks[client] = clock
+		}
+	}
+
+	clients := make([]uint64, 0, len(clocks))
+	for client := range clocks {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] > clients[j] })
+	e := &yjsEncoder{}
+	e.writeVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		e.writeVarUint(client)
+		e.writeVarUint(clocks[client])
+	}
+	return e.buf, nil
+}
+
+// An update with nothing in it
+func emptyYjsUpdate() []byte {
+	return []byte{0, 0}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Updates in the Yjs v1 format, as sent by the editor. Each is the
+// update emitted by a single transaction on a Y.Doc with the given
+// client ID.
+var yjsFixtures = map[string]string{
+	// Client 1: getText('codemirror').insert(0, 'hello')
+	"hello": "0101010004010a636f64656d6972726f720568656c6c6f00",
+	// Client 1: insert(5, ' world')
+	"world": "010101058401040620776f726c6400",
+	// Client 1: encodeStateAsUpdate after both inserts (which Yjs
+	// merges into a single item)
+	"helloWorld": "0101010004010a636f64656d6972726f720b68656c6c6f20776f726c6400",
+	// Client 1: delete(0, 6)
+	"delete": "000101010006",
+	// Client 2, concurrently with client 1: insert(0, 'X')
+	"x": "0101020004010a636f64656d6972726f72015800",
+	// Client 3: insert(0, 'a😀b'), then delete(1, 2)
+	"emoji":       "0101030004010a636f64656d6972726f720661f09f98806200",
+	"emojiDelete": "000103010102",
+	// Client 4: getMap('editor contents').set('ruby', 'puts 1'),
+	// then set('ruby', 'puts 2'), then
+	// getMap('switch language status').set('active', true)
+	"mapSet":    "0101040028010f656469746f7220636f6e74656e7473047275627901770670757473203100",
+	"mapUpdate": "01010401a804000177067075747320320104010001",
+	"mapBool":   "01010402280116737769746368206c616e67756167652073746174757306616374697665017800",
+}
+
+func yjsFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(yjsFixtures[name])
+	if err != nil {
+		t.Fatalf("bad fixture %s: %s", name, err)
+	}
+	return b
+}
+
+func mergeYjsFixtures(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var updates [][]byte
+	for _, name := range names {
+		updates = append(updates, yjsFixture(t, name))
+	}
+	merged, err := mergeYjsUpdates(updates)
+	if err != nil {
+		t.Fatalf("merging %v: %s", names, err)
+	}
+	return merged
+}
+
+func yjsFixtureText(t *testing.T, names ...string) string {
+	t.Helper()
+	doc, err := loadYjsDoc(mergeYjsFixtures(t, names...))
+	if err != nil {
+		t.Fatalf("loading %v: %s", names, err)
+	}
+	return doc.getText("codemirror")
+}
+
+func TestYjsUpdateRoundTrip(t *testing.T) {
+	for name := range yjsFixtures {
+		update := yjsFixture(t, name)
+		merged, err := mergeYjsUpdates([][]byte{update})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !bytes.Equal(merged, update) {
+			t.Errorf("%s: got %x, want %x", name, merged, update)
+		}
+	}
+}
+
+func TestYjsMergeSequentialUpdates(t *testing.T) {
+	merged := mergeYjsFixtures(t, "hello", "world")
+	// Yjs keeps the items of merged updates apart
+	want := "0102010004010a636f64656d6972726f720568656c6c6f8401040620776f726c6400"
+	if got := hex.EncodeToString(merged); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if reversed := mergeYjsFixtures(t, "world", "hello"); !bytes.Equal(reversed, merged) {
+		t.Errorf("merge depends on order: %x", reversed)
+	}
+	// The full state overlaps the first update, and has to be split
+	// where it does
+	if overlapping := mergeYjsFixtures(t, "hello", "helloWorld"); !bytes.Equal(overlapping, merged) {
+		t.Errorf("overlapping merge: got %x, want %x", overlapping, merged)
+	}
+	if got := yjsFixtureText(t, "hello", "world"); got != "hello world" {
+		t.Errorf("text is %q", got)
+	}
+	if got := yjsFixtureText(t, "helloWorld"); got != "hello world" {
+		t.Errorf("text of full state is %q", got)
+	}
+}
+
+func TestYjsDeletes(t *testing.T) {
+	if got := yjsFixtureText(t, "hello", "world", "delete"); got != "world" {
+		t.Errorf("text is %q", got)
+	}
+	if got := yjsFixtureText(t, "helloWorld", "delete"); got != "world" {
+		t.Errorf("text of full state is %q", got)
+	}
+	// Offsets are in UTF-16 code units, like in JavaScript
+	if got := yjsFixtureText(t, "emoji", "emojiDelete"); got != "ab" {
+		t.Errorf("text is %q", got)
+	}
+}
+
+func TestYjsConcurrentInserts(t *testing.T) {
+	// Conflicting inserts are ordered by client ID, lowest first
+	for _, order := range [][]string{{"hello", "x"}, {"x", "hello"}} {
+		if got := yjsFixtureText(t, order...); got != "helloX" {
+			t.Errorf("%v: text is %q", order, got)
+		}
+	}
+}
+
+func TestYjsMaps(t *testing.T) {
+	doc, err := loadYjsDoc(mergeYjsFixtures(t, "mapSet", "mapUpdate", "mapBool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := doc.getMap("editor contents")["ruby"]; got != "puts 2" {
+		t.Errorf("editor contents ruby is %v", got)
+	}
+	if got := doc.getMap("switch language status")["active"]; got != true {
+		t.Errorf("switch language status active is %v", got)
+	}
+}
+
+func TestYjsStateVector(t *testing.T) {
+	tests := []struct {
+		update []byte
+		want   string
+	}{
+		{mergeYjsFixtures(t, "hello", "world"), "01010b"},
+		{yjsFixture(t, "helloWorld"), "01010b"},
+		// Highest client first
+		{mergeYjsFixtures(t, "hello", "x"), "0202010105"},
+		{mergeYjsFixtures(t, "emoji", "emojiDelete"), "010304"},
+		// Nothing is known from client 1 without its first struct
+		{yjsFixture(t, "world"), "00"},
+	}
+	for _, test := range tests {
+		sv, err := yjsStateVector(test.update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(sv); got != test.want {
+			t.Errorf("state vector of %x is %s, want %s", test.update, got, test.want)
+		}
+	}
+}
+
+func TestYjsMissingDependencies(t *testing.T) {
+	doc, err := loadYjsDoc(yjsFixture(t, "world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := doc.getText("codemirror"); got != "" {
+		t.Errorf("text is %q, want nothing until the first insert arrives", got)
+	}
+}
+
+func TestYjsInvalidUpdates(t *testing.T) {
+	update := yjsFixture(t, "hello")
+	for i := 1; i < len(update); i++ {
+		if _, err := decodeYjsUpdate(update[:i]); err == nil {
+			t.Errorf("no error decoding first %d bytes", i)
+		}
+	}
+	if _, err := decodeYjsUpdate(append(update, 0)); err == nil {
+		t.Error("no error decoding trailing data")
+	}
+}